@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"log"
 	"net/mail"
 	"os"
 
+	"github.com/cptaffe/email2rss/internal/fetch"
 	"github.com/cptaffe/email2rss/internal/journalclub"
 )
 
+var (
+	offline = flag.Bool("offline", false, "Leave out data such as the audio size which must be fetched from the network")
+)
+
 func main() {
 	flag.Parse()
 	msg, err := mail.ReadMessage(os.Stdin)
@@ -17,11 +23,19 @@ func main() {
 		log.Fatalf("parse message: %v", err)
 	}
 
-	back := &journalclub.Backend{}
+	opts := fetch.DefaultOptions
+	opts.Offline = *offline
+	back := journalclub.NewBackend(fetch.NewClient(opts))
 	jc, err := back.FromMessage(msg)
 	if err != nil {
 		log.Fatalf("construct journalclub message: %v", err)
 	}
+	if !*offline {
+		err = back.Enrich(context.Background(), jc)
+		if err != nil {
+			log.Fatalf("fetch audio and paper details: %v", err)
+		}
+	}
 	err = json.NewEncoder(os.Stdout).Encode(&jc)
 	if err != nil {
 		log.Fatalf("serialize journalclub message as JSON: %v", err)
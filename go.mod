@@ -2,7 +2,10 @@ module github.com/cptaffe/email2rss
 
 go 1.23
 
-require gocloud.dev v0.40.0
+require (
+	gocloud.dev v0.40.0
+	golang.org/x/net v0.28.0
+)
 
 require (
 	cloud.google.com/go v0.115.0 // indirect
@@ -27,7 +30,6 @@ require (
 	go.opentelemetry.io/otel/metric v1.28.0 // indirect
 	go.opentelemetry.io/otel/trace v1.28.0 // indirect
 	golang.org/x/crypto v0.26.0 // indirect
-	golang.org/x/net v0.28.0 // indirect
 	golang.org/x/oauth2 v0.22.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/sys v0.24.0 // indirect
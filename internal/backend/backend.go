@@ -2,8 +2,10 @@
 package backend
 
 import (
+	"context"
 	"io"
 	"net/mail"
+	"time"
 )
 
 type Item interface {
@@ -14,6 +16,97 @@ type Item interface {
 type Backend interface {
 	Name() string
 	TemplatePath() string
+	// ItemTemplatePath names the HTML template for an item's page
+	ItemTemplatePath() string
 	FromMessage(*mail.Message) (Item, error)
 	Decode(r io.Reader) (Item, error)
 }
+
+// Enricher is implemented by backends whose items need data from the network.
+// Items are stored as soon as they are parsed, then enriched in the background
+// and retried until Enrich succeeds, so that network failures don't lose emails.
+type Enricher interface {
+	Enrich(ctx context.Context, item Item) error
+}
+
+// Enclosure describes a media file attached to an item, e.g. a podcast episode's audio
+type Enclosure struct {
+	URL      string        `json:"url"`
+	Length   int64         `json:"length"`
+	Type     string        `json:"type"`
+	Title    string        `json:"title,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// Enclosed is implemented by items which carry media, so templates can render
+// enclosure metadata without knowing about each backend's item type
+type Enclosed interface {
+	Enclosures() []Enclosure
+}
+
+// Chapter marks a section of an item's media, in the Podcasting 2.0 JSON chapters format
+type Chapter struct {
+	StartTime float64 `json:"startTime"`
+	EndTime   float64 `json:"endTime,omitempty"`
+	Title     string  `json:"title,omitempty"`
+	URL       string  `json:"url,omitempty"`
+}
+
+// Chaptered is implemented by items whose media is divided into chapters
+type Chaptered interface {
+	Chapters() []Chapter
+}
+
+// Mirrorable is implemented by items which reference remote files, such as
+// images and audio, which can be copied into the bucket in case they expire
+type Mirrorable interface {
+	// RemoteURLs lists the remote files the item references
+	RemoteURLs() []string
+	// ReplaceURLs rewrites references to remote files using a map of old to new URLs
+	ReplaceURLs(replacements map[string]string)
+}
+
+// Filterable is implemented by items whose HTML and links pass through the
+// privacy filters applied to every item before it's stored
+type Filterable interface {
+	// Filter rewrites the item's HTML using html and each of its links using url
+	Filter(html, url func(string) string)
+}
+
+// Listable is implemented by items which can be listed in a feed's archive
+type Listable interface {
+	Title() string
+	Published() time.Time
+	// Summary is a plain text description of the item
+	Summary() string
+}
+
+// Asset is a file carried within an email, such as an inline image or an attachment
+type Asset struct {
+	// ContentID is referenced from the item's HTML by cid: URLs
+	ContentID string
+	// Attachment is set for files the sender attached rather than embedded in the HTML
+	Attachment  bool
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Embedded is implemented by items parsed from emails which carry their own
+// files, which are stored in the bucket before the item is written.
+// Once stored, references to each asset's cid: URL are replaced using Mirrorable.
+type Embedded interface {
+	EmbeddedAssets() []Asset
+}
+
+// Numbered is implemented by items numbered in the order they're added to their feed, such as
+// podcast episodes, whose numbers mustn't change once they're published
+type Numbered interface {
+	Number() int
+	SetNumber(int)
+}
+
+// Attachable is implemented by items which publish their email's attachments as enclosures
+type Attachable interface {
+	Attach(Enclosure)
+}
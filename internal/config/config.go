@@ -0,0 +1,220 @@
+// Package config holds the per-feed settings of an email2rss instance, read from a JSON file
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const DefaultBaseURL = "https://connor.zip"
+
+type Config struct {
+	// BaseURL is where the server is reachable, used to construct links to items and assets
+	BaseURL string `json:"baseURL"`
+	// Identity is who emails are addressed to, for feeds which don't set their own
+	Identity Identity `json:"identity"`
+	// Hub is an external WebSub hub for feeds to advertise, instead of the built-in hub
+	Hub string `json:"hub,omitempty"`
+	// Relays are trusted to report how they authenticated the mail they pass on, in ARC chains they seal
+	Relays []string `json:"relays,omitempty"`
+	// RelayAccess maps relays to the token or credentials they POST email with. The Authentication-Results
+	// headers naming a relay are only believed on email it POSTed itself, as anyone else could write them.
+	RelayAccess map[string]*Access `json:"relayAccess,omitempty"`
+	// SMTP is the relay mailto: unsubscribe requests are sent through
+	SMTP *SMTP `json:"smtp,omitempty"`
+	// Admin restricts the endpoints which manage the instance to holders of a token or credentials.
+	// They're disabled if it isn't set.
+	Admin *Access `json:"admin,omitempty"`
+	// Routes pick the feed of email sent to POST /email2rss/email, the first which matches winning
+	Routes []Route         `json:"routes,omitempty"`
+	Feeds  map[string]Feed `json:"feeds"`
+}
+
+// SMTP is a mail relay, which is sent to with STARTTLS if it offers it
+type SMTP struct {
+	// Addr is the relay's host and port, e.g. smtp.example.com:587
+	Addr string `json:"addr"`
+	// From is the address mail is sent from
+	From string `json:"from"`
+	// Username and Password authenticate with the relay using PLAIN, if set
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Route sends email to a feed when all of its conditions, case-insensitive regular
+// expressions, match. A route without conditions matches any email.
+type Route struct {
+	// Name identifies the route when reporting a match
+	Name string `json:"name,omitempty"`
+	Feed string `json:"feed"`
+	// ListID is matched against the identifier of the List-Id header
+	ListID string `json:"listID,omitempty"`
+	// From is matched against the address the email is from
+	From string `json:"from,omitempty"`
+	// Tag is matched against the plus-address tags of the recipients, e.g. digest for connor+digest@example.com
+	Tag string `json:"tag,omitempty"`
+	// Subject is matched against the decoded subject
+	Subject string `json:"subject,omitempty"`
+	// Headers match other headers by name
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Identity describes a recipient, whose details are redacted from items before they're published.
+// The addresses and names an email is addressed to are always redacted, so this only needs
+// to list those which appear in emails without being in their headers.
+type Identity struct {
+	// Names are removed from greetings such as "Hi Connor,"
+	Names []string `json:"names,omitempty"`
+	// Addresses are replaced wherever they appear
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// Feed configures optional behaviour of a single feed
+type Feed struct {
+	// Mirror copies remote images and audio into the bucket, so that items
+	// don't break when the newsletter's hosting expires
+	Mirror bool `json:"mirror"`
+	// Extract keeps only the article of each email, dropping headers, footers
+	// and other boilerplate, for feeds using the generic backend
+	Extract bool `json:"extract"`
+	// ResolveLinks follows click-tracking redirects which can't be decoded from the link,
+	// which registers a click with the tracker, so links are otherwise left as they are
+	ResolveLinks bool `json:"resolveLinks,omitempty"`
+	// Attachments publishes files attached to emails as enclosures, if set
+	Attachments *Attachments `json:"attachments,omitempty"`
+	// Identity overrides the recipient the feed's emails are addressed to
+	Identity *Identity `json:"identity,omitempty"`
+	// Locked marks a podcast feed podcast:locked, asking platforms not to import it into another account
+	Locked bool `json:"locked,omitempty"`
+	// History is how many previously published versions of the feed are kept for rollback
+	History int `json:"history,omitempty"`
+	// Webhooks are sent each item written to the feed
+	Webhooks []Webhook `json:"webhooks,omitempty"`
+	// Private restricts the feed to readers with a token or credentials, if set,
+	// and hides it from the instance's listings
+	Private *Access `json:"private,omitempty"`
+	// Senders restricts the feed to email authenticated as from one of its domains, if set
+	Senders *Senders `json:"senders,omitempty"`
+	// Confirmations holds back emails confirming subscriptions to the feed instead of publishing them, if set
+	Confirmations *Confirmations `json:"confirmations,omitempty"`
+}
+
+// Confirmations recognises the emails newsletters send to confirm a subscription
+type Confirmations struct {
+	// Subjects are case-insensitive regular expressions matching the subjects of confirmation emails,
+	// and Links their confirmation links by text or URL, replacing the defaults if set
+	Subjects []string `json:"subjects,omitempty"`
+	Links    []string `json:"links,omitempty"`
+	// Follow lists sender domains, along with their subdomains, whose confirmation links are followed
+	// automatically, if the feed authenticated the email's sender and the link is within the domain
+	Follow []string `json:"follow,omitempty"`
+}
+
+const (
+	// ActionReject refuses email from unauthenticated senders
+	ActionReject = "reject"
+	// ActionQuarantine holds email from unauthenticated senders under {feed}/quarantine/
+	ActionQuarantine = "quarantine"
+)
+
+// Senders lists who a feed accepts email from
+type Senders struct {
+	// Domains are accepted along with their subdomains
+	Domains []string `json:"domains"`
+	// Action is taken with email which isn't from an accepted sender, ActionReject by default
+	Action string `json:"action,omitempty"`
+}
+
+// Access lists who may read a private feed, or manage the instance
+type Access struct {
+	// Tokens are secrets which grant access when given in the token query parameter,
+	// making capability URLs for podcast apps which don't support credentials
+	Tokens []string `json:"tokens,omitempty"`
+	// Users maps usernames to passwords for HTTP Basic auth
+	Users map[string]string `json:"users,omitempty"`
+}
+
+// Webhook receives the JSON of items, signed with HMAC-SHA256 if it has a secret
+type Webhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+}
+
+const DefaultHistory = 10
+
+// HistoryLength is the number of previous versions of the feed to keep
+func (f Feed) HistoryLength() int {
+	if f.History <= 0 {
+		return DefaultHistory
+	}
+	return f.History
+}
+
+const DefaultMaxAttachmentSize = 25 * 1024 * 1024
+
+// DefaultAttachmentTypes are allowed when a feed doesn't list its own
+var DefaultAttachmentTypes = []string{"application/pdf", "audio/*", "video/*", "image/*"}
+
+// Attachments limits which attached files are published
+type Attachments struct {
+	// Types allowlists media types, where a subtype of * matches any subtype e.g. audio/*
+	Types []string `json:"types,omitempty"`
+	// MaxSize in bytes of each attachment
+	MaxSize int64 `json:"maxSize,omitempty"`
+}
+
+// Allows reports whether an attachment of the given type and size may be published
+func (a *Attachments) Allows(mediaType string, size int64) bool {
+	if a == nil {
+		return false
+	}
+	maxSize := a.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxAttachmentSize
+	}
+	if size > maxSize {
+		return false
+	}
+	types := a.Types
+	if len(types) == 0 {
+		types = DefaultAttachmentTypes
+	}
+	mediaType = strings.ToLower(mediaType)
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Default is used when no configuration file is given
+func Default() *Config {
+	return &Config{BaseURL: DefaultBaseURL}
+}
+
+// Load reads a configuration file
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	cfg := Default()
+	err = json.Unmarshal(b, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parse config file `%s`: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Feed returns the settings for a feed, which are all off for unconfigured feeds
+func (c *Config) Feed(name string) Feed {
+	feed := c.Feeds[name]
+	if feed.Identity == nil {
+		feed.Identity = &c.Identity
+	}
+	return feed
+}
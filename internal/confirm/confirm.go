@@ -0,0 +1,184 @@
+// Package confirm recognises the emails newsletters send to confirm a subscription, and finds their confirmation links
+package confirm
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/cptaffe/email2rss/internal/email"
+	nethtml "golang.org/x/net/html"
+)
+
+// DefaultSubjects match the subjects of confirmation emails, for detectors which aren't given their own
+var DefaultSubjects = []string{
+	`\b(confirm|verify|activate)\b.*\b(subscri\w*|sign[ -]?up|e-?mail|address|account)\b`,
+	`\bplease confirm\b`,
+	`\bone (more|last) step\b`,
+	`\bdouble opt-?in\b`,
+}
+
+// DefaultLinks match the text or URL of confirmation links, for detectors which aren't given their own
+var DefaultLinks = []string{
+	`\b(confirm|verify|activate)`,
+	`\bopt-?in\b`,
+	`\byes,? (subscribe|sign me up)\b`,
+}
+
+// unsubscribeRegexp matches links which would do the opposite of confirming
+var unsubscribeRegexp = regexp.MustCompile(`(?i)unsubscribe|opt-?out|not you|report`)
+
+// urlRegexp finds links in plain text bodies
+var urlRegexp = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// Detector recognises confirmation emails by their subject, and picks their confirmation link
+type Detector struct {
+	subjects []*regexp.Regexp
+	links    []*regexp.Regexp
+}
+
+// Confirmation is a detected confirmation email
+type Confirmation struct {
+	Subject string
+	// Link is the URL which confirms the subscription
+	Link string
+}
+
+// New compiles case-insensitive regular expressions matched against the decoded subject and against
+// the text and URL of each link, using DefaultSubjects and DefaultLinks for those not given
+func New(subjects, links []string) (*Detector, error) {
+	if len(subjects) == 0 {
+		subjects = DefaultSubjects
+	}
+	if len(links) == 0 {
+		links = DefaultLinks
+	}
+	d := &Detector{}
+	for _, pattern := range subjects {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("compile subject pattern: %w", err)
+		}
+		d.subjects = append(d.subjects, re)
+	}
+	for _, pattern := range links {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("compile link pattern: %w", err)
+		}
+		d.links = append(d.links, re)
+	}
+	return d, nil
+}
+
+// Detect reports whether a raw email is a confirmation, which it is if its subject
+// matches and it has a link to confirm with
+func (d *Detector) Detect(raw []byte) (*Confirmation, bool) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, false
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	if !matchAny(d.subjects, subject) {
+		return nil, false
+	}
+	parts, err := email.Parts(msg)
+	if err != nil {
+		return nil, false
+	}
+	var candidates []link
+	if part := email.Find(parts, "text/html"); part != nil {
+		candidates = htmlLinks(part.Body)
+	} else if part := email.Find(parts, "text/plain"); part != nil {
+		candidates = textLinks(part.Body)
+	}
+	for _, l := range candidates {
+		u, err := url.Parse(l.href)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			continue
+		}
+		if unsubscribeRegexp.MatchString(l.text) || unsubscribeRegexp.MatchString(l.href) {
+			continue
+		}
+		if matchAny(d.links, l.text) || matchAny(d.links, l.href) {
+			return &Confirmation{Subject: subject, Link: l.href}, true
+		}
+	}
+	return nil, false
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// link is a URL along with the text describing it
+type link struct {
+	href, text string
+}
+
+// htmlLinks finds the anchors of an HTML body, in order
+func htmlLinks(body []byte) []link {
+	var links []link
+	var current *link
+	var text strings.Builder
+	z := nethtml.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case nethtml.ErrorToken:
+			return links
+		case nethtml.StartTagToken:
+			token := z.Token()
+			if token.Data != "a" {
+				continue
+			}
+			current = &link{}
+			text.Reset()
+			for _, attr := range token.Attr {
+				if attr.Key == "href" {
+					current.href = strings.TrimSpace(attr.Val)
+				}
+			}
+		case nethtml.TextToken:
+			if current != nil {
+				text.Write(z.Text())
+				text.WriteByte(' ')
+			}
+		case nethtml.EndTagToken:
+			name, _ := z.TagName()
+			if string(name) != "a" || current == nil {
+				continue
+			}
+			current.text = strings.Join(strings.Fields(text.String()), " ")
+			links = append(links, *current)
+			current = nil
+		}
+	}
+}
+
+// textLinks finds the URLs of a plain text body, described by the line they're on
+func textLinks(body []byte) []link {
+	var links []link
+	var previous string
+	for _, line := range strings.Split(string(body), "\n") {
+		for _, href := range urlRegexp.FindAllString(line, -1) {
+			// Instructions often precede the link on a line of their own
+			links = append(links, link{href: strings.TrimRight(href, ".,;:!?)"), text: previous + " " + line})
+		}
+		if strings.TrimSpace(line) != "" {
+			previous = line
+		}
+	}
+	return links
+}
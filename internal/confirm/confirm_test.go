@@ -0,0 +1,63 @@
+package confirm
+
+import (
+	"testing"
+)
+
+const htmlEmail = "From: Weekly Digest <digest@news.example.com>\r\n" +
+	"Subject: =?UTF-8?Q?Confirm_your_subscription_to_Weekly_Digest?=\r\n" +
+	"Content-Type: text/html; charset=UTF-8\r\n" +
+	"\r\n" +
+	`<p>Thanks for signing up!</p>` +
+	`<p><a href="https://news.example.com/unsubscribe?id=42">Unsubscribe</a></p>` +
+	`<p><a href="https://news.example.com/about">About us</a></p>` +
+	`<p><a href=" https://news.example.com/subscribe/confirm?token=abc&amp;id=42 "><b>Yes,</b> confirm</a></p>`
+
+const textEmail = "From: Reports <reports@example.com>\r\n" +
+	"Subject: One more step\r\n" +
+	"Content-Type: text/plain; charset=UTF-8\r\n" +
+	"\r\n" +
+	"Hi,\r\n" +
+	"Read our policy at https://example.com/privacy.\r\n" +
+	"\r\n" +
+	"To activate your subscription, open this link:\r\n" +
+	"https://lists.example.com/optin?u=1&id=2.\r\n"
+
+func TestDetect(t *testing.T) {
+	d, err := New(nil, nil)
+	if err != nil {
+		t.Fatalf("construct detector: %v", err)
+	}
+	for _, test := range []struct {
+		name  string
+		email string
+		link  string
+	}{
+		{"html", htmlEmail, "https://news.example.com/subscribe/confirm?token=abc&id=42"},
+		{"text", textEmail, "https://lists.example.com/optin?u=1&id=2"},
+		{"newsletter", "Subject: This week's reading\r\n\r\n<a href=\"https://example.com/confirm\">Confirm</a>", ""},
+		{"no link", "Subject: Please confirm your email\r\n\r\n<a href=\"https://example.com/unsubscribe/confirm\">Confirm unsubscribe</a>", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, ok := d.Detect([]byte(test.email))
+			if ok != (test.link != "") {
+				t.Fatalf("detected is %t, expected %t", ok, test.link != "")
+			}
+			if ok && c.Link != test.link {
+				t.Errorf("link is %q, expected %q", c.Link, test.link)
+			}
+		})
+	}
+
+	d, err = New([]string{`^welcome`}, []string{`^get started$`})
+	if err != nil {
+		t.Fatalf("construct detector: %v", err)
+	}
+	c, ok := d.Detect([]byte("Subject: Welcome aboard\r\nContent-Type: text/html\r\n\r\n<a href=\"https://example.com/s/1\">Get started</a>"))
+	if !ok || c.Link != "https://example.com/s/1" || c.Subject != "Welcome aboard" {
+		t.Errorf("detected %+v, %t with custom patterns", c, ok)
+	}
+	if _, err := New([]string{`(`}, nil); err == nil {
+		t.Errorf("constructed detector with an invalid pattern")
+	}
+}
@@ -1,6 +1,7 @@
 package email
 
 import (
+	"bytes"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -8,41 +9,110 @@ import (
 	"mime/multipart"
 	"mime/quotedprintable"
 	"net/mail"
+	"net/textproto"
 	"strings"
 )
 
-// MessageMIME finds and parses a portion of the message based on the MIME type
-func MessageMIME(message *mail.Message, contentType string) (io.Reader, error) {
-	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+// Part is a leaf of a message's MIME tree, with its transfer encoding decoded
+type Part struct {
+	Header    textproto.MIMEHeader
+	MediaType string
+	Params    map[string]string
+	Body      []byte
+}
+
+// ContentID is the part's Content-ID without angle brackets, as referenced by cid: URLs
+func (p *Part) ContentID() string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(p.Header.Get("Content-ID")), "<"), ">")
+}
+
+// Disposition is the part's Content-Disposition, e.g. inline or attachment
+func (p *Part) Disposition() string {
+	disposition, _, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
 	if err != nil {
-		return nil, fmt.Errorf("parse message content type: %w", err)
+		return ""
 	}
-	if !strings.HasPrefix(mediaType, "multipart/") {
-		return nil, fmt.Errorf("expected multipart message but found %s", mediaType)
+	return disposition
+}
+
+// Filename is the name the sender gave the part, if any
+func (p *Part) Filename() string {
+	_, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err == nil && params["filename"] != "" {
+		return params["filename"]
 	}
-	reader := multipart.NewReader(message.Body, params["boundary"])
-	if reader == nil {
-		return nil, fmt.Errorf("could not construct multipart reader for message")
+	return p.Params["name"]
+}
+
+// Parts flattens a message's MIME tree into its leaf parts, in order
+func Parts(message *mail.Message) ([]*Part, error) {
+	return parts(textproto.MIMEHeader(message.Header), message.Body)
+}
+
+func parts(header textproto.MIMEHeader, body io.Reader) ([]*Part, error) {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
 	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("parse content type: %w", err)
+	}
+
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		var r io.Reader
+		switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+		case "base64":
+			r = base64.NewDecoder(base64.StdEncoding, body)
+		case "quoted-printable":
+			r = quotedprintable.NewReader(body)
+		default:
+			r = body
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("read %s part: %w", mediaType, err)
+		}
+		return []*Part{{Header: header, MediaType: mediaType, Params: params, Body: b}}, nil
+	}
+
+	reader := multipart.NewReader(body, params["boundary"])
+	var leaves []*Part
 	for {
-		part, err := reader.NextPart()
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			return leaves, nil
+		}
 		if err != nil {
-			return nil, fmt.Errorf("could not find %s part of message: %w", contentType, err)
+			return nil, fmt.Errorf("read multipart message part: %w", err)
 		}
-		mediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		children, err := parts(part.Header, part)
 		if err != nil {
-			return nil, fmt.Errorf("parse multipart message part content type: %w", err)
+			return nil, err
 		}
-		if mediaType == contentType {
-			enc := strings.ToLower(part.Header.Get("Content-Transfer-Encoding"))
-			switch enc {
-			case "base64":
-				return base64.NewDecoder(base64.StdEncoding, part), nil
-			case "quoted-printable":
-				return quotedprintable.NewReader(part), nil
-			default:
-				return part, nil
-			}
+		leaves = append(leaves, children...)
+	}
+}
+
+// MessageMIME finds and parses a portion of the message based on the MIME type
+func MessageMIME(message *mail.Message, contentType string) (io.Reader, error) {
+	leaves, err := Parts(message)
+	if err != nil {
+		return nil, fmt.Errorf("parse message parts: %w", err)
+	}
+	part := Find(leaves, contentType)
+	if part == nil {
+		return nil, fmt.Errorf("could not find %s part of message", contentType)
+	}
+	return bytes.NewReader(part.Body), nil
+}
+
+// Find returns the first part with the given media type, or nil
+func Find(leaves []*Part, mediaType string) *Part {
+	for _, part := range leaves {
+		if part.MediaType == mediaType && part.Disposition() != "attachment" {
+			return part
 		}
 	}
+	return nil
 }
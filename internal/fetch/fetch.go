@@ -0,0 +1,284 @@
+// Package fetch provides the HTTP client backends use to enrich items from the network,
+// with timeouts, retries, a response cache and an offline mode
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	UserAgent = "email2rss/1.0 (+https://connor.zip/email2rss)"
+	// maxCachedBody bounds the responses kept in the cache, which are usually
+	// HEAD requests or ranged requests for the start of a file
+	maxCachedBody = 1024 * 1024
+	// maxCacheEntries bounds the size of the cache, which is simply emptied when full
+	maxCacheEntries = 1024
+)
+
+// ErrOffline is returned for every request made by an offline client
+var ErrOffline = errors.New("network access disabled in offline mode")
+
+// ErrNotPublic is returned for requests to addresses which aren't on the public internet,
+// such as loopback, private and link-local addresses, by clients restricted to public addresses
+var ErrNotPublic = errors.New("address is not public")
+
+// nonPublic are ranges IsGlobalUnicast and IsPrivate don't rule out, which aren't reachable on the internet
+var nonPublic = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// Public reports whether an address is on the public internet
+func Public(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublic {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// refuseNonPublic is a dialer control which refuses to connect to addresses which aren't public.
+// It sees the address after resolution, so a hostname can't be made to resolve to one.
+func refuseNonPublic(network, address string, c syscall.RawConn) error {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("parse address %s: %w", address, err)
+	}
+	if !Public(addr.Addr()) {
+		return fmt.Errorf("connect to %s: %w", address, ErrNotPublic)
+	}
+	return nil
+}
+
+// publicTransport is http.DefaultTransport restricted to public addresses. It doesn't use a
+// proxy, as the proxy's address is all the dialer would see.
+func publicTransport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: refuseNonPublic}
+	t.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, address)
+	}
+	return t
+}
+
+// IsOffline reports whether err is due to the client being offline
+func IsOffline(err error) bool {
+	return errors.Is(err, ErrOffline)
+}
+
+type Options struct {
+	// Timeout bounds each request, including retries
+	Timeout time.Duration
+	// Retries is the number of times a failed request is repeated
+	Retries int
+	// Backoff is the delay before the first retry, doubling on each subsequent retry
+	Backoff time.Duration
+	// CacheTTL is how long successful responses are reused, zero disables the cache
+	CacheTTL time.Duration
+	// Offline fails all requests with ErrOffline without touching the network
+	Offline bool
+	// PublicOnly refuses requests to addresses which aren't on the public internet, for clients
+	// requesting URLs from untrusted sources such as emails. It applies when Transport is nil.
+	PublicOnly bool
+	// Transport makes the underlying requests, http.DefaultTransport if nil
+	Transport http.RoundTripper
+}
+
+// DefaultOptions are suitable for fetching metadata during ingestion
+var DefaultOptions = Options{
+	Timeout:  30 * time.Second,
+	Retries:  2,
+	Backoff:  500 * time.Millisecond,
+	CacheTTL: time.Hour,
+}
+
+// NewClient constructs an HTTP client which applies opts to every request
+func NewClient(opts Options) *http.Client {
+	base := opts.Transport
+	if base == nil && opts.PublicOnly {
+		base = publicTransport()
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &http.Client{
+		Timeout: opts.Timeout,
+		Transport: &Transport{
+			Base:     base,
+			Retries:  opts.Retries,
+			Backoff:  opts.Backoff,
+			CacheTTL: opts.CacheTTL,
+			Offline:  opts.Offline,
+		},
+	}
+}
+
+// Transport adds a User-Agent, retries and caching to a base transport
+type Transport struct {
+	Base     http.RoundTripper
+	Retries  int
+	Backoff  time.Duration
+	CacheTTL time.Duration
+	Offline  bool
+
+	mu    sync.Mutex
+	cache map[string]*cachedResponse
+}
+
+type cachedResponse struct {
+	expires       time.Time
+	status        string
+	statusCode    int
+	header        http.Header
+	contentLength int64
+	body          []byte
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Offline {
+		return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL, ErrOffline)
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("%s %s: unsupported scheme %q", req.Method, req.URL, req.URL.Scheme)
+	}
+
+	cacheable := t.CacheTTL > 0 && (req.Method == http.MethodGet || req.Method == http.MethodHead)
+	key := req.Method + " " + req.URL.String() + " " + req.Header.Get("Range")
+	if cacheable {
+		if resp := t.cached(key, req); resp != nil {
+			return resp, nil
+		}
+	}
+
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", UserAgent)
+	}
+
+	resp, err := t.roundTripWithRetries(req)
+	if err != nil {
+		return nil, err
+	}
+	if cacheable && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent) {
+		return t.store(key, resp)
+	}
+	return resp, nil
+}
+
+func (t *Transport) roundTripWithRetries(req *http.Request) (*http.Response, error) {
+	// Requests with bodies can only be retried if the body can be rewound
+	retries := t.Retries
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		retries = 0
+	}
+
+	backoff := t.Backoff
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("rewind request body: %w", err)
+			}
+			req.Body = body
+		}
+		resp, err := t.Base.RoundTrip(req)
+		// Refused addresses won't become public on retrying
+		retryable := err != nil && !errors.Is(err, ErrNotPublic) || err == nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500)
+		if !retryable || attempt >= retries {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (t *Transport) cached(key string, req *http.Request) *http.Response {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.cache[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(c.expires) {
+		delete(t.cache, key)
+		return nil
+	}
+	return &http.Response{
+		Status:        c.status,
+		StatusCode:    c.statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        c.header.Clone(),
+		ContentLength: c.contentLength,
+		Body:          io.NopCloser(bytes.NewReader(c.body)),
+		Request:       req,
+	}
+}
+
+// store buffers a response into the cache, provided it is small enough
+func (t *Transport) store(key string, resp *http.Response) (*http.Response, error) {
+	if resp.ContentLength > maxCachedBody {
+		return resp, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCachedBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("read response body: %w", err)
+	}
+	if len(body) > maxCachedBody {
+		// Too large to cache, so hand back what was read followed by the rest
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cache == nil || len(t.cache) >= maxCacheEntries {
+		t.cache = map[string]*cachedResponse{}
+	}
+	t.cache[key] = &cachedResponse{
+		expires:       time.Now().Add(t.CacheTTL),
+		status:        resp.Status,
+		statusCode:    resp.StatusCode,
+		header:        resp.Header.Clone(),
+		contentLength: resp.ContentLength,
+		body:          body,
+	}
+	return resp, nil
+}
@@ -0,0 +1,140 @@
+package fetch
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetries(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if requests.Add(1) < 3 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		if ua := req.Header.Get("User-Agent"); ua != UserAgent {
+			t.Errorf("User-Agent is %s, expected %s", ua, UserAgent)
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	client := NewClient(Options{Timeout: time.Second, Retries: 2, Backoff: time.Millisecond})
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status is %d, expected 200", resp.StatusCode)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("server received %d requests, expected 3", n)
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	client := NewClient(Options{Timeout: time.Second, Retries: 1, Backoff: time.Millisecond})
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status is %d, expected the last response's 502", resp.StatusCode)
+	}
+}
+
+func TestCache(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Length", "12345")
+	}))
+	defer srv.Close()
+
+	client := NewClient(Options{Timeout: time.Second, CacheTTL: time.Minute})
+	for range 3 {
+		resp, err := client.Head(srv.URL)
+		if err != nil {
+			t.Fatalf("HEAD: %v", err)
+		}
+		resp.Body.Close()
+		if resp.ContentLength != 12345 {
+			t.Errorf("Content-Length is %d, expected 12345", resp.ContentLength)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("server received %d requests, expected 1", n)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Error("offline client made a request")
+	}))
+	defer srv.Close()
+
+	client := NewClient(Options{Offline: true})
+	_, err := client.Get(srv.URL)
+	if !IsOffline(err) {
+		t.Errorf("error is %v, expected ErrOffline", err)
+	}
+}
+
+func TestPublicOnly(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+	}))
+	defer srv.Close()
+
+	client := NewClient(Options{Timeout: time.Second, Retries: 2, Backoff: time.Millisecond, PublicOnly: true})
+	// The server listens on loopback, as would a service only meant to be reached from the host
+	for _, u := range []string{srv.URL, strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)} {
+		_, err := client.Get(u)
+		if !errors.Is(err, ErrNotPublic) {
+			t.Errorf("GET %s gave %v, expected ErrNotPublic", u, err)
+		}
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("server received %d requests, expected none", n)
+	}
+	_, err := client.Get("file:///etc/passwd")
+	if err == nil {
+		t.Errorf("GET of a file URL succeeded")
+	}
+
+	for addr, public := range map[string]bool{
+		"93.184.215.14":        true,
+		"2606:4700::6810:85e5": true,
+		"127.0.0.1":            false,
+		"::1":                  false,
+		"10.1.2.3":             false,
+		"172.16.0.1":           false,
+		"192.168.1.1":          false,
+		"169.254.169.254":      false,
+		"100.100.100.200":      false,
+		"0.0.0.0":              false,
+		"::ffff:127.0.0.1":     false,
+		"fd00:ec2::254":        false,
+		"fe80::1":              false,
+		"224.0.0.1":            false,
+	} {
+		if Public(netip.MustParseAddr(addr)) != public {
+			t.Errorf("%s is public: %t, expected %t", addr, !public, public)
+		}
+	}
+}
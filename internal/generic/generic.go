@@ -3,19 +3,32 @@ package generic
 import (
 	"encoding/json"
 	"fmt"
+	"html"
 	"io"
 	"mime"
 	"net/mail"
+	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/cptaffe/email2rss/internal/backend"
 	"github.com/cptaffe/email2rss/internal/email"
+	"github.com/cptaffe/email2rss/internal/readability"
+	"github.com/cptaffe/email2rss/internal/sanitize"
 )
 
 var (
-	_ backend.Item    = &Message{}
-	_ backend.Backend = &Backend{}
+	imageRegexp                    = regexp.MustCompile(`(<img\s(?:[^>]*\s)?src=")((?:https?|cid):[^"]+)(")`)
+	cidRegexp                      = regexp.MustCompile(`cid:[^"'\s<>()]+`)
+	_           backend.Item       = &Message{}
+	_           backend.Mirrorable = &Message{}
+	_           backend.Embedded   = &Message{}
+	_           backend.Enclosed   = &Message{}
+	_           backend.Attachable = &Message{}
+	_           backend.Filterable = &Message{}
+	_           backend.Listable   = &Message{}
+	_           backend.Backend    = &Backend{}
 )
 
 type Message struct {
@@ -23,8 +36,16 @@ type Message struct {
 	Subject string    `json:"subject"`
 	Date    time.Time `json:"date"`
 	Body    string    `json:"body"`
+	// Attachments are the files attached to the email which have been stored
+	Attachments []backend.Enclosure `json:"attachments,omitempty"`
+	// Inline holds the images the body references by cid: URL, along with
+	// the email's attachments, until they are stored
+	Inline []backend.Asset `json:"-"`
 }
 
+// summaryLength bounds the plain text description of an item
+const summaryLength = 300
+
 func (msg *Message) Key() string {
 	return msg.Date.Format(time.RFC3339)
 }
@@ -33,12 +54,96 @@ func (msg *Message) Encode(w io.Writer) error {
 	return json.NewEncoder(w).Encode(msg)
 }
 
+// Description is a plain text summary of the body, for the feed's <description>
+func (msg *Message) Description() string {
+	return readability.Summary(msg.Body, summaryLength)
+}
+
+func (msg *Message) Title() string {
+	return msg.Subject
+}
+
+func (msg *Message) Published() time.Time {
+	return msg.Date
+}
+
+func (msg *Message) Summary() string {
+	return msg.Description()
+}
+
+func (msg *Message) RemoteURLs() []string {
+	var urls []string
+	for _, matches := range imageRegexp.FindAllStringSubmatch(msg.Body, -1) {
+		if !strings.HasPrefix(matches[2], "cid:") {
+			urls = append(urls, html.UnescapeString(matches[2]))
+		}
+	}
+	return urls
+}
+
+func (msg *Message) EmbeddedAssets() []backend.Asset {
+	return msg.Inline
+}
+
+func (msg *Message) Enclosures() []backend.Enclosure {
+	return msg.Attachments
+}
+
+func (msg *Message) Attach(enclosure backend.Enclosure) {
+	msg.Attachments = append(msg.Attachments, enclosure)
+}
+
+func (msg *Message) ReplaceURLs(replacements map[string]string) {
+	msg.Body = imageRegexp.ReplaceAllStringFunc(msg.Body, func(img string) string {
+		matches := imageRegexp.FindStringSubmatch(img)
+		src := html.UnescapeString(matches[2])
+		if id, ok := contentID(src); ok {
+			src = "cid:" + id
+		}
+		u, ok := replacements[src]
+		if !ok {
+			return img
+		}
+		return matches[1] + html.EscapeString(u) + matches[3]
+	})
+}
+
+// contentID is the Content-ID a cid: URL references, which RFC 2392 allows to be %-encoded
+func contentID(u string) (string, bool) {
+	id, ok := strings.CutPrefix(u, "cid:")
+	if !ok {
+		return "", false
+	}
+	if unescaped, err := url.PathUnescape(id); err == nil {
+		id = unescaped
+	}
+	return id, true
+}
+
+func (msg *Message) Filter(html, url func(string) string) {
+	msg.Body = html(msg.Body)
+}
+
 type Backend struct {
-	name string
+	name    string
+	extract bool
 }
 
-func NewBackend(feed string) *Backend {
-	return &Backend{name: feed}
+type Option func(*Backend)
+
+// WithExtraction keeps only the article of each email, dropping its headers, footers and other boilerplate
+func WithExtraction() Option {
+	return func(b *Backend) {
+		b.extract = true
+	}
+}
+
+func NewBackend(feed string, opts ...Option) *Backend {
+	b := &Backend{name: feed}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
 }
 
 func (b *Backend) Name() string {
@@ -49,6 +154,10 @@ func (b *Backend) TemplatePath() string {
 	return "generic.xml.tmpl"
 }
 
+func (b *Backend) ItemTemplatePath() string {
+	return "generic.html.tmpl"
+}
+
 func (b *Backend) FromMessage(msg *mail.Message) (backend.Item, error) {
 	date, err := msg.Header.Date()
 	if err != nil {
@@ -61,22 +170,51 @@ func (b *Backend) FromMessage(msg *mail.Message) (backend.Item, error) {
 		return nil, fmt.Errorf("decode Subject of message using RFC 2047: %w", err)
 	}
 
-	html, err := email.MessageMIME(msg, "text/html")
+	parts, err := email.Parts(msg)
 	if err != nil {
-		return nil, fmt.Errorf("find HTML MIME portion of message body: %w", err)
+		return nil, fmt.Errorf("parse MIME parts of message body: %w", err)
 	}
-	var sb strings.Builder
-	_, err = io.Copy(&sb, html)
-	if err != nil {
-		return nil, fmt.Errorf("read HTML as string: %w", err)
+	htmlPart := email.Find(parts, "text/html")
+	if htmlPart == nil {
+		return nil, fmt.Errorf("find HTML MIME portion of message body: no text/html part")
+	}
+	body := string(htmlPart.Body)
+	if b.extract {
+		body = readability.Extract(body)
+	}
+	// Bodies are served from our domain, so must not be able to run script
+	body = sanitize.HTML(body)
+
+	// Keep attachments, and the parts of multipart/related emails which the HTML references
+	references := map[string]bool{}
+	for _, u := range cidRegexp.FindAllString(body, -1) {
+		if id, ok := contentID(html.UnescapeString(u)); ok {
+			references[id] = true
+		}
+	}
+	var inline []backend.Asset
+	for _, part := range parts {
+		cid := part.ContentID()
+		attachment := part.Disposition() == "attachment"
+		referenced := cid != "" && references[cid]
+		if part == htmlPart || !(attachment || referenced) {
+			continue
+		}
+		inline = append(inline, backend.Asset{
+			ContentID:   cid,
+			Attachment:  attachment,
+			Filename:    part.Filename(),
+			ContentType: part.MediaType,
+			Data:        part.Body,
+		})
 	}
-	body := sb.String()
 
 	return &Message{
 		UUID:    msg.Header.Get("X-Apple-UUID"),
 		Subject: subject,
 		Date:    date,
 		Body:    body,
+		Inline:  inline,
 	}, nil
 }
 
@@ -1,30 +1,59 @@
 package journalclub
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"mime"
 	"net/http"
 	"net/mail"
+	"net/url"
 	"regexp"
-	"strconv"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/cptaffe/email2rss/internal/backend"
 	"github.com/cptaffe/email2rss/internal/email"
+	"github.com/cptaffe/email2rss/internal/fetch"
+	"github.com/cptaffe/email2rss/internal/mp3"
+	"github.com/cptaffe/email2rss/internal/readability"
 )
 
 var (
-	audioRegexp                       = regexp.MustCompile(`"(https?://[^ ]+\.mp3)"`)
-	imageRegexp                       = regexp.MustCompile(`<img src="(https?://[^ ]*)"`)
-	descriptionRegexp                 = regexp.MustCompile(`Hi[ ]+Connor, (.*)</p>`)
-	paperRegexp                       = regexp.MustCompile(`<a [^>]*href="(https?://(\w+\.)?doi.org[^"]*)"[^>]*>`)
-	_                 backend.Item    = &Message{}
-	_                 backend.Backend = &Backend{}
+	audioRegexp                          = regexp.MustCompile(`"(https?://[^ ]+\.mp3)"`)
+	imageRegexp                          = regexp.MustCompile(`<img src="(https?://[^ ]*)"`)
+	descriptionRegexp                    = regexp.MustCompile(`(?:Hi|Hello|Hey|Dear)[ ]+[^,<]+, (.*)</p>`)
+	paperRegexp                          = regexp.MustCompile(`<a [^>]*href="(https?://(\w+\.)?doi.org[^"]*)"[^>]*>`)
+	authorsRegexp                        = regexp.MustCompile(`The authors are ([^,<]+)`)
+	transcriptRegexp                     = regexp.MustCompile(`"(https?://[^ "]+\.(vtt|srt))"`)
+	chaptersRegexp                       = regexp.MustCompile(`"(https?://[^ "]+chapters\.json)"`)
+	_                 backend.Item       = &Message{}
+	_                 backend.Enclosed   = &Message{}
+	_                 backend.Chaptered  = &Message{}
+	_                 backend.Mirrorable = &Message{}
+	_                 backend.Filterable = &Message{}
+	_                 backend.Listable   = &Message{}
+	_                 backend.Backend    = &Backend{}
+	_                 backend.Enricher   = &Backend{}
 )
 
+// Transcript is rendered as a podcast:transcript element
+type Transcript struct {
+	URL  string `json:"url"`
+	Type string `json:"type"`
+}
+
+// Person is rendered as a podcast:person element
+type Person struct {
+	Name  string `json:"name"`
+	Role  string `json:"role,omitempty"`
+	Group string `json:"group,omitempty"`
+	Href  string `json:"href,omitempty"`
+}
+
 type Message struct {
 	UUID        string    `json:"uuid"`
 	Subject     string    `json:"subject"`
@@ -34,8 +63,23 @@ type Message struct {
 	AudioURL    string    `json:"audioURL"`
 	AudioSize   int       `json:"audioSize"`
 	PaperURL    string    `json:"paperURL"`
+	PaperTitle  string    `json:"paperTitle,omitempty"`
+	// Duration of the audio in seconds
+	Duration int `json:"duration,omitempty"`
+	// Bitrate of the audio in bits per second
+	Bitrate       int               `json:"bitrate,omitempty"`
+	AudioChapters []backend.Chapter `json:"chapters,omitempty"`
+	Episode       int               `json:"episode,omitempty"`
+	Transcripts   []Transcript      `json:"transcripts,omitempty"`
+	ChaptersURL   string            `json:"chaptersURL,omitempty"`
+	Persons       []Person          `json:"persons,omitempty"`
+	// artwork is the picture in the audio's ID3 tags, held until it's stored as an asset
+	artwork *backend.Asset
 }
 
+// artworkContentID references the audio's artwork until it's stored
+const artworkContentID = "artwork"
+
 func (msg *Message) Key() string {
 	return msg.Date.Format(time.RFC3339)
 }
@@ -44,7 +88,100 @@ func (msg *Message) Encode(w io.Writer) error {
 	return json.NewEncoder(w).Encode(msg)
 }
 
-type Backend struct{}
+func (msg *Message) EmbeddedAssets() []backend.Asset {
+	if msg.artwork == nil {
+		return nil
+	}
+	return []backend.Asset{*msg.artwork}
+}
+
+func (msg *Message) Number() int {
+	return msg.Episode
+}
+
+func (msg *Message) SetNumber(n int) {
+	msg.Episode = n
+}
+
+func (msg *Message) Title() string {
+	return msg.Subject
+}
+
+func (msg *Message) Published() time.Time {
+	return msg.Date
+}
+
+// Summary is the description without its markup
+func (msg *Message) Summary() string {
+	return readability.Text(msg.Description)
+}
+
+func (msg *Message) Chapters() []backend.Chapter {
+	return msg.AudioChapters
+}
+
+func (msg *Message) RemoteURLs() []string {
+	var urls []string
+	for _, u := range []string{msg.ImageURL, msg.AudioURL} {
+		if u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+func (msg *Message) ReplaceURLs(replacements map[string]string) {
+	if u, ok := replacements[msg.ImageURL]; ok {
+		msg.ImageURL = u
+	}
+	if u, ok := replacements[msg.AudioURL]; ok {
+		msg.AudioURL = u
+	}
+}
+
+func (msg *Message) Filter(html, url func(string) string) {
+	msg.Description = html(msg.Description)
+	links := []*string{&msg.ImageURL, &msg.AudioURL, &msg.PaperURL, &msg.ChaptersURL}
+	for i := range msg.Transcripts {
+		links = append(links, &msg.Transcripts[i].URL)
+	}
+	for i := range msg.Persons {
+		links = append(links, &msg.Persons[i].Href)
+	}
+	for _, link := range links {
+		if *link != "" {
+			*link = url(*link)
+		}
+	}
+}
+
+func (msg *Message) Enclosures() []backend.Enclosure {
+	if msg.AudioURL == "" {
+		return nil
+	}
+	return []backend.Enclosure{{
+		URL:      msg.AudioURL,
+		Length:   int64(msg.AudioSize),
+		Type:     "audio/mpeg",
+		Duration: time.Duration(msg.Duration) * time.Second,
+	}}
+}
+
+type Backend struct {
+	client *http.Client
+}
+
+// NewBackend constructs a backend which fetches audio metadata using client
+func NewBackend(client *http.Client) *Backend {
+	return &Backend{client: client}
+}
+
+func (b *Backend) httpClient() *http.Client {
+	if b.client == nil {
+		return http.DefaultClient
+	}
+	return b.client
+}
 
 func (b *Backend) Name() string {
 	return "journalclub"
@@ -54,6 +191,10 @@ func (b *Backend) TemplatePath() string {
 	return "journalclub.xml.tmpl"
 }
 
+func (b *Backend) ItemTemplatePath() string {
+	return "journalclub.html.tmpl"
+}
+
 func (b *Backend) FromMessage(msg *mail.Message) (backend.Item, error) {
 	date, err := msg.Header.Date()
 	if err != nil {
@@ -100,14 +241,23 @@ func (b *Backend) FromMessage(msg *mail.Message) (backend.Item, error) {
 		paperURL = matches[1]
 	}
 
-	audioResponse, err := http.Head(audioURL)
-	if err != nil {
-		return nil, fmt.Errorf("HEAD audio url: %w", err)
+	var transcripts []Transcript
+	for _, matches := range transcriptRegexp.FindAllStringSubmatch(body, -1) {
+		typ := "text/vtt"
+		if matches[2] == "srt" {
+			typ = "application/srt"
+		}
+		transcripts = append(transcripts, Transcript{URL: matches[1], Type: typ})
 	}
-	defer audioResponse.Body.Close()
-	audioSize, err := strconv.Atoi(audioResponse.Header.Get("Content-Length"))
-	if err != nil {
-		return nil, fmt.Errorf("fetch size of audio: %w", err)
+	var chaptersURL string
+	matches = chaptersRegexp.FindStringSubmatch(body)
+	if matches != nil {
+		chaptersURL = matches[1]
+	}
+	var persons []Person
+	matches = authorsRegexp.FindStringSubmatch(body)
+	if matches != nil {
+		persons = append(persons, Person{Name: strings.TrimSpace(matches[1]), Role: "author", Group: "writing"})
 	}
 
 	return &Message{
@@ -117,11 +267,124 @@ func (b *Backend) FromMessage(msg *mail.Message) (backend.Item, error) {
 		Date:        date,
 		ImageURL:    imageURL,
 		AudioURL:    audioURL,
-		AudioSize:   audioSize,
 		PaperURL:    paperURL,
+		Transcripts: transcripts,
+		ChaptersURL: chaptersURL,
+		Persons:     persons,
 	}, nil
 }
 
+// Enrich fills in the audio metadata and paper details which must be fetched from the network
+func (b *Backend) Enrich(ctx context.Context, item backend.Item) error {
+	msg, ok := item.(*Message)
+	if !ok {
+		return fmt.Errorf("expected a journalclub message but found %T", item)
+	}
+
+	if msg.AudioURL != "" && msg.AudioSize == 0 {
+		prober := &mp3.Prober{Client: b.httpClient()}
+		audio, err := prober.Probe(ctx, msg.AudioURL)
+		if audio == nil {
+			return fmt.Errorf("probe audio: %w", err)
+		}
+		if err != nil {
+			// The size is enough for the enclosure, the rest is nice to have
+			log.Printf("probe audio metadata: %v", err)
+		}
+		msg.AudioSize = int(audio.Size)
+		if msg.Subject == "" {
+			msg.Subject = audio.Title
+		}
+		// The episode's artwork stands in for an image the email doesn't have
+		if msg.ImageURL == "" && audio.Artwork != nil {
+			msg.artwork = &backend.Asset{ContentID: artworkContentID, Filename: "artwork", ContentType: audio.Artwork.MIMEType, Data: audio.Artwork.Data}
+			msg.ImageURL = "cid:" + artworkContentID
+		}
+		msg.Duration = int(audio.Duration.Round(time.Second).Seconds())
+		msg.Bitrate = audio.Bitrate
+		msg.AudioChapters = nil
+		for _, chapter := range audio.Chapters {
+			msg.AudioChapters = append(msg.AudioChapters, backend.Chapter{
+				StartTime: chapter.Start.Seconds(),
+				EndTime:   chapter.End.Seconds(),
+				Title:     chapter.Title,
+				URL:       chapter.URL,
+			})
+		}
+	}
+
+	if msg.PaperURL != "" && msg.PaperTitle == "" {
+		paper, err := lookupDOI(ctx, b.httpClient(), msg.PaperURL)
+		switch {
+		case fetch.IsOffline(err):
+			return fmt.Errorf("look up paper: %w", err)
+		case err != nil:
+			// Not every DOI is registered with an agency supporting content negotiation
+			log.Printf("look up paper %s: %v", msg.PaperURL, err)
+		default:
+			msg.PaperTitle = paper.Title
+			if len(paper.Authors) > 0 {
+				msg.Persons = slices.DeleteFunc(msg.Persons, func(p Person) bool { return p.Role == "author" })
+				for _, author := range paper.Authors {
+					msg.Persons = append(msg.Persons, Person{Name: author, Role: "author", Group: "writing"})
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// paper is the subset of CSL JSON metadata we use
+type paper struct {
+	Title   string
+	Authors []string
+}
+
+// lookupDOI fetches citation metadata for a DOI URL using content negotiation
+func lookupDOI(ctx context.Context, client *http.Client, doiURL string) (*paper, error) {
+	u, err := url.Parse(doiURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse DOI url: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://doi.org"+u.Path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("construct request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.citationstyles.csl+json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %w", req.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", req.URL, resp.Status)
+	}
+
+	var csl struct {
+		Title  string `json:"title"`
+		Author []struct {
+			Given   string `json:"given"`
+			Family  string `json:"family"`
+			Literal string `json:"literal"`
+		} `json:"author"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&csl)
+	if err != nil {
+		return nil, fmt.Errorf("parse CSL JSON: %w", err)
+	}
+	p := &paper{Title: csl.Title}
+	for _, author := range csl.Author {
+		name := author.Literal
+		if name == "" {
+			name = strings.TrimSpace(author.Given + " " + author.Family)
+		}
+		if name != "" {
+			p.Authors = append(p.Authors, name)
+		}
+	}
+	return p, nil
+}
+
 func (b *Backend) Decode(r io.Reader) (backend.Item, error) {
 	var item Message
 	err := json.NewDecoder(r).Decode(&item)
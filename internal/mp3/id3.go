@@ -0,0 +1,196 @@
+package mp3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// syncsafe decodes an ID3v2 integer which uses only the low seven bits of each byte
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// id3Size returns the length of the ID3v2 tag at the start of b, including its header and footer
+func id3Size(b []byte) (int, bool) {
+	if len(b) < 10 || string(b[:3]) != "ID3" {
+		return 0, false
+	}
+	size := 10 + syncsafe(b[6:10])
+	if b[5]&0x10 != 0 {
+		// Footer present
+		size += 10
+	}
+	return size, true
+}
+
+// parseID3 reads the frames email2rss cares about from an ID3v2.3 or ID3v2.4 tag
+func parseID3(tag []byte, info *Info) error {
+	version := tag[3]
+	if version != 3 && version != 4 {
+		// ID3v2.2 uses three character frame IDs which we don't read
+		return nil
+	}
+	size := 10 + syncsafe(tag[6:10])
+	b := tag[10:size]
+	if tag[5]&0x40 != 0 {
+		// Skip the extended header
+		if len(b) < 4 {
+			return fmt.Errorf("truncated extended header")
+		}
+		n := int(binary.BigEndian.Uint32(b)) + 4
+		if version == 4 {
+			n = syncsafe(b)
+		}
+		if n > len(b) {
+			return fmt.Errorf("extended header of %d bytes overflows tag", n)
+		}
+		b = b[n:]
+	}
+
+	return readFrames(b, version, func(id string, data []byte) error {
+		switch id {
+		case "TIT2":
+			info.Title = decodeText(data)
+		case "APIC":
+			if info.Artwork != nil {
+				return nil
+			}
+			artwork, err := decodePicture(data)
+			if err != nil {
+				return fmt.Errorf("decode APIC frame: %w", err)
+			}
+			info.Artwork = artwork
+		case "CHAP":
+			chapter, err := decodeChapter(data, version)
+			if err != nil {
+				return fmt.Errorf("decode CHAP frame: %w", err)
+			}
+			info.Chapters = append(info.Chapters, *chapter)
+		}
+		return nil
+	})
+}
+
+// readFrames calls fn with the ID and contents of each frame in b
+func readFrames(b []byte, version byte, fn func(id string, data []byte) error) error {
+	for len(b) >= 10 {
+		if b[0] == 0 {
+			// Padding
+			return nil
+		}
+		id := string(b[:4])
+		size := int(binary.BigEndian.Uint32(b[4:8]))
+		if version == 4 {
+			size = syncsafe(b[4:8])
+		}
+		if 10+size > len(b) {
+			return fmt.Errorf("frame %s of %d bytes overflows tag", id, size)
+		}
+		err := fn(id, b[10:10+size])
+		if err != nil {
+			return err
+		}
+		b = b[10+size:]
+	}
+	return nil
+}
+
+// splitText splits a terminated string from the start of b in the given text encoding
+func splitText(b []byte, encoding byte) (string, []byte) {
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return decodeString(b[:i], encoding), b[i+2:]
+			}
+		}
+		return decodeString(b, encoding), nil
+	}
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return decodeString(b, encoding), nil
+	}
+	return decodeString(b[:i], encoding), b[i+1:]
+}
+
+// decodeText decodes a text information frame, which begins with its encoding
+func decodeText(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	text, _ := splitText(data[1:], data[0])
+	return text
+}
+
+func decodeString(b []byte, encoding byte) string {
+	switch encoding {
+	case 0:
+		// ISO-8859-1 maps directly onto the first 256 code points
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes)
+	case 1, 2:
+		order := binary.ByteOrder(binary.BigEndian)
+		if encoding == 1 && len(b) >= 2 {
+			if b[0] == 0xff && b[1] == 0xfe {
+				order = binary.LittleEndian
+			}
+			if (b[0] == 0xff && b[1] == 0xfe) || (b[0] == 0xfe && b[1] == 0xff) {
+				b = b[2:]
+			}
+		}
+		units := make([]uint16, len(b)/2)
+		for i := range units {
+			units[i] = order.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(units))
+	default:
+		return strings.TrimRight(string(b), "\x00")
+	}
+}
+
+func decodePicture(data []byte) (*Artwork, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("truncated frame")
+	}
+	encoding := data[0]
+	mimeType, rest := splitText(data[1:], 0)
+	if len(rest) < 1 {
+		return nil, fmt.Errorf("missing picture type")
+	}
+	_, rest = splitText(rest[1:], encoding)
+	return &Artwork{MIMEType: mimeType, Data: rest}, nil
+}
+
+func decodeChapter(data []byte, version byte) (*Chapter, error) {
+	id, rest := splitText(data, 0)
+	if len(rest) < 16 {
+		return nil, fmt.Errorf("truncated chapter %s", id)
+	}
+	chapter := &Chapter{
+		ID:    id,
+		Start: time.Duration(binary.BigEndian.Uint32(rest[0:4])) * time.Millisecond,
+		End:   time.Duration(binary.BigEndian.Uint32(rest[4:8])) * time.Millisecond,
+	}
+	err := readFrames(rest[16:], version, func(id string, data []byte) error {
+		switch id {
+		case "TIT2":
+			chapter.Title = decodeText(data)
+		case "WXXX":
+			if len(data) > 0 {
+				_, url := splitText(data[1:], data[0])
+				chapter.URL = decodeString(url, 0)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read chapter %s subframes: %w", id, err)
+	}
+	return chapter, nil
+}
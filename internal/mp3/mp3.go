@@ -0,0 +1,258 @@
+// Package mp3 reads enough of an MP3 file to describe it in a feed: its
+// duration, bitrate and ID3 metadata such as the title, artwork and chapters
+package mp3
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Info describes an MP3 file
+type Info struct {
+	// Size of the whole file in bytes
+	Size       int64
+	Duration   time.Duration
+	Bitrate    int // bits per second, averaged for VBR files
+	SampleRate int
+	VBR        bool
+	Title      string
+	Artwork    *Artwork
+	Chapters   []Chapter
+}
+
+// Artwork is an attached picture from an APIC frame
+type Artwork struct {
+	MIMEType string
+	Data     []byte
+}
+
+// Chapter is a CHAP frame
+type Chapter struct {
+	ID    string
+	Start time.Duration
+	End   time.Duration
+	Title string
+	URL   string
+}
+
+// frameHeader is the decoded four byte header of an MPEG audio frame
+type frameHeader struct {
+	version    int // 1, 2 or 25 for MPEG 2.5
+	layer      int
+	bitrate    int // bits per second
+	sampleRate int
+	padding    bool
+	mono       bool
+}
+
+var (
+	// bitrates in kbps indexed by [version 1 or 2][layer-1][index]
+	bitrates = [2][3][16]int{
+		{
+			{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+			{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+		},
+		{
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		},
+	}
+	sampleRates = map[int][3]int{
+		1:  {44100, 48000, 32000},
+		2:  {22050, 24000, 16000},
+		25: {11025, 12000, 8000},
+	}
+)
+
+func parseFrameHeader(b []byte) (*frameHeader, bool) {
+	if len(b) < 4 || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return nil, false
+	}
+	var h frameHeader
+	switch (b[1] >> 3) & 0x3 {
+	case 0:
+		h.version = 25
+	case 2:
+		h.version = 2
+	case 3:
+		h.version = 1
+	default:
+		return nil, false
+	}
+	layer := int((b[1] >> 1) & 0x3)
+	if layer == 0 {
+		return nil, false
+	}
+	h.layer = 4 - layer
+	bitrateIndex := int(b[2] >> 4)
+	sampleRateIndex := int((b[2] >> 2) & 0x3)
+	if bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return nil, false
+	}
+	table := 0
+	if h.version != 1 {
+		table = 1
+	}
+	h.bitrate = bitrates[table][h.layer-1][bitrateIndex] * 1000
+	h.sampleRate = sampleRates[h.version][sampleRateIndex]
+	h.padding = b[2]&0x2 != 0
+	h.mono = b[3]>>6 == 0x3
+	return &h, true
+}
+
+// samples is the number of samples encoded in each frame
+func (h *frameHeader) samples() int {
+	switch {
+	case h.layer == 1:
+		return 384
+	case h.layer == 3 && h.version != 1:
+		return 576
+	default:
+		return 1152
+	}
+}
+
+// size is the length of the frame in bytes, including the header
+func (h *frameHeader) size() int {
+	padding := 0
+	if h.padding {
+		padding = 1
+	}
+	if h.layer == 1 {
+		return (12*h.bitrate/h.sampleRate + padding) * 4
+	}
+	return h.samples()/8*h.bitrate/h.sampleRate + padding
+}
+
+// sideInfoSize is the length of the layer III side information following the header,
+// which is where a Xing header begins
+func (h *frameHeader) sideInfoSize() int {
+	switch {
+	case h.version == 1 && h.mono:
+		return 17
+	case h.version == 1:
+		return 32
+	case h.mono:
+		return 9
+	default:
+		return 17
+	}
+}
+
+// Parse describes an MP3 file from its first bytes, which must include the
+// whole ID3v2 tag and the first audio frame. size is the length of the whole file.
+func Parse(b []byte, size int64) (*Info, error) {
+	info := &Info{Size: size}
+	offset := 0
+	if tagSize, ok := id3Size(b); ok {
+		if len(b) < tagSize {
+			return nil, fmt.Errorf("ID3 tag of %d bytes is truncated at %d bytes", tagSize, len(b))
+		}
+		err := parseID3(b[:tagSize], info)
+		if err != nil {
+			return nil, fmt.Errorf("parse ID3 tag: %w", err)
+		}
+		offset = tagSize
+	}
+
+	// Find the first frame, requiring the following frame to be valid too so
+	// that stray sync bits in junk data aren't mistaken for audio
+	var h *frameHeader
+	for ; offset+4 <= len(b); offset++ {
+		candidate, ok := parseFrameHeader(b[offset:])
+		if !ok {
+			continue
+		}
+		next := offset + candidate.size()
+		if next+4 <= len(b) {
+			if _, ok := parseFrameHeader(b[next:]); !ok {
+				continue
+			}
+		}
+		h = candidate
+		break
+	}
+	if h == nil {
+		return nil, fmt.Errorf("no MPEG audio frame found in the first %d bytes", len(b))
+	}
+	info.SampleRate = h.sampleRate
+	frame := b[offset:min(offset+h.size(), len(b))]
+
+	frames, length, vbr, ok := xing(frame, h)
+	if !ok {
+		frames, length, ok = vbri(frame)
+		vbr = ok
+	}
+	if ok {
+		info.VBR = vbr
+		info.Duration = time.Duration(frames) * time.Duration(h.samples()) * time.Second / time.Duration(h.sampleRate)
+		if length == 0 {
+			length = size - int64(offset)
+		}
+		info.Bitrate = int(float64(length*8) / info.Duration.Seconds())
+		return info, nil
+	}
+
+	// Constant bitrate, so the duration follows from the size of the audio
+	info.Bitrate = h.bitrate
+	audio := size - int64(offset)
+	if size >= 128 && hasID3v1(b, size) {
+		audio -= 128
+	}
+	info.Duration = time.Duration(audio*8) * time.Second / time.Duration(h.bitrate)
+	return info, nil
+}
+
+// xing reads the frame count from a Xing header in the first frame, or from
+// the Info header which LAME writes into constant bitrate files
+func xing(frame []byte, h *frameHeader) (frames int64, length int64, vbr bool, ok bool) {
+	if h.layer != 3 {
+		return 0, 0, false, false
+	}
+	b := frame[min(4+h.sideInfoSize(), len(frame)):]
+	if len(b) < 8 || (string(b[:4]) != "Xing" && string(b[:4]) != "Info") {
+		return 0, 0, false, false
+	}
+	vbr = string(b[:4]) == "Xing"
+	flags := binary.BigEndian.Uint32(b[4:8])
+	b = b[8:]
+	if flags&0x1 != 0 {
+		if len(b) < 4 {
+			return 0, 0, false, false
+		}
+		frames = int64(binary.BigEndian.Uint32(b))
+		b = b[4:]
+	}
+	if flags&0x2 != 0 {
+		if len(b) < 4 {
+			return 0, 0, false, false
+		}
+		length = int64(binary.BigEndian.Uint32(b))
+	}
+	return frames, length, vbr, frames > 0
+}
+
+// vbri reads the frame count from a Fraunhofer VBRI header, which always sits 32 bytes after the frame header
+func vbri(frame []byte) (frames int64, length int64, ok bool) {
+	if len(frame) < 36+18 {
+		return 0, 0, false
+	}
+	b := frame[36:]
+	if string(b[:4]) != "VBRI" {
+		return 0, 0, false
+	}
+	length = int64(binary.BigEndian.Uint32(b[10:14]))
+	frames = int64(binary.BigEndian.Uint32(b[14:18]))
+	return frames, length, frames > 0
+}
+
+// hasID3v1 reports whether b covers the end of the file and it carries an ID3v1 tag
+func hasID3v1(b []byte, size int64) bool {
+	if int64(len(b)) != size {
+		return false
+	}
+	return string(b[len(b)-128:len(b)-125]) == "TAG"
+}
@@ -0,0 +1,111 @@
+package mp3
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//go:embed test/*.mp3
+var fixtures embed.FS
+
+// serve serves the fixtures, honouring Range requests unless ranges is false
+func serve(t *testing.T, ranges bool) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, err := fixtures.ReadFile("test" + req.URL.Path)
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		if !ranges {
+			req.Header.Del("Range")
+		}
+		http.ServeContent(w, req, req.URL.Path, time.Time{}, bytes.NewReader(b))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		expected Info
+	}{
+		{
+			name: "constant bitrate with ID3 tags",
+			file: "/cbr.mp3",
+			expected: Info{
+				Size:       8706,
+				Duration:   521250 * time.Microsecond,
+				Bitrate:    128000,
+				SampleRate: 44100,
+				Title:      "Test Episode",
+				Artwork:    &Artwork{MIMEType: "image/png", Data: []byte("\x89PNG\r\n\x1a\nfakeimage")},
+				Chapters: []Chapter{
+					{ID: "ch0", Start: 0, End: 250 * time.Millisecond, Title: "Intro", URL: "https://example.com/intro"},
+					{ID: "ch1", Start: 250 * time.Millisecond, End: 521 * time.Millisecond, Title: "Main"},
+				},
+			},
+		},
+		{
+			name: "variable bitrate with Xing header",
+			file: "/xing.mp3",
+			expected: Info{
+				Size:       15017,
+				Duration:   1044897959,
+				Bitrate:    111781,
+				SampleRate: 44100,
+				VBR:        true,
+			},
+		},
+		{
+			name: "variable bitrate with VBRI header",
+			file: "/vbri.mp3",
+			expected: Info{
+				Size:       10464,
+				Duration:   720 * time.Millisecond,
+				Bitrate:    112000,
+				SampleRate: 48000,
+				VBR:        true,
+			},
+		},
+	}
+
+	for _, ranges := range []bool{true, false} {
+		srv := serve(t, ranges)
+		prober := &Prober{Client: srv.Client()}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				info, err := prober.Probe(context.Background(), srv.URL+test.file)
+				if err != nil {
+					t.Fatalf("probe: %v", err)
+				}
+				if !reflect.DeepEqual(*info, test.expected) {
+					t.Errorf("info does not match expected value (ranges %t):\nhave:    %+v\nexpected:%+v", ranges, *info, test.expected)
+				}
+			})
+		}
+	}
+}
+
+func TestProbeNotMP3(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "audio.mp3", time.Time{}, bytes.NewReader(make([]byte, 1000)))
+	}))
+	defer srv.Close()
+
+	prober := &Prober{Client: srv.Client()}
+	info, err := prober.Probe(context.Background(), srv.URL+"/audio.mp3")
+	if err == nil {
+		t.Fatal("expected an error for a file without MPEG frames")
+	}
+	if info == nil || info.Size != 1000 {
+		t.Errorf("expected the size to be reported alongside the error, have %+v", info)
+	}
+}
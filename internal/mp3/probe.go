@@ -0,0 +1,92 @@
+package mp3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// probeSize covers a typical ID3 tag and the first few audio frames
+	probeSize = 64 * 1024
+	// frameSize is fetched beyond the ID3 tag to reach the first frames
+	frameSize = 8 * 1024
+)
+
+// Prober describes remote MP3 files using ranged requests,
+// so that only the start of each file is downloaded
+type Prober struct {
+	Client *http.Client
+}
+
+// Probe fetches the start of the MP3 file at url and describes it.
+// If the file's size is known but its contents can't be understood, the
+// returned Info carries just the size alongside the error.
+func (p *Prober) Probe(ctx context.Context, url string) (*Info, error) {
+	b, size, err := p.fetch(ctx, url, probeSize)
+	if err != nil {
+		return nil, err
+	}
+	if tagSize, ok := id3Size(b); ok && tagSize+frameSize > len(b) && int64(len(b)) < size {
+		// Large tags, usually due to artwork, need a second request
+		b, size, err = p.fetch(ctx, url, tagSize+frameSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	info, err := Parse(b, size)
+	if err != nil {
+		return &Info{Size: size}, fmt.Errorf("parse %s: %w", url, err)
+	}
+	return info, nil
+}
+
+// fetch retrieves up to n bytes from the start of url, along with the size of the whole file
+func (p *Prober) fetch(ctx context.Context, url string, n int) ([]byte, int64, error) {
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("construct request: %w", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", n-1))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("GET %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	var size int64
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-65535/18218972
+		contentRange := resp.Header.Get("Content-Range")
+		i := strings.LastIndexByte(contentRange, '/')
+		if i < 0 {
+			return nil, 0, fmt.Errorf("parse Content-Range `%s`", contentRange)
+		}
+		size, err = strconv.ParseInt(contentRange[i+1:], 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("parse size from Content-Range `%s`: %w", contentRange, err)
+		}
+	case http.StatusOK:
+		// The server ignored the range, so we read just what we need of the whole file
+		size = resp.ContentLength
+		if size < 0 {
+			return nil, 0, fmt.Errorf("GET %s: no Content-Length", url)
+		}
+	default:
+		return nil, 0, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, int64(n)))
+	if err != nil {
+		return nil, 0, fmt.Errorf("read %s: %w", url, err)
+	}
+	return b, size, nil
+}
@@ -0,0 +1,282 @@
+// Package privacy removes the tracking newsletters add to their emails, so that
+// reading a feed doesn't report back to the sender: open-tracking pixels,
+// click-tracking redirects and analytics parameters
+package privacy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	nethtml "golang.org/x/net/html"
+)
+
+var (
+	// pixels are the hosts and paths of open-tracking images
+	pixels = []struct{ host, path *regexp.Regexp }{
+		{regexp.MustCompile(`^open\.convertkit-mail\d*\.com$`), regexp.MustCompile(``)},
+		{regexp.MustCompile(`(^|\.)list-manage\.com$`), regexp.MustCompile(`^/track/open`)},
+		{regexp.MustCompile(`^eotrx\.substackcdn\.com$`), regexp.MustCompile(`^/open`)},
+		{regexp.MustCompile(`^email\.mg\d*\.substack\.com$`), regexp.MustCompile(`^/o/`)},
+	}
+	convertKitRegexp = regexp.MustCompile(`^click\.convertkit-mail\d*\.com$`)
+	mailchimpRegexp  = regexp.MustCompile(`(^|\.)list-manage\.com$`)
+	substackRegexp   = regexp.MustCompile(`^email\.mg\d*\.substack\.com$`)
+	pixelSizeRegexp  = regexp.MustCompile(`(?i)(^|;)\s*(width|height)\s*:\s*[01]px`)
+)
+
+// trackingParam reports whether a query parameter only identifies the campaign or reader
+func trackingParam(key string) bool {
+	key = strings.ToLower(key)
+	switch key {
+	case "mc_cid", "mc_eid", "ck_subscriber_id", "_hsenc", "_hsmi":
+		return true
+	}
+	return strings.HasPrefix(key, "utm_")
+}
+
+// maxRedirects bounds how many trackers may wrap a single link
+const maxRedirects = 5
+
+// URL unwraps click-tracking redirects whose destination is embedded in the link and strips tracking parameters.
+// Links whose destination can only be found by following the redirect are left for a Resolver.
+func URL(u string) string {
+	for range maxRedirects {
+		target, ok := embeddedTarget(u)
+		if !ok {
+			break
+		}
+		u = target
+	}
+	return stripParams(u)
+}
+
+// Tracked reports whether a link still goes through a click tracker after URL
+func Tracked(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	switch {
+	case convertKitRegexp.MatchString(host):
+		return true
+	case mailchimpRegexp.MatchString(host):
+		return strings.HasPrefix(parsed.Path, "/track/click")
+	case substackRegexp.MatchString(host):
+		return strings.HasPrefix(parsed.Path, "/c/")
+	case host == "substack.com":
+		return strings.HasPrefix(parsed.Path, "/redirect/")
+	}
+	return false
+}
+
+// embeddedTarget decodes the destination of a click-tracking link without network access, if the tracker embeds it
+func embeddedTarget(u string) (string, bool) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	segments := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	switch {
+	case convertKitRegexp.MatchString(host):
+		// /{subscriber}/{link}/{base64 destination}, where the destination may contain slashes
+		if len(segments) >= 3 {
+			return decodeURL(strings.Join(segments[2:], "/"))
+		}
+	case host == "substack.com" && len(segments) == 3 && segments[0] == "redirect":
+		// /redirect/2/{base64 JSON}.{signature}, where the JSON's e field is the destination
+		payload, _, _ := strings.Cut(segments[2], ".")
+		b, ok := decodeBase64(payload)
+		if !ok {
+			return "", false
+		}
+		var redirect struct {
+			E string `json:"e"`
+		}
+		if json.Unmarshal(b, &redirect) != nil {
+			return "", false
+		}
+		return absoluteURL(redirect.E)
+	}
+	return "", false
+}
+
+func decodeURL(s string) (string, bool) {
+	b, ok := decodeBase64(s)
+	if !ok {
+		return "", false
+	}
+	return absoluteURL(string(b))
+}
+
+// decodeBase64 accepts either alphabet, with or without padding
+func decodeBase64(s string) ([]byte, bool) {
+	s = strings.TrimRight(s, "=")
+	for _, enc := range []*base64.Encoding{base64.RawStdEncoding, base64.RawURLEncoding} {
+		b, err := enc.DecodeString(s)
+		if err == nil {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// absoluteURL accepts decoded destinations which are web links
+func absoluteURL(s string) (string, bool) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+	return s, true
+}
+
+// stripParams removes tracking parameters, keeping the order and encoding of the others
+func stripParams(u string) string {
+	base, query, ok := strings.Cut(u, "?")
+	if !ok {
+		return u
+	}
+	query, fragment, hasFragment := strings.Cut(query, "#")
+	var kept []string
+	for _, param := range strings.Split(query, "&") {
+		key, _, _ := strings.Cut(param, "=")
+		key, err := url.QueryUnescape(key)
+		if err == nil && trackingParam(key) {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	if len(kept) > 0 {
+		base += "?" + strings.Join(kept, "&")
+	}
+	if hasFragment {
+		base += "#" + fragment
+	}
+	return base
+}
+
+// Pixel reports whether an image is an open-tracking pixel, by its host or by being 1x1
+func Pixel(src string, attrs map[string]string) bool {
+	if parsed, err := url.Parse(src); err == nil {
+		host := strings.ToLower(parsed.Hostname())
+		for _, pixel := range pixels {
+			if pixel.host.MatchString(host) && pixel.path.MatchString(parsed.Path) {
+				return true
+			}
+		}
+	}
+	if tiny(attrs["width"]) && tiny(attrs["height"]) {
+		return true
+	}
+	return len(pixelSizeRegexp.FindAllString(attrs["style"], -1)) >= 2
+}
+
+func tiny(dimension string) bool {
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(dimension), "px"))
+	return err == nil && n <= 1
+}
+
+// HTML removes tracking pixels and rewrites links using rewrite, leaving the rest of the document untouched
+func HTML(s string, rewrite func(string) string) string {
+	var b strings.Builder
+	z := nethtml.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		if tt == nethtml.ErrorToken {
+			// Reading a string only ends at EOF
+			return b.String()
+		}
+		// Token unescapes attributes in place, so Raw must be copied first
+		raw := slices.Clone(z.Raw())
+		if tt != nethtml.StartTagToken && tt != nethtml.SelfClosingTagToken {
+			b.Write(raw)
+			continue
+		}
+		token := z.Token()
+		switch token.Data {
+		case "img":
+			attrs := map[string]string{}
+			for _, attr := range token.Attr {
+				attrs[attr.Key] = attr.Val
+			}
+			if Pixel(attrs["src"], attrs) {
+				continue
+			}
+			b.Write(raw)
+		case "a", "area":
+			changed := false
+			for i, attr := range token.Attr {
+				if attr.Key != "href" {
+					continue
+				}
+				if u := rewrite(attr.Val); u != attr.Val {
+					token.Attr[i].Val = u
+					changed = true
+				}
+			}
+			if !changed {
+				b.Write(raw)
+				continue
+			}
+			b.WriteString("<" + token.Data)
+			for _, attr := range token.Attr {
+				b.WriteString(" " + attr.Key + `="` + html.EscapeString(attr.Val) + `"`)
+			}
+			if tt == nethtml.SelfClosingTagToken {
+				b.WriteString("/")
+			}
+			b.WriteString(">")
+		default:
+			b.Write(raw)
+		}
+	}
+}
+
+// ErrUnresolvable is returned for tracked links which don't redirect anywhere, as retrying won't help
+var ErrUnresolvable = errors.New("tracked link does not redirect")
+
+// Resolver follows click-tracking redirects whose destination isn't embedded in the link
+type Resolver struct {
+	Client *http.Client
+}
+
+// Resolve requests a tracked link without following its redirect, returning the destination.
+// Some trackers only redirect GET requests, so that's used rather than HEAD.
+func (r *Resolver) Resolve(ctx context.Context, u string) (string, error) {
+	client := *r.Client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	for range maxRedirects {
+		u = URL(u)
+		if !Tracked(u) {
+			return u, nil
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return "", fmt.Errorf("construct request: %w", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("GET %s: %w", u, err)
+		}
+		resp.Body.Close()
+		location, err := resp.Location()
+		if err != nil {
+			return "", fmt.Errorf("GET %s: %s: %w", u, resp.Status, ErrUnresolvable)
+		}
+		u = location.String()
+	}
+	return "", fmt.Errorf("more than %d redirects: %w", maxRedirects, ErrUnresolvable)
+}
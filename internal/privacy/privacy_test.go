@@ -0,0 +1,99 @@
+package privacy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		in, expected string
+	}{
+		// ConvertKit embeds the destination as base64
+		{"https://click.convertkit-mail2.com/92u9qde2d0fnhq8p7o3c9hz3vmd33aw/z2hghnh32gq5evbp/aHR0cHM6Ly9kb2kub3JnLzEwLjExMDkvT0pJRVMuMjAyNC4zMzczMjMy", "https://doi.org/10.1109/OJIES.2024.3373232"},
+		{"https://click.convertkit-mail2.com/92u9qde2d0fnhq8p7o3c9hz3vmd33aw/owhkhqhrmz2xwdav/aHR0cHM6Ly9qb3VybmFsY2x1Yi5pby9hcmNoaXZl", "https://journalclub.io/archive"},
+		// Substack embeds it in a signed JSON payload
+		{"https://substack.com/redirect/2/eyJlIjogImh0dHBzOi8vZXhhbXBsZS5jb20vcG9zdD91dG1fc291cmNlPXN1YnN0YWNrJnV0bV9tZWRpdW09ZW1haWwmaWQ9NyIsICJwIjogMTIzLCAicyI6IDF9.c2lnbmF0dXJl?j=eyJ1IjoxfQ", "https://example.com/post?id=7"},
+		// Mailchimp doesn't, so its links are left for a Resolver
+		{"https://example.us1.list-manage.com/track/click?u=abc&id=def&e=123", "https://example.us1.list-manage.com/track/click?u=abc&id=def&e=123"},
+		{"https://example.com/?utm_source=newsletter&utm_campaign=fall&page=2#top", "https://example.com/?page=2#top"},
+		{"https://example.com/?utm_source=newsletter&mc_eid=abc123", "https://example.com/"},
+		{"https://example.com/?a=1&b=%20two", "https://example.com/?a=1&b=%20two"},
+		{"mailto:editor@example.com", "mailto:editor@example.com"},
+		// Undecodable tracker links are left alone
+		{"https://click.convertkit-mail2.com/abc/def/not*base64", "https://click.convertkit-mail2.com/abc/def/not*base64"},
+	}
+	for _, test := range tests {
+		if out := URL(test.in); out != test.expected {
+			t.Errorf("URL(%s) is %s, expected %s", test.in, out, test.expected)
+		}
+	}
+}
+
+func TestHTML(t *testing.T) {
+	in := `<p><a href="https://example.com/?a=1&amp;b=2">Unchanged</a></p>` +
+		`<p>Read <a href="https://click.convertkit-mail2.com/a/b/aHR0cHM6Ly9qb3VybmFsY2x1Yi5pby9hcmNoaXZl" style="color: red">the archive</a></p>` +
+		`<img src="https://embed.filekitcdn.com/e/logo" alt="Logo">` +
+		`<img src="https://open.convertkit-mail2.com/92u9qde2d0fnhq8p7o3c9hz3vmd33aw" alt="">` +
+		`<img src="https://example.us1.list-manage.com/track/open.php?u=abc&amp;id=def" width="1" height="1">` +
+		`<img src="https://eotrx.substackcdn.com/open?token=abc" alt="">` +
+		`<img src="https://tracker.example/p.gif" style="width:1px;height:1px;border:0">` +
+		`<img src="https://example.com/spacer.gif" width="1" height="20">`
+	expected := `<p><a href="https://example.com/?a=1&amp;b=2">Unchanged</a></p>` +
+		`<p>Read <a href="https://journalclub.io/archive" style="color: red">the archive</a></p>` +
+		`<img src="https://embed.filekitcdn.com/e/logo" alt="Logo">` +
+		`<img src="https://example.com/spacer.gif" width="1" height="20">`
+	if out := HTML(in, URL); out != expected {
+		t.Errorf("HTML is\n%s\nexpected\n%s", out, expected)
+	}
+}
+
+type transportFunc func(*http.Request) (*http.Response, error)
+
+func (f transportFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestResolver(t *testing.T) {
+	requests := 0
+	client := &http.Client{Transport: transportFunc(func(req *http.Request) (*http.Response, error) {
+		requests++
+		resp := &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("")), Request: req}
+		switch req.URL.String() {
+		case "https://example.us1.list-manage.com/track/click?u=abc&id=def&e=123":
+			resp.StatusCode = http.StatusFound
+			resp.Header.Set("Location", "https://example.com/article?utm_source=mailchimp")
+		case "https://example.us1.list-manage.com/track/click?u=abc&id=gone":
+			resp.StatusCode = http.StatusOK
+		default:
+			t.Errorf("unexpected request for %s", req.URL)
+		}
+		return resp, nil
+	})}
+	resolver := &Resolver{Client: client}
+	ctx := context.Background()
+
+	u, err := resolver.Resolve(ctx, "https://example.us1.list-manage.com/track/click?u=abc&id=def&e=123")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if u != "https://example.com/article" {
+		t.Errorf("resolved to %s, expected https://example.com/article", u)
+	}
+
+	_, err = resolver.Resolve(ctx, "https://example.us1.list-manage.com/track/click?u=abc&id=gone")
+	if !errors.Is(err, ErrUnresolvable) {
+		t.Errorf("resolving a link without a redirect gave %v, expected ErrUnresolvable", err)
+	}
+
+	// Links with embedded destinations never hit the network
+	requests = 0
+	u, err = resolver.Resolve(ctx, "https://click.convertkit-mail2.com/a/b/aHR0cHM6Ly9qb3VybmFsY2x1Yi5pby9hcmNoaXZl")
+	if err != nil || u != "https://journalclub.io/archive" || requests != 0 {
+		t.Errorf("resolve embedded link gave %s, %v after %d requests", u, err, requests)
+	}
+}
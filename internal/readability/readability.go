@@ -0,0 +1,280 @@
+// Package readability finds the article within a newsletter's HTML, dropping the
+// headers, footers, social buttons and unsubscribe blocks around it, by scoring
+// elements on how much paragraph text they contain in the manner of Arc90's Readability
+package readability
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	// unlikelyRegexp matches the classes and IDs of boilerplate
+	unlikelyRegexp = regexp.MustCompile(`(?i)banner|breadcrumb|comment|community|copyright|disclaimer|footer|header|legal|menu|nav|preferences|promo|related|share|sidebar|social|sponsor|subscribe|unsubscribe|utility`)
+	// likelyRegexp matches the classes and IDs of articles, overriding unlikelyRegexp
+	likelyRegexp = regexp.MustCompile(`(?i)article|body|content|entry|main|post|story|text`)
+	spaceRegexp  = regexp.MustCompile(`\s+`)
+)
+
+// minParagraph is the length of text below which a paragraph doesn't count towards its ancestors' scores
+const minParagraph = 25
+
+// Extract returns the HTML of a document's article, or the whole document if no article stands out
+func Extract(doc string) string {
+	root, err := html.Parse(strings.NewReader(doc))
+	if err != nil {
+		return doc
+	}
+	body := find(root, atom.Body)
+	if body == nil {
+		return doc
+	}
+	prune(body)
+
+	scores := map[*html.Node]float64{}
+	var candidates []*html.Node
+	addScore := func(n *html.Node, score float64) {
+		if n == nil || n.Type != html.ElementNode {
+			return
+		}
+		if _, ok := scores[n]; !ok {
+			scores[n] = initialScore(n)
+			candidates = append(candidates, n)
+		}
+		scores[n] += score
+	}
+	walk(body, func(n *html.Node) {
+		switch n.DataAtom {
+		case atom.P, atom.Td, atom.Pre, atom.Blockquote, atom.Li:
+		default:
+			return
+		}
+		text := textContent(n)
+		if utf8.RuneCountInString(text) < minParagraph {
+			return
+		}
+		score := 1 + float64(strings.Count(text, ",")) + math.Min(float64(len(text))/100, 3)
+		addScore(n.Parent, score)
+		if n.Parent != nil {
+			addScore(n.Parent.Parent, score/2)
+		}
+	})
+
+	var top *html.Node
+	for _, n := range candidates {
+		scores[n] *= 1 - linkDensity(n)
+		if top == nil || scores[n] > scores[top] {
+			top = n
+		}
+	}
+	if top == nil || top == body {
+		return render(body)
+	}
+
+	// Siblings which score well, or are paragraphs of prose, are part of the article too
+	threshold := math.Max(10, scores[top]*0.2)
+	var article strings.Builder
+	for sibling := top.Parent.FirstChild; sibling != nil; sibling = sibling.NextSibling {
+		keep := sibling == top
+		if score, ok := scores[sibling]; ok && score >= threshold {
+			keep = true
+		}
+		if sibling.DataAtom == atom.P {
+			text := textContent(sibling)
+			length := utf8.RuneCountInString(text)
+			density := linkDensity(sibling)
+			keep = keep || (length > 80 && density < 0.25) || (length > 0 && density == 0 && strings.Contains(text, ". "))
+		}
+		if keep {
+			article.WriteString(render(sibling))
+		}
+	}
+	return "<div>" + article.String() + "</div>"
+}
+
+// prune removes elements which are never part of an article
+func prune(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.CommentNode || (c.Type == html.ElementNode && unlikely(c)) {
+			n.RemoveChild(c)
+		} else {
+			prune(c)
+		}
+		c = next
+	}
+}
+
+func unlikely(n *html.Node) bool {
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Noscript, atom.Nav, atom.Header, atom.Footer, atom.Aside, atom.Form, atom.Iframe:
+		return true
+	}
+	match := attr(n, "class") + " " + attr(n, "id")
+	return unlikelyRegexp.MatchString(match) && !likelyRegexp.MatchString(match)
+}
+
+// initialScore weighs an element by its tag, class and ID
+func initialScore(n *html.Node) float64 {
+	var score float64
+	switch n.DataAtom {
+	case atom.Div, atom.Article, atom.Section, atom.Main:
+		score = 5
+	case atom.Td, atom.Pre, atom.Blockquote:
+		score = 3
+	case atom.Form, atom.Ol, atom.Ul, atom.Li, atom.Dl, atom.Dd, atom.Dt, atom.Address:
+		score = -3
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Th:
+		score = -5
+	}
+	match := attr(n, "class") + " " + attr(n, "id")
+	if likelyRegexp.MatchString(match) {
+		score += 25
+	}
+	if unlikelyRegexp.MatchString(match) {
+		score -= 25
+	}
+	return score
+}
+
+// linkDensity is the proportion of an element's text which is within links
+func linkDensity(n *html.Node) float64 {
+	length := utf8.RuneCountInString(textContent(n))
+	if length == 0 {
+		return 0
+	}
+	links := 0
+	walk(n, func(a *html.Node) {
+		if a.DataAtom == atom.A {
+			links += utf8.RuneCountInString(textContent(a))
+		}
+	})
+	return float64(links) / float64(length)
+}
+
+// walk calls f on n and each element within it
+func walk(n *html.Node, f func(*html.Node)) {
+	if n.Type == html.ElementNode {
+		f(n)
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		walk(c, f)
+	}
+}
+
+func find(n *html.Node, a atom.Atom) *html.Node {
+	var found *html.Node
+	walk(n, func(e *html.Node) {
+		if found == nil && e.DataAtom == a {
+			found = e
+		}
+	})
+	return found
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// textContent is an element's text with whitespace collapsed
+func textContent(n *html.Node) string {
+	var b strings.Builder
+	text(&b, n)
+	return strings.TrimSpace(spaceRegexp.ReplaceAllString(b.String(), " "))
+}
+
+func text(b *strings.Builder, n *html.Node) {
+	switch {
+	case n.Type == html.TextNode:
+		b.WriteString(n.Data)
+		return
+	case n.Type == html.ElementNode && (n.DataAtom == atom.Script || n.DataAtom == atom.Style || n.DataAtom == atom.Head):
+		return
+	case n.Type == html.ElementNode && n.DataAtom == atom.Br:
+		b.WriteString(" ")
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		text(b, c)
+	}
+	if n.Type == html.ElementNode && block(n) {
+		// Keep the words of adjacent blocks apart
+		b.WriteString(" ")
+	}
+}
+
+func block(n *html.Node) bool {
+	switch n.DataAtom {
+	case atom.A, atom.Abbr, atom.B, atom.Code, atom.Em, atom.Font, atom.I, atom.Img, atom.Mark, atom.Q,
+		atom.S, atom.Small, atom.Span, atom.Strong, atom.Sub, atom.Sup, atom.U:
+		return false
+	}
+	return true
+}
+
+func render(n *html.Node) string {
+	var b strings.Builder
+	err := html.Render(&b, n)
+	if err != nil {
+		// Rendering only fails writing, which a strings.Builder doesn't
+		return ""
+	}
+	return b.String()
+}
+
+// Body returns the HTML within a document's <body>, without the style sheets which would restyle a page embedding it
+func Body(doc string) string {
+	root, err := html.Parse(strings.NewReader(doc))
+	if err != nil {
+		return doc
+	}
+	body := find(root, atom.Body)
+	if body == nil {
+		return doc
+	}
+	var sheets []*html.Node
+	walk(body, func(n *html.Node) {
+		if n.DataAtom == atom.Style || n.DataAtom == atom.Link {
+			sheets = append(sheets, n)
+		}
+	})
+	for _, n := range sheets {
+		n.Parent.RemoveChild(n)
+	}
+	var b strings.Builder
+	for c := body.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(render(c))
+	}
+	return b.String()
+}
+
+// Text is the plain text of a document, with whitespace collapsed
+func Text(doc string) string {
+	root, err := html.Parse(strings.NewReader(doc))
+	if err != nil {
+		return ""
+	}
+	return textContent(root)
+}
+
+// Summary is the start of a document's plain text, cut at a word boundary to at most max characters
+func Summary(doc string, max int) string {
+	s := Text(doc)
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	runes := []rune(s)[:max]
+	if i := strings.LastIndexByte(string(runes), ' '); i > 0 {
+		return strings.TrimRight(string(runes)[:i], " ,;:") + "…"
+	}
+	return string(runes[:max-1]) + "…"
+}
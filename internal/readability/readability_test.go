@@ -0,0 +1,57 @@
+package readability
+
+import (
+	"strings"
+	"testing"
+
+	_ "embed"
+)
+
+//go:embed test/newsletter.html
+var testNewsletter string
+
+func TestExtract(t *testing.T) {
+	article := Extract(testNewsletter)
+	for _, kept := range []string{
+		"<h1>Why the river flooded</h1>",
+		"After three weeks of rain",
+		"<blockquote>We knew it was coming",
+		`<a href="https://example.com/report">the engineers&#39; report</a>`,
+	} {
+		if !strings.Contains(article, kept) {
+			t.Errorf("article does not contain %s:\n%s", kept, article)
+		}
+	}
+	for _, dropped := range []string{"View in browser", "Weather", "Instagram", "Unsubscribe", "High Street", "<style>"} {
+		if strings.Contains(article, dropped) {
+			t.Errorf("article contains %s:\n%s", dropped, article)
+		}
+	}
+}
+
+func TestExtractWithoutArticle(t *testing.T) {
+	// Short emails have no paragraphs to score, so are kept whole
+	doc := `<html><head></head><body><p>See you soon!</p></body></html>`
+	if article := Extract(doc); !strings.Contains(article, "<p>See you soon!</p>") {
+		t.Errorf("article is %s, expected the whole body", article)
+	}
+}
+
+func TestBody(t *testing.T) {
+	doc := `<html><head><title>Issue 1</title><style>body { background: red; }</style></head>` +
+		`<body bgcolor="red"><style>p { color: red; }</style><p>See you soon!</p></body></html>`
+	if body := Body(doc); body != "<p>See you soon!</p>" {
+		t.Errorf("body is %s, expected only the paragraph", body)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	summary := Summary(Extract(testNewsletter), 100)
+	expected := "Why the river flooded After three weeks of rain, the river finally broke its banks on Tuesday…"
+	if summary != expected {
+		t.Errorf("summary is %q, expected %q", summary, expected)
+	}
+	if summary := Summary("<p>Short &amp; sweet</p>", 100); summary != "Short & sweet" {
+		t.Errorf("summary is %q, expected %q", summary, "Short & sweet")
+	}
+}
@@ -0,0 +1,250 @@
+// Package redact removes the recipient's personal details from newsletters before
+// they're published: their name in greetings, their address, and links carrying
+// tokens which would let a reader of the feed unsubscribe or impersonate them
+package redact
+
+import (
+	"html"
+	"mime"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+
+	nethtml "golang.org/x/net/html"
+)
+
+// Placeholder replaces the recipient's addresses
+const Placeholder = "[redacted]"
+
+var (
+	// tokenRegexp finds the subscriber IDs in List-Unsubscribe URLs
+	tokenRegexp = regexp.MustCompile(`[A-Za-z0-9_\-]{16,}`)
+	// accountRegexp matches links which manage the recipient's subscription
+	accountRegexp = regexp.MustCompile(`(?i)unsubscribe|opt-?out|manage[-_]?subscription|email[-_]?preferences|disable_email|^https?://preferences\.|list-manage\.com/(profile|vcard)`)
+	greetings     = `Hi|Hello|Hey|Dear|Howdy|Greetings|Good morning|Good afternoon|Good evening`
+)
+
+// identifyingParam reports whether a query parameter identifies the recipient
+func identifyingParam(host, key string) bool {
+	switch strings.ToLower(key) {
+	case "email", "token", "subscriber", "subscriber_id", "uid":
+		return true
+	case "e":
+		// Mailchimp's subscriber ID, e.g. on "view in browser" links
+		return strings.HasSuffix(host, "list-manage.com") || strings.HasSuffix(host, "mailchi.mp")
+	}
+	return false
+}
+
+// Redactor removes a recipient's details from items
+type Redactor struct {
+	// Names are removed from greetings
+	Names []string
+	// Addresses are replaced wherever they appear
+	Addresses []string
+	// Links are removed wherever they appear, e.g. the email's List-Unsubscribe URLs
+	Links []string
+	// Tokens mark links to remove, e.g. the subscriber IDs of List-Unsubscribe URLs
+	Tokens []string
+}
+
+// ForMessage adds the recipients and unsubscribe links of an email to a copy of the redactor
+func (r Redactor) ForMessage(msg *mail.Message) *Redactor {
+	dec := new(mime.WordDecoder)
+	for _, header := range []string{"To", "Cc", "Delivered-To", "X-Original-To"} {
+		addrs, err := msg.Header.AddressList(header)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			r.Addresses = append(r.Addresses, addr.Address)
+			name, err := dec.DecodeHeader(addr.Name)
+			// Greetings use the first name
+			if f := strings.Fields(name); err == nil && len(f) > 0 {
+				r.Names = append(r.Names, name, f[0])
+			}
+		}
+	}
+	for _, link := range strings.Split(msg.Header.Get("List-Unsubscribe"), ",") {
+		link = strings.Trim(strings.TrimSpace(link), "<>")
+		if link == "" {
+			continue
+		}
+		r.Links = append(r.Links, link)
+		for _, token := range tokenRegexp.FindAllString(link, -1) {
+			// Hostnames and paths such as "unsubscribe.example.com" aren't identifying
+			if !strings.Contains(token, ".") && strings.ContainsAny(token, "0123456789") {
+				r.Tokens = append(r.Tokens, token)
+			}
+		}
+	}
+	return &r
+}
+
+// Text removes greetings of the recipient and replaces their addresses in plain text
+func (r *Redactor) Text(s string) string {
+	return r.text()(s)
+}
+
+// text compiles the patterns for redacting text once, for documents with many text nodes
+func (r *Redactor) text() func(string) string {
+	var greeting, address *regexp.Regexp
+	if len(r.Names) > 0 {
+		names := make([]string, len(r.Names))
+		for i, name := range r.Names {
+			names[i] = regexp.QuoteMeta(name)
+		}
+		greeting = regexp.MustCompile(`(?i)\b(` + greetings + `)\s+(?:` + strings.Join(names, "|") + `)\b`)
+	}
+	if len(r.Addresses) > 0 {
+		addrs := make([]string, len(r.Addresses))
+		for i, addr := range r.Addresses {
+			addrs[i] = regexp.QuoteMeta(addr)
+		}
+		address = regexp.MustCompile(`(?i)` + strings.Join(addrs, "|"))
+	}
+	return func(s string) string {
+		if greeting != nil {
+			s = greeting.ReplaceAllString(s, "$1")
+		}
+		if address != nil {
+			s = address.ReplaceAllLiteralString(s, Placeholder)
+		}
+		return s
+	}
+}
+
+// URL returns a link with identifying parameters removed, or "" if the link itself identifies the recipient
+func (r *Redactor) URL(u string) string {
+	if u == "" {
+		return u
+	}
+	for _, link := range r.Links {
+		if u == link {
+			return ""
+		}
+	}
+	for _, token := range r.Tokens {
+		if strings.Contains(u, token) {
+			return ""
+		}
+	}
+	unescaped, err := url.QueryUnescape(u)
+	if err != nil {
+		unescaped = u
+	}
+	for _, addr := range r.Addresses {
+		if strings.Contains(strings.ToLower(unescaped), strings.ToLower(addr)) {
+			return ""
+		}
+	}
+	if accountRegexp.MatchString(u) {
+		return ""
+	}
+
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.RawQuery == "" {
+		return u
+	}
+	base, query, _ := strings.Cut(u, "?")
+	query, fragment, hasFragment := strings.Cut(query, "#")
+	var kept []string
+	for _, param := range strings.Split(query, "&") {
+		key, _, _ := strings.Cut(param, "=")
+		if !identifyingParam(strings.ToLower(parsed.Hostname()), key) {
+			kept = append(kept, param)
+		}
+	}
+	if len(kept) > 0 {
+		base += "?" + strings.Join(kept, "&")
+	}
+	if hasFragment {
+		base += "#" + fragment
+	}
+	return base
+}
+
+// rawText reports whether the tokenizer reads an element's text without unescaping it
+func rawText(element string) bool {
+	switch element {
+	case "iframe", "noembed", "noframes", "noscript", "plaintext", "script", "style", "xmp":
+		return true
+	}
+	return false
+}
+
+// HTML redacts the text of a document and removes links which identify the recipient, along with their text
+func (r *Redactor) HTML(s string) string {
+	var b strings.Builder
+	text := r.text()
+	z := nethtml.NewTokenizer(strings.NewReader(s))
+	dropping := false
+	// rawElement is the element whose unescaped text is being read, such as a style sheet
+	rawElement := ""
+	for {
+		tt := z.Next()
+		if tt == nethtml.ErrorToken {
+			// Reading a string only ends at EOF
+			return b.String()
+		}
+		raw := string(z.Raw())
+		token := z.Token()
+		if dropping {
+			dropping = !(tt == nethtml.EndTagToken && token.Data == "a")
+			continue
+		}
+		switch tt {
+		case nethtml.TextToken:
+			if redacted := text(token.Data); redacted != token.Data {
+				if rawElement != "" {
+					b.WriteString(redacted)
+				} else {
+					b.WriteString(html.EscapeString(redacted))
+				}
+				continue
+			}
+		case nethtml.EndTagToken:
+			if token.Data == rawElement {
+				rawElement = ""
+			}
+		case nethtml.StartTagToken, nethtml.SelfClosingTagToken:
+			// Like browsers, the tokenizer ignores the slash of e.g. <style/>
+			if rawText(token.Data) {
+				rawElement = token.Data
+			}
+			changed, drop := false, false
+			for i, attr := range token.Attr {
+				val := attr.Val
+				switch attr.Key {
+				case "href", "src":
+					val = r.URL(val)
+					drop = drop || (val == "" && attr.Val != "" && token.Data == "a")
+				default:
+					val = text(val)
+				}
+				if val != attr.Val {
+					token.Attr[i].Val = val
+					changed = true
+				}
+			}
+			if drop {
+				// Anchors don't nest, so everything up to the next </a> is the link's text
+				dropping = tt == nethtml.StartTagToken
+				continue
+			}
+			if changed {
+				b.WriteString("<" + token.Data)
+				for _, attr := range token.Attr {
+					b.WriteString(" " + attr.Key + `="` + html.EscapeString(attr.Val) + `"`)
+				}
+				if tt == nethtml.SelfClosingTagToken {
+					b.WriteString("/")
+				}
+				b.WriteString(">")
+				continue
+			}
+		}
+		b.WriteString(raw)
+	}
+}
@@ -0,0 +1,85 @@
+package redact
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+const testHeaders = "From: \"Weekly Digest\" <digest@example.com>\r\n" +
+	"To: \"Connor Taffe\" <hello@connor.zip>\r\n" +
+	"List-Unsubscribe: <mailto:unsub+92u9qde2d0fnhq8p7o3c9hz3vmd33aw@example.com>,\r\n" +
+	" <https://unsubscribe.example.com/92u9qde2d0fnhq8p7o3c9hz3vmd33aw>\r\n" +
+	"\r\n"
+
+func testRedactor(t *testing.T) *Redactor {
+	msg, err := mail.ReadMessage(strings.NewReader(testHeaders))
+	if err != nil {
+		t.Fatalf("parse email: %v", err)
+	}
+	return Redactor{Addresses: []string{"connor@example.org"}}.ForMessage(msg)
+}
+
+func TestURL(t *testing.T) {
+	r := testRedactor(t)
+	tests := []struct {
+		in, expected string
+	}{
+		{"https://example.com/article", "https://example.com/article"},
+		{"https://unsubscribe.example.com/92u9qde2d0fnhq8p7o3c9hz3vmd33aw", ""},
+		{"https://preferences.example.com/92u9qde2d0fnhq8p7o3c9hz3vmd33aw", ""},
+		{"https://example.com/manage-subscription?list=weekly", ""},
+		{"https://example.com/login?email=hello%40connor.zip", ""},
+		{"mailto:CONNOR@example.org", ""},
+		// View in browser links work without the subscriber's ID
+		{"https://us1.campaign-archive.com/?u=abc&id=def", "https://us1.campaign-archive.com/?u=abc&id=def"},
+		{"https://example.us1.list-manage.com/?u=abc&id=def&e=123", "https://example.us1.list-manage.com/?u=abc&id=def"},
+		{"https://digest.substack.com/p/post?token=secret#comments", "https://digest.substack.com/p/post#comments"},
+		{"#top", "#top"},
+	}
+	for _, test := range tests {
+		if out := r.URL(test.in); out != test.expected {
+			t.Errorf("URL(%s) is %q, expected %q", test.in, out, test.expected)
+		}
+	}
+}
+
+func TestHTML(t *testing.T) {
+	r := testRedactor(t)
+	in := `<p class="greeting">Hi  Connor, today's article is about MQTT.</p>` +
+		`<p>Hello Connor Taffe! Dear reader,</p>` +
+		`<p>Sent to <a href="mailto:hello@connor.zip">hello@connor.zip</a> &amp; you.</p>` +
+		`<p><a href="https://example.com/a?x=1&amp;y=2">Keep</a> · <a href="https://unsubscribe.example.com/92u9qde2d0fnhq8p7o3c9hz3vmd33aw" style="color:#656565"><b>Unsubscribe</b></a></p>` +
+		`<img src="https://example.com/pic.png" alt="Photo for HELLO@connor.zip">` +
+		`<style>a[href^="mailto:hello@connor.zip"] > b { content: "Connor's"; }</style>`
+	expected := `<p class="greeting">Hi, today&#39;s article is about MQTT.</p>` +
+		`<p>Hello! Dear reader,</p>` +
+		`<p>Sent to  &amp; you.</p>` +
+		`<p><a href="https://example.com/a?x=1&amp;y=2">Keep</a> · </p>` +
+		`<img src="https://example.com/pic.png" alt="Photo for [redacted]">` +
+		`<style>a[href^="mailto:[redacted]"] > b { content: "Connor's"; }</style>`
+	if out := r.HTML(in); out != expected {
+		t.Errorf("HTML is\n%s\nexpected\n%s", out, expected)
+	}
+}
+
+func TestText(t *testing.T) {
+	r := &Redactor{Names: []string{"Connor"}}
+	if out := r.Text("Good morning Connor, and welcome. Connor Street is unchanged."); out != "Good morning, and welcome. Connor Street is unchanged." {
+		t.Errorf("Text is %q", out)
+	}
+}
+
+func TestBlankName(t *testing.T) {
+	msg, err := mail.ReadMessage(strings.NewReader("To: \"   \" <hello@connor.zip>\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("parse email: %v", err)
+	}
+	r := Redactor{}.ForMessage(msg)
+	if len(r.Names) != 0 {
+		t.Errorf("names are %q, expected none", r.Names)
+	}
+	if len(r.Addresses) != 1 || r.Addresses[0] != "hello@connor.zip" {
+		t.Errorf("addresses are %q", r.Addresses)
+	}
+}
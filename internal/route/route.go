@@ -0,0 +1,195 @@
+// Package route picks the feed an email belongs to by matching rules against its headers
+package route
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rule sends email to a feed. Its conditions are case-insensitive regular expressions, which must
+// all match somewhere in the value they're tested against. A rule without conditions matches any email.
+type Rule struct {
+	// Name identifies the rule when reporting a match, its position from one if unset
+	Name string
+	Feed string
+	// ListID is matched against the identifier of the List-Id header, e.g. digest.example.com
+	ListID string
+	// From is matched against the address the email is from
+	From string
+	// Tag is matched against the plus-address tags of the recipients, e.g. digest for connor+digest@example.com
+	Tag string
+	// Subject is matched against the decoded subject
+	Subject string
+	// Headers match other headers by name, any one of whose values must match
+	Headers map[string]string
+}
+
+// Router tries its rules in order, routing email by the first which matches
+type Router struct {
+	rules []rule
+}
+
+type rule struct {
+	name       string
+	feed       string
+	conditions []condition
+}
+
+// condition tests a regular expression against the values of a message selected by name
+type condition struct {
+	name   string
+	values func(mail.Header) []string
+	re     *regexp.Regexp
+}
+
+// Match describes the rule which routed an email
+type Match struct {
+	Rule string `json:"rule"`
+	Feed string `json:"feed"`
+	// Matched is the value which met each of the rule's conditions, by condition
+	Matched map[string]string `json:"matched,omitempty"`
+}
+
+// New compiles rules into a router
+func New(rules []Rule) (*Router, error) {
+	r := &Router{}
+	for i, spec := range rules {
+		name := spec.Name
+		if name == "" {
+			name = strconv.Itoa(i + 1)
+		}
+		if spec.Feed == "" || strings.ContainsAny(spec.Feed, "/?#") {
+			return nil, fmt.Errorf("rule %s: invalid feed %q", name, spec.Feed)
+		}
+		compiled := rule{name: name, feed: spec.Feed}
+		add := func(label string, values func(mail.Header) []string, pattern string) error {
+			if pattern == "" {
+				return nil
+			}
+			re, err := regexp.Compile("(?i)" + pattern)
+			if err != nil {
+				return fmt.Errorf("rule %s: compile %s: %w", name, label, err)
+			}
+			compiled.conditions = append(compiled.conditions, condition{name: label, values: values, re: re})
+			return nil
+		}
+		err := errors.Join(
+			add("List-Id", listID, spec.ListID),
+			add("From", from, spec.From),
+			add("Tag", tags, spec.Tag),
+			add("Subject", header("Subject"), spec.Subject),
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(spec.Headers))
+		for key := range spec.Headers {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			canonical := textproto.CanonicalMIMEHeaderKey(key)
+			if err := add(canonical, header(canonical), spec.Headers[key]); err != nil {
+				return nil, err
+			}
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	return r, nil
+}
+
+// Route finds the first rule which matches an email's headers
+func (r *Router) Route(h mail.Header) (*Match, bool) {
+next:
+	for _, rule := range r.rules {
+		m := &Match{Rule: rule.name, Feed: rule.feed}
+		for _, c := range rule.conditions {
+			value, ok := c.match(h)
+			if !ok {
+				continue next
+			}
+			if m.Matched == nil {
+				m.Matched = map[string]string{}
+			}
+			m.Matched[c.name] = value
+		}
+		return m, true
+	}
+	return nil, false
+}
+
+func (c condition) match(h mail.Header) (string, bool) {
+	for _, v := range c.values(h) {
+		if c.re.MatchString(v) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// header selects every value of a header, decoded from RFC 2047 where possible
+func header(name string) func(mail.Header) []string {
+	return func(h mail.Header) []string {
+		dec := new(mime.WordDecoder)
+		var values []string
+		for _, v := range h[textproto.CanonicalMIMEHeaderKey(name)] {
+			if decoded, err := dec.DecodeHeader(v); err == nil {
+				v = decoded
+			}
+			values = append(values, strings.TrimSpace(v))
+		}
+		return values
+	}
+}
+
+// listID selects the identifier of the List-Id header, which may follow a description e.g. "Digest <digest.example.com>"
+func listID(h mail.Header) []string {
+	v := h.Get("List-Id")
+	if start := strings.LastIndex(v, "<"); start >= 0 {
+		if end := strings.Index(v[start:], ">"); end >= 0 {
+			return []string{strings.TrimSpace(v[start+1 : start+end])}
+		}
+	}
+	if v = strings.TrimSpace(v); v != "" {
+		return []string{v}
+	}
+	return nil
+}
+
+// from selects the addresses the email is from
+func from(h mail.Header) []string {
+	addrs, err := h.AddressList("From")
+	if err != nil {
+		return nil
+	}
+	var values []string
+	for _, addr := range addrs {
+		values = append(values, addr.Address)
+	}
+	return values
+}
+
+// tags selects the plus-address tags of the email's recipients, including those it was forwarded to
+func tags(h mail.Header) []string {
+	var values []string
+	for _, name := range []string{"To", "Cc", "Delivered-To", "X-Original-To"} {
+		addrs, err := h.AddressList(name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			local, _, _ := strings.Cut(addr.Address, "@")
+			if _, tag, ok := strings.Cut(local, "+"); ok && tag != "" {
+				values = append(values, tag)
+			}
+		}
+	}
+	return values
+}
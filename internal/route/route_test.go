@@ -0,0 +1,97 @@
+package route
+
+import (
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testEmail = "From: \"Weekly Digest\" <digest@news.example.com>\r\n" +
+	"To: Connor <connor+Reading@example.org>\r\n" +
+	"Delivered-To: connor+inbox@example.org\r\n" +
+	"List-Id: The Weekly Digest <weekly.news.example.com>\r\n" +
+	"Subject: =?UTF-8?Q?Issue_42:_na=C3=AFve_sorting?=\r\n" +
+	"X-Campaign: spring-2024\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+func TestRoute(t *testing.T) {
+	msg, err := mail.ReadMessage(strings.NewReader(testEmail))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		rules    []Rule
+		expected *Match
+	}{
+		{
+			name:     "list id",
+			rules:    []Rule{{Feed: "other", ListID: `^other\.example\.com$`}, {Feed: "digest", ListID: `^weekly\.news\.example\.com$`}},
+			expected: &Match{Rule: "2", Feed: "digest", Matched: map[string]string{"List-Id": "weekly.news.example.com"}},
+		},
+		{
+			name:     "from",
+			rules:    []Rule{{Name: "news", Feed: "digest", From: `@news\.example\.com$`}},
+			expected: &Match{Rule: "news", Feed: "digest", Matched: map[string]string{"From": "digest@news.example.com"}},
+		},
+		{
+			name:     "tag",
+			rules:    []Rule{{Feed: "reading", Tag: `^reading$`}},
+			expected: &Match{Rule: "1", Feed: "reading", Matched: map[string]string{"Tag": "Reading"}},
+		},
+		{
+			name:     "forwarded tag",
+			rules:    []Rule{{Feed: "inbox", Tag: `^inbox$`}},
+			expected: &Match{Rule: "1", Feed: "inbox", Matched: map[string]string{"Tag": "inbox"}},
+		},
+		{
+			name:     "decoded subject",
+			rules:    []Rule{{Feed: "digest", Subject: `naïve`}},
+			expected: &Match{Rule: "1", Feed: "digest", Matched: map[string]string{"Subject": "Issue 42: naïve sorting"}},
+		},
+		{
+			name:     "custom header",
+			rules:    []Rule{{Feed: "spring", Headers: map[string]string{"x-campaign": `^spring-`}}},
+			expected: &Match{Rule: "1", Feed: "spring", Matched: map[string]string{"X-Campaign": "spring-2024"}},
+		},
+		{
+			name:     "all conditions",
+			rules:    []Rule{{Feed: "digest", From: `news\.example\.com`, Subject: `^Weekly`}, {Name: "fallback", Feed: "inbox"}},
+			expected: &Match{Rule: "fallback", Feed: "inbox"},
+		},
+		{
+			name:  "no match",
+			rules: []Rule{{Feed: "digest", Headers: map[string]string{"X-Missing": `.`}}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			router, err := New(test.rules)
+			if err != nil {
+				t.Fatalf("compile rules: %v", err)
+			}
+			m, ok := router.Route(msg.Header)
+			if ok != (test.expected != nil) {
+				t.Fatalf("matched is %t, expected %t", ok, test.expected != nil)
+			}
+			if !reflect.DeepEqual(m, test.expected) {
+				t.Errorf("match is %+v, expected %+v", m, test.expected)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, rules := range [][]Rule{
+		{{Feed: "digest", Subject: `(`}},
+		{{Feed: "digest", Headers: map[string]string{"X-Campaign": `[`}}},
+		{{Subject: `digest`}},
+		{{Feed: "digest/items", Subject: `digest`}},
+	} {
+		if _, err := New(rules); err == nil {
+			t.Errorf("rules %+v compiled, expected an error", rules)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Package sanitize removes anything from an email's HTML which could run script
+// when it's served from our domain, keeping only allowlisted elements and attributes
+package sanitize
+
+import (
+	"html"
+	"strings"
+
+	nethtml "golang.org/x/net/html"
+)
+
+// allowedElements are kept along with their allowed attributes
+var allowedElements = map[string]bool{
+	"html": true, "head": true, "body": true, "title": true, "style": true,
+	"a": true, "abbr": true, "address": true, "article": true, "aside": true,
+	"b": true, "bdi": true, "bdo": true, "big": true, "blockquote": true, "br": true,
+	"caption": true, "center": true, "cite": true, "code": true, "col": true, "colgroup": true,
+	"dd": true, "del": true, "details": true, "dfn": true, "div": true, "dl": true, "dt": true,
+	"em": true, "figcaption": true, "figure": true, "font": true, "footer": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hr": true, "i": true, "img": true, "ins": true, "kbd": true,
+	"li": true, "main": true, "mark": true, "nav": true, "ol": true, "p": true, "pre": true,
+	"q": true, "s": true, "samp": true, "section": true, "small": true, "span": true,
+	"strike": true, "strong": true, "sub": true, "summary": true, "sup": true,
+	"table": true, "tbody": true, "td": true, "tfoot": true, "th": true, "thead": true,
+	"time": true, "tr": true, "tt": true, "u": true, "ul": true, "var": true, "wbr": true,
+}
+
+// droppedElements are removed along with everything inside them
+var droppedElements = map[string]bool{
+	"script": true, "iframe": true, "frame": true, "frameset": true, "object": true,
+	"embed": true, "applet": true, "noscript": true, "noembed": true, "noframes": true,
+	"template": true, "form": true, "button": true, "select": true, "textarea": true,
+	"svg": true, "math": true, "xmp": true, "plaintext": true,
+}
+
+// allowedAttributes are kept on any allowed element
+var allowedAttributes = map[string]bool{
+	"align": true, "alt": true, "bgcolor": true, "border": true, "cellpadding": true,
+	"cellspacing": true, "class": true, "color": true, "colspan": true, "dir": true,
+	"face": true, "height": true, "hspace": true, "id": true, "lang": true, "rowspan": true,
+	"size": true, "span": true, "start": true, "style": true, "summary": true, "title": true,
+	"valign": true, "vspace": true, "width": true,
+}
+
+// urlAttributes are kept on the given elements if their URL has an allowed scheme
+var urlAttributes = map[string]map[string][]string{
+	"a":   {"href": {"http", "https", "mailto"}},
+	"img": {"src": {"http", "https", "cid"}},
+}
+
+// HTML returns the allowlisted portion of a document, which is safe to serve as text/html
+func HTML(s string) string {
+	var b strings.Builder
+	z := nethtml.NewTokenizer(strings.NewReader(s))
+	// dropping is the element whose contents are being removed, and depth how deeply it's nested in itself
+	var dropping string
+	depth := 0
+	inStyle := false
+	for {
+		tt := z.Next()
+		if tt == nethtml.ErrorToken {
+			// Reading a string only ends at EOF
+			return b.String()
+		}
+		token := z.Token()
+		if dropping != "" {
+			switch {
+			case tt == nethtml.StartTagToken && token.Data == dropping:
+				depth++
+			case tt == nethtml.EndTagToken && token.Data == dropping:
+				depth--
+				if depth == 0 {
+					dropping = ""
+				}
+			}
+			continue
+		}
+
+		switch tt {
+		case nethtml.TextToken:
+			if inStyle {
+				// Style sheets aren't escaped, and the tokenizer ends them at the first </style
+				b.WriteString(safeCSS(token.Data))
+				continue
+			}
+			b.WriteString(html.EscapeString(token.Data))
+		case nethtml.DoctypeToken:
+			b.WriteString("<!DOCTYPE html>")
+		case nethtml.StartTagToken, nethtml.SelfClosingTagToken:
+			// Like browsers, the tokenizer ignores the slash of e.g. <script/>
+			opens := tt == nethtml.StartTagToken || rawText(token.Data)
+			if droppedElements[token.Data] {
+				if opens && !isVoid(token.Data) {
+					dropping = token.Data
+					depth = 1
+				}
+				continue
+			}
+			if !allowedElements[token.Data] {
+				continue
+			}
+			b.WriteString("<" + token.Data)
+			for _, attr := range token.Attr {
+				if attr.Namespace != "" || !allowedAttribute(token.Data, attr) {
+					continue
+				}
+				b.WriteString(" " + attr.Key + `="` + html.EscapeString(attr.Val) + `"`)
+			}
+			if token.Data == "style" && opens {
+				inStyle = true
+			}
+			if token.Data == "a" {
+				b.WriteString(` rel="noopener noreferrer nofollow"`)
+			}
+			b.WriteString(">")
+		case nethtml.EndTagToken:
+			if token.Data == "style" {
+				inStyle = false
+			}
+			if allowedElements[token.Data] {
+				b.WriteString("</" + token.Data + ">")
+			}
+		}
+	}
+}
+
+// safeCSS drops style sheets using features which run script in old browsers
+func safeCSS(css string) string {
+	if unsafeStyle(css) {
+		return ""
+	}
+	return css
+}
+
+func unsafeStyle(style string) bool {
+	style = strings.ToLower(stripControl(style))
+	return strings.Contains(style, "expression(") || strings.Contains(style, "javascript:") ||
+		strings.Contains(style, "behavior:") || strings.Contains(style, "-moz-binding")
+}
+
+func allowedAttribute(element string, attr nethtml.Attribute) bool {
+	if schemes, ok := urlAttributes[element][attr.Key]; ok {
+		return allowedURL(attr.Val, schemes)
+	}
+	if attr.Key == "style" {
+		return !unsafeStyle(attr.Val)
+	}
+	return allowedAttributes[attr.Key]
+}
+
+// allowedURL reports whether a URL is relative or uses one of the given schemes.
+// Browsers ignore whitespace and control characters in schemes, so checks do too.
+func allowedURL(u string, schemes []string) bool {
+	u = stripControl(u)
+	i := strings.IndexAny(u, ":/?#")
+	if i < 0 || u[i] != ':' {
+		return true
+	}
+	scheme := strings.ToLower(u[:i])
+	for _, s := range schemes {
+		if scheme == s {
+			return true
+		}
+	}
+	return false
+}
+
+func stripControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func isVoid(element string) bool {
+	switch element {
+	case "area", "base", "br", "col", "embed", "hr", "img", "input", "link", "meta", "param", "source", "track", "wbr":
+		return true
+	}
+	return false
+}
+
+// rawText elements contain text rather than markup, up to their end tag
+func rawText(element string) bool {
+	switch element {
+	case "iframe", "noembed", "noframes", "noscript", "plaintext", "script", "style", "textarea", "title", "xmp":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package sender
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxARCInstances is the longest chain RFC 8617 allows
+const maxARCInstances = 50
+
+// arcSet is the headers a relay adds to a message it passes on: its results,
+// its signature of the message and its seal over the chain so far
+type arcSet struct {
+	results, signature, seal *field
+}
+
+// ARC is the outcome of validating a message's ARC chain
+type ARC struct {
+	Status Status
+	// Domain sealed the latest set of the chain
+	Domain string
+	// Results are the latest relay's Authentication-Results
+	Results *AuthResults
+	Err     error
+}
+
+// instance reads the i= tag of an ARC header, which each starts with
+func instance(f *field) (int, error) {
+	tag, _, _ := strings.Cut(f.value(), ";")
+	name, value, _ := strings.Cut(tag, "=")
+	i, err := strconv.Atoi(strings.TrimSpace(value))
+	if strings.TrimSpace(name) != "i" || err != nil || i < 1 || i > maxARCInstances {
+		return 0, fmt.Errorf("invalid instance %q", strings.TrimSpace(tag))
+	}
+	return i, nil
+}
+
+// arcSets groups a message's ARC headers by instance, which must run from one without gaps
+func arcSets(msg *message) ([]arcSet, error) {
+	byInstance := map[int]*arcSet{}
+	for _, f := range msg.fields {
+		var slot func(*arcSet) **field
+		switch f.name {
+		case "arc-authentication-results":
+			slot = func(set *arcSet) **field { return &set.results }
+		case "arc-message-signature":
+			slot = func(set *arcSet) **field { return &set.signature }
+		case "arc-seal":
+			slot = func(set *arcSet) **field { return &set.seal }
+		default:
+			continue
+		}
+		i, err := instance(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.name, err)
+		}
+		set, ok := byInstance[i]
+		if !ok {
+			set = &arcSet{}
+			byInstance[i] = set
+		}
+		if *slot(set) != nil {
+			return nil, fmt.Errorf("instance %d has more than one %s", i, f.name)
+		}
+		*slot(set) = f
+	}
+	sets := make([]arcSet, len(byInstance))
+	for i := range sets {
+		set, ok := byInstance[i+1]
+		if !ok || set.results == nil || set.signature == nil || set.seal == nil {
+			return nil, fmt.Errorf("instance %d is incomplete", i+1)
+		}
+		sets[i] = *set
+	}
+	return sets, nil
+}
+
+// verifyARC validates a message's ARC chain, returning nil if it has none
+func verifyARC(ctx context.Context, resolver Resolver, msg *message) *ARC {
+	sets, err := arcSets(msg)
+	if err != nil {
+		return &ARC{Status: Fail, Err: err}
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+	latest := sets[len(sets)-1]
+	arc := &ARC{}
+	fail := func(status Status, err error) *ARC {
+		arc.Status = status
+		arc.Err = err
+		return arc
+	}
+
+	// Each seal covers the sets before it, and says whether the chain validated when it was added
+	for i, set := range sets {
+		tags, err := parseTags(set.seal.value())
+		if err != nil {
+			return fail(Fail, fmt.Errorf("parse seal %d: %w", i+1, err))
+		}
+		for _, tag := range []string{"a", "b", "cv", "d", "s"} {
+			if tags[tag] == "" {
+				return fail(Fail, fmt.Errorf("seal %d is missing %s= tag", i+1, tag))
+			}
+		}
+		expected := "pass"
+		if i == 0 {
+			expected = "none"
+		}
+		if tags["cv"] != expected {
+			return fail(Fail, fmt.Errorf("seal %d has cv=%s", i+1, tags["cv"]))
+		}
+		b, err := decodeBase64(tags["b"])
+		if err != nil {
+			return fail(Fail, fmt.Errorf("decode seal %d: %w", i+1, err))
+		}
+		h := sha256.New()
+		for _, prior := range sets[:i] {
+			for _, f := range []*field{prior.results, prior.signature, prior.seal} {
+				h.Write([]byte(canonicalHeader(f, "relaxed")))
+			}
+		}
+		h.Write([]byte(canonicalHeader(set.results, "relaxed")))
+		h.Write([]byte(canonicalHeader(set.signature, "relaxed")))
+		h.Write([]byte(strings.TrimSuffix(canonicalHeader(withoutSignature(set.seal), "relaxed"), "\r\n")))
+		domain := strings.ToLower(tags["d"])
+		status, err := verifyHash(ctx, resolver, tags["a"], tags["s"], domain, h.Sum(nil), b)
+		if status != Pass {
+			return fail(status, fmt.Errorf("verify seal %d: %w", i+1, err))
+		}
+		arc.Domain = domain
+	}
+
+	// Only the latest relay's signature of the message need still hold
+	sig, err := parseSignature(latest.signature, "bh", "h")
+	if err != nil {
+		return fail(Fail, fmt.Errorf("parse message signature %d: %w", len(sets), err))
+	}
+	if strings.Contains(":"+strings.Join(sig.headers, ":")+":", ":arc-seal:") {
+		return fail(Fail, errors.New("message signature covers a seal"))
+	}
+	status, err := verifySignature(ctx, resolver, msg, sig)
+	if status != Pass {
+		return fail(status, fmt.Errorf("verify message signature %d: %w", len(sets), err))
+	}
+
+	// The results are prefixed with the instance, e.g. i=1; mx.example.com; dkim=pass
+	_, value, _ := strings.Cut(latest.results.value(), ";")
+	arc.Results, err = ParseAuthResults(value)
+	if err != nil {
+		return fail(Fail, fmt.Errorf("parse results %d: %w", len(sets), err))
+	}
+	arc.Status = Pass
+	return arc
+}
@@ -0,0 +1,428 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status is the outcome of verifying a signature, as reported in Authentication-Results
+type Status string
+
+const (
+	Pass Status = "pass"
+	Fail Status = "fail"
+	// PermError is a signature which can't be verified, e.g. because it's malformed or its key is missing
+	PermError Status = "permerror"
+	// TempError is a signature which couldn't be verified this time, e.g. because DNS failed
+	TempError Status = "temperror"
+)
+
+// minRSABits is the smallest RSA key accepted, as RFC 8301 requires
+const minRSABits = 1024
+
+// Resolver looks up the DNS TXT records which hold signing keys, as net.Resolver does
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Verification is the outcome of verifying one DKIM-Signature of a message
+type Verification struct {
+	// Domain is the signing domain, d=
+	Domain   string
+	Selector string
+	Status   Status
+	// Err explains why the signature didn't pass
+	Err error
+}
+
+// field is a header field as it appears in the message, with the CRLF ending it
+type field struct {
+	// name is lowercased
+	name string
+	raw  string
+}
+
+func (f *field) value() string {
+	_, value, _ := strings.Cut(f.raw, ":")
+	return value
+}
+
+// message is an email split into its header fields and body, with CRLF line endings
+type message struct {
+	fields []*field
+	body   []byte
+}
+
+func parseMessage(raw []byte) (*message, error) {
+	// Messages posted to the server may have bare LF line endings, which were CRLF in transit
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	raw = bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+	msg := &message{}
+	rest := raw
+	for len(rest) > 0 {
+		line, after, found := bytes.Cut(rest, []byte("\r\n"))
+		if !found {
+			return nil, fmt.Errorf("header isn't terminated by an empty line")
+		}
+		if len(line) == 0 {
+			msg.body = after
+			return msg, nil
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(msg.fields) == 0 {
+				return nil, fmt.Errorf("header starts with a continuation line")
+			}
+			msg.fields[len(msg.fields)-1].raw += string(line) + "\r\n"
+		} else {
+			name, _, ok := bytes.Cut(line, []byte(":"))
+			if !ok {
+				return nil, fmt.Errorf("malformed header field %q", line)
+			}
+			msg.fields = append(msg.fields, &field{name: strings.ToLower(strings.TrimSpace(string(name))), raw: string(line) + "\r\n"})
+		}
+		rest = after
+	}
+	return msg, nil
+}
+
+// all returns every field with the given lowercase name, in order
+func (msg *message) all(name string) []*field {
+	var fields []*field
+	for _, f := range msg.fields {
+		if f.name == name {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+var (
+	wspRegexp = regexp.MustCompile(`[ \t]+`)
+	// bTagRegexp matches the value of the b= tag, which is emptied when hashing the signature's own header
+	bTagRegexp = regexp.MustCompile(`((?:^|;)[ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+)
+
+// canonicalHeader canonicalizes a header field, with "simple" leaving it as it is
+// and "relaxed" unfolding it and compressing its whitespace
+func canonicalHeader(f *field, canon string) string {
+	if canon == "simple" {
+		return f.raw
+	}
+	name, value, _ := strings.Cut(f.raw, ":")
+	value = strings.NewReplacer("\r\n", "").Replace(value)
+	value = wspRegexp.ReplaceAllString(value, " ")
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + strings.Trim(value, " ") + "\r\n"
+}
+
+// canonicalBody canonicalizes a body, "relaxed" compressing whitespace within lines,
+// and both dropping empty lines at its end
+func canonicalBody(body []byte, canon string) []byte {
+	if canon == "relaxed" {
+		lines := bytes.Split(body, []byte("\r\n"))
+		for i, line := range lines {
+			line = wspRegexp.ReplaceAll(line, []byte(" "))
+			lines[i] = bytes.TrimRight(line, " ")
+		}
+		body = bytes.Join(lines, []byte("\r\n"))
+	}
+	for bytes.HasSuffix(body, []byte("\r\n")) {
+		body = body[:len(body)-2]
+	}
+	if len(body) > 0 || canon == "simple" {
+		body = append(body, "\r\n"...)
+	}
+	return body
+}
+
+// parseTags parses a tag=value list, as used by signatures and key records
+func parseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed tag %q", spec)
+		}
+		name = strings.TrimSpace(name)
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicate tag %s", name)
+		}
+		tags[name] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// decodeBase64 decodes base64 which may be broken up by folding whitespace
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// signature is a DKIM-Signature or ARC-Message-Signature
+type signature struct {
+	field     *field
+	tags      map[string]string
+	algorithm string
+	domain    string
+	selector  string
+	b         []byte
+	// headers lists the signed header fields, lowercased
+	headers                []string
+	headerCanon, bodyCanon string
+}
+
+func parseSignature(f *field, required ...string) (*signature, error) {
+	tags, err := parseTags(f.value())
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range append([]string{"a", "b", "d", "s"}, required...) {
+		if tags[tag] == "" {
+			return nil, fmt.Errorf("missing %s= tag", tag)
+		}
+	}
+	sig := &signature{
+		field:       f,
+		tags:        tags,
+		algorithm:   tags["a"],
+		domain:      strings.ToLower(tags["d"]),
+		selector:    tags["s"],
+		headerCanon: "simple",
+		bodyCanon:   "simple",
+	}
+	sig.b, err = decodeBase64(tags["b"])
+	if err != nil {
+		return nil, fmt.Errorf("decode b= tag: %w", err)
+	}
+	if c, ok := tags["c"]; ok {
+		header, body, ok := strings.Cut(c, "/")
+		sig.headerCanon = header
+		if ok {
+			sig.bodyCanon = body
+		}
+	}
+	for _, canon := range []string{sig.headerCanon, sig.bodyCanon} {
+		if canon != "simple" && canon != "relaxed" {
+			return nil, fmt.Errorf("unknown canonicalization %s", canon)
+		}
+	}
+	for _, name := range strings.Split(tags["h"], ":") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			sig.headers = append(sig.headers, name)
+		}
+	}
+	return sig, nil
+}
+
+// verifyBody checks the body hash, bh=, which covers the first l= bytes of the canonical body if given
+func (sig *signature) verifyBody(body []byte) error {
+	bh, err := decodeBase64(sig.tags["bh"])
+	if err != nil {
+		return fmt.Errorf("decode bh= tag: %w", err)
+	}
+	body = canonicalBody(body, sig.bodyCanon)
+	if l, ok := sig.tags["l"]; ok {
+		n, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || n < 0 || n > int64(len(body)) {
+			return fmt.Errorf("invalid l= tag %s", l)
+		}
+		body = body[:n]
+	}
+	sum := sha256.Sum256(body)
+	if !bytes.Equal(sum[:], bh) {
+		return errors.New("body hash doesn't match")
+	}
+	return nil
+}
+
+// headerHash hashes the signed header fields, taking repeated fields from the bottom up,
+// followed by the signature's own header field without its signature
+func (sig *signature) headerHash(msg *message) []byte {
+	h := sha256.New()
+	used := map[*field]bool{}
+	for _, name := range sig.headers {
+		fields := msg.all(name)
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[fields[i]] {
+				used[fields[i]] = true
+				h.Write([]byte(canonicalHeader(fields[i], sig.headerCanon)))
+				break
+			}
+		}
+	}
+	h.Write([]byte(strings.TrimSuffix(canonicalHeader(withoutSignature(sig.field), sig.headerCanon), "\r\n")))
+	return h.Sum(nil)
+}
+
+// withoutSignature empties the b= tag of a signature's header field
+func withoutSignature(f *field) *field {
+	name, value, _ := strings.Cut(f.raw, ":")
+	return &field{name: f.name, raw: name + ":" + bTagRegexp.ReplaceAllString(value, "$1")}
+}
+
+// verifyHash checks a signature of a hash with the key published for the selector and domain
+func verifyHash(ctx context.Context, resolver Resolver, algorithm, selector, domain string, hash, b []byte) (Status, error) {
+	name := fmt.Sprintf("%s._domainkey.%s", selector, domain)
+	records, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return PermError, fmt.Errorf("no key at %s", name)
+		}
+		return TempError, fmt.Errorf("look up key at %s: %w", name, err)
+	}
+	if len(records) != 1 {
+		return PermError, fmt.Errorf("found %d keys at %s", len(records), name)
+	}
+	key, err := parseTags(records[0])
+	if err != nil {
+		return PermError, fmt.Errorf("parse key at %s: %w", name, err)
+	}
+	if v, ok := key["v"]; ok && v != "DKIM1" {
+		return PermError, fmt.Errorf("key at %s has version %s", name, v)
+	}
+	if key["p"] == "" {
+		return PermError, fmt.Errorf("key at %s is revoked", name)
+	}
+	p, err := decodeBase64(key["p"])
+	if err != nil {
+		return PermError, fmt.Errorf("decode key at %s: %w", name, err)
+	}
+	k := key["k"]
+	if k == "" {
+		k = "rsa"
+	}
+
+	switch algorithm {
+	case "rsa-sha256":
+		if k != "rsa" {
+			return PermError, fmt.Errorf("key at %s is %s, not rsa", name, k)
+		}
+		pub, err := parseRSAKey(p)
+		if err != nil {
+			return PermError, fmt.Errorf("parse key at %s: %w", name, err)
+		}
+		if pub.N.BitLen() < minRSABits {
+			return PermError, fmt.Errorf("key at %s is only %d bits", name, pub.N.BitLen())
+		}
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash, b)
+		if err != nil {
+			return Fail, errors.New("signature doesn't match")
+		}
+	case "ed25519-sha256":
+		if k != "ed25519" || len(p) != ed25519.PublicKeySize {
+			return PermError, fmt.Errorf("key at %s isn't an ed25519 key", name)
+		}
+		if !ed25519.Verify(ed25519.PublicKey(p), hash, b) {
+			return Fail, errors.New("signature doesn't match")
+		}
+	default:
+		// Including rsa-sha1, which RFC 8301 forbids verifying
+		return PermError, fmt.Errorf("unsupported algorithm %s", algorithm)
+	}
+	return Pass, nil
+}
+
+func parseRSAKey(b []byte) (*rsa.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(b)
+	if err != nil {
+		// Some records hold a bare PKCS #1 key
+		return x509.ParsePKCS1PublicKey(b)
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an RSA key but found %T", key)
+	}
+	return pub, nil
+}
+
+// verifySignature verifies a DKIM-Signature or ARC-Message-Signature against the message
+func verifySignature(ctx context.Context, resolver Resolver, msg *message, sig *signature) (Status, error) {
+	err := sig.verifyBody(msg.body)
+	if err != nil {
+		return Fail, err
+	}
+	return verifyHash(ctx, resolver, sig.algorithm, sig.selector, sig.domain, sig.headerHash(msg), sig.b)
+}
+
+// verifyDKIM verifies a DKIM-Signature header field
+func verifyDKIM(ctx context.Context, resolver Resolver, msg *message, f *field, now time.Time) *Verification {
+	sig, err := parseSignature(f, "bh", "h")
+	if err != nil {
+		return &Verification{Status: PermError, Err: err}
+	}
+	v := &Verification{Domain: sig.domain, Selector: sig.selector}
+	fail := func(status Status, err error) *Verification {
+		v.Status = status
+		v.Err = err
+		return v
+	}
+	if sig.tags["v"] != "1" {
+		return fail(PermError, fmt.Errorf("unsupported version %q", sig.tags["v"]))
+	}
+	if !strings.Contains(":"+strings.Join(sig.headers, ":")+":", ":from:") {
+		return fail(PermError, errors.New("From isn't signed"))
+	}
+	if i, ok := sig.tags["i"]; ok {
+		_, domain, _ := strings.Cut(i, "@")
+		if !within(strings.ToLower(domain), sig.domain) {
+			return fail(PermError, fmt.Errorf("identity %s isn't within %s", i, sig.domain))
+		}
+	}
+	if x, ok := sig.tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return fail(PermError, fmt.Errorf("invalid x= tag %s", x))
+		}
+		if now.Unix() > expires {
+			return fail(PermError, errors.New("signature has expired"))
+		}
+	}
+	v.Status, v.Err = verifySignature(ctx, resolver, msg, sig)
+	return v
+}
+
+// Verify checks each DKIM-Signature of a raw message
+func Verify(ctx context.Context, resolver Resolver, raw []byte) ([]*Verification, error) {
+	msg, err := parseMessage(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse message: %w", err)
+	}
+	return verify(ctx, resolver, msg, time.Now()), nil
+}
+
+func verify(ctx context.Context, resolver Resolver, msg *message, now time.Time) []*Verification {
+	var verifications []*Verification
+	for _, f := range msg.all("dkim-signature") {
+		verifications = append(verifications, verifyDKIM(ctx, resolver, msg, f, now))
+	}
+	return verifications
+}
+
+// within reports whether domain is parent or one of its subdomains
+func within(domain, parent string) bool {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	parent = strings.TrimSuffix(strings.ToLower(parent), ".")
+	return parent != "" && (domain == parent || strings.HasSuffix(domain, "."+parent))
+}
@@ -0,0 +1,108 @@
+package sender
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AuthResults is an Authentication-Results header, in which a relay reports how it authenticated a message
+type AuthResults struct {
+	// AuthServID identifies the relay
+	AuthServID string
+	Results    []AuthResult
+}
+
+// AuthResult is the outcome of one method, e.g. dkim=pass header.d=example.com
+type AuthResult struct {
+	Method string
+	Result string
+	// Properties are keyed by type and property, e.g. header.d or smtp.mailfrom
+	Properties map[string]string
+}
+
+// ParseAuthResults parses the value of an Authentication-Results header as described by RFC 8601
+func ParseAuthResults(value string) (*AuthResults, error) {
+	parts := split(stripComments(value), ';')
+	if len(parts) == 0 || len(strings.Fields(parts[0])) == 0 {
+		return nil, fmt.Errorf("missing authserv-id")
+	}
+	// The authserv-id may be followed by a version
+	results := &AuthResults{AuthServID: strings.ToLower(strings.Fields(parts[0])[0])}
+	for _, part := range parts[1:] {
+		tokens := split(part, ' ', '\t', '\r', '\n')
+		if len(tokens) == 0 || (len(tokens) == 1 && strings.EqualFold(tokens[0], "none")) {
+			continue
+		}
+		method, result, ok := strings.Cut(tokens[0], "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed result %q", tokens[0])
+		}
+		// Methods may have a version, e.g. dkim/1
+		method, _, _ = strings.Cut(method, "/")
+		r := AuthResult{Method: strings.ToLower(method), Result: strings.ToLower(result), Properties: map[string]string{}}
+		for _, token := range tokens[1:] {
+			name, value, ok := strings.Cut(token, "=")
+			if !ok {
+				return nil, fmt.Errorf("malformed property %q", token)
+			}
+			r.Properties[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+		results.Results = append(results.Results, r)
+	}
+	return results, nil
+}
+
+// stripComments removes parenthesised comments, which may nest, outside quoted strings
+func stripComments(s string) string {
+	var b strings.Builder
+	depth := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && (quoted || depth > 0):
+			if depth == 0 {
+				b.WriteByte(c)
+				b.WriteByte(s[i+1])
+			}
+			i++
+			continue
+		case c == '"' && depth == 0:
+			quoted = !quoted
+		case c == '(' && !quoted:
+			depth++
+			continue
+		case c == ')' && !quoted && depth > 0:
+			depth--
+			// A comment separates the tokens either side of it
+			b.WriteByte(' ')
+			continue
+		}
+		if depth == 0 {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// split splits s on any of the separators outside quoted strings, dropping empty fields
+func split(s string, separators ...byte) []string {
+	var fields []string
+	start := 0
+	quoted := false
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) {
+			if s[i] == '"' {
+				quoted = !quoted
+			}
+			if quoted || !strings.ContainsRune(string(separators), rune(s[i])) {
+				continue
+			}
+		}
+		if field := strings.TrimSpace(s[start:i]); field != "" {
+			fields = append(fields, field)
+		}
+		start = i + 1
+	}
+	return fields
+}
@@ -0,0 +1,179 @@
+// Package sender authenticates who sent an email, by verifying its DKIM signatures and by believing
+// what the relay which submitted it reports in Authentication-Results, or trusted relays in ARC headers
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrUnauthenticated is returned for messages which aren't from an accepted sender
+	ErrUnauthenticated = errors.New("sender isn't authenticated")
+	// ErrTemporary is returned when a message couldn't be authenticated, but might be later
+	ErrTemporary = errors.New("sender couldn't be authenticated")
+)
+
+// Policy decides which senders are accepted
+type Policy struct {
+	// Domains are accepted along with their subdomains
+	Domains []string
+	// Relays are the ARC sealing domains of relays, along with their subdomains,
+	// trusted to report how they authenticated the mail they pass on
+	Relays []string
+	// Submitter is the authserv-id of the relay which submitted the message, if the submission
+	// was authenticated as coming from it. Authentication-Results are only as trustworthy as the
+	// path the message took, since anyone able to submit a message can write them, so only the
+	// submitter's are believed.
+	Submitter string
+	Resolver  Resolver
+}
+
+// Verdict describes how a message was authenticated
+type Verdict struct {
+	// From is the domain of the message's From address
+	From string
+	// Domain was authenticated and aligns with From
+	Domain string
+	// Method is dkim when a signature was verified, or the header a trusted relay reported in,
+	// either authentication-results or arc
+	Method string
+	// By is the relay which reported the result
+	By string
+}
+
+// Check authenticates the sender of a raw message, failing with ErrUnauthenticated or ErrTemporary
+// unless its From domain is accepted and aligns with a domain which was authenticated
+func (p *Policy) Check(ctx context.Context, raw []byte) (*Verdict, error) {
+	msg, err := parseMessage(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: parse message: %v", ErrUnauthenticated, err)
+	}
+	from := msg.all("from")
+	if len(from) != 1 {
+		return nil, fmt.Errorf("%w: message has %d From headers", ErrUnauthenticated, len(from))
+	}
+	addresses, err := mail.ParseAddressList(strings.TrimSpace(from[0].value()))
+	if err != nil || len(addresses) != 1 {
+		return nil, fmt.Errorf("%w: message doesn't have a single From address", ErrUnauthenticated)
+	}
+	_, domain, _ := strings.Cut(addresses[0].Address, "@")
+	verdict := &Verdict{From: strings.ToLower(domain)}
+	if !p.accepts(verdict.From) {
+		return nil, fmt.Errorf("%w: %s isn't an accepted sender", ErrUnauthenticated, verdict.From)
+	}
+
+	var problems []string
+	temporary := false
+	for _, v := range verify(ctx, p.Resolver, msg, time.Now()) {
+		if v.Status == Pass && aligned(v.Domain, verdict.From) {
+			verdict.Domain = v.Domain
+			verdict.Method = "dkim"
+			return verdict, nil
+		}
+		if v.Status == Pass {
+			problems = append(problems, fmt.Sprintf("signature by %s doesn't align with From", v.Domain))
+		} else {
+			problems = append(problems, fmt.Sprintf("signature by %s: %s: %v", v.Domain, v.Status, v.Err))
+		}
+		temporary = temporary || v.Status == TempError
+	}
+
+	// Only the topmost results from the submitter were added by it, as the sender can forge any below
+	for _, f := range msg.all("authentication-results") {
+		results, err := ParseAuthResults(f.value())
+		if err != nil || p.Submitter == "" || !within(results.AuthServID, p.Submitter) {
+			continue
+		}
+		if domain, ok := authenticated(results, verdict.From); ok {
+			verdict.Domain = domain
+			verdict.Method = "authentication-results"
+			verdict.By = results.AuthServID
+			return verdict, nil
+		}
+		problems = append(problems, fmt.Sprintf("%s didn't authenticate %s", results.AuthServID, verdict.From))
+		break
+	}
+
+	if arc := verifyARC(ctx, p.Resolver, msg); arc != nil {
+		switch {
+		case arc.Status != Pass:
+			problems = append(problems, fmt.Sprintf("ARC chain: %s: %v", arc.Status, arc.Err))
+			temporary = temporary || arc.Status == TempError
+		case !p.trusts(arc.Domain):
+			problems = append(problems, fmt.Sprintf("ARC chain was sealed by untrusted %s", arc.Domain))
+		default:
+			if domain, ok := authenticated(arc.Results, verdict.From); ok {
+				verdict.Domain = domain
+				verdict.Method = "arc"
+				verdict.By = arc.Domain
+				return verdict, nil
+			}
+			problems = append(problems, fmt.Sprintf("%s didn't authenticate %s", arc.Domain, verdict.From))
+		}
+	}
+
+	if len(problems) == 0 {
+		problems = append(problems, "message isn't signed")
+	}
+	if temporary {
+		return nil, fmt.Errorf("%w: %s", ErrTemporary, strings.Join(problems, "; "))
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnauthenticated, strings.Join(problems, "; "))
+}
+
+func (p *Policy) accepts(domain string) bool {
+	for _, accepted := range p.Domains {
+		if within(domain, accepted) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) trusts(relay string) bool {
+	for _, trusted := range p.Relays {
+		if within(relay, trusted) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticated finds a domain aligned with from which a relay reports passed DMARC, DKIM or SPF
+func authenticated(results *AuthResults, from string) (string, bool) {
+	for _, r := range results.Results {
+		if r.Result != "pass" {
+			continue
+		}
+		var domain string
+		switch r.Method {
+		case "dmarc":
+			domain = r.Properties["header.from"]
+		case "dkim":
+			domain = r.Properties["header.d"]
+			if domain == "" {
+				_, domain, _ = strings.Cut(r.Properties["header.i"], "@")
+			}
+		case "spf":
+			domain = r.Properties["smtp.mailfrom"]
+			if _, after, ok := strings.Cut(domain, "@"); ok {
+				domain = after
+			}
+		}
+		if domain != "" && aligned(domain, from) {
+			return strings.ToLower(domain), true
+		}
+	}
+	return "", false
+}
+
+// aligned reports whether an authenticated domain vouches for the From domain, as in DMARC's
+// relaxed alignment, approximating organisational domains by requiring one to be within the other
+func aligned(domain, from string) bool {
+	return within(domain, from) || within(from, domain)
+}
@@ -0,0 +1,225 @@
+package sender
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//go:embed test
+var fixtures embed.FS
+
+// keys are published by the local DNS server, for the keys which signed the fixtures
+var keys = map[string]string{
+	"rsa2024._domainkey.example.com.":   "v=DKIM1; k=rsa; p=MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAnEDkaaezJsVUUausmKPeeMah1oQosEoj6YSWurd79emLIu59oDaoqLBNlcpyRSt2/Dvw/p13Wexr5kyKKxVRCpePWFlssVEU+CDzYE8erJgwWQlPqEFun9uNB077FZ7tYIS8l96zudiqoAM3/CXsBpTIneric63yEJ/RnPSwlFP3upULIHQx5HTri0WnEkscZV3AfHB9IWwzb2Ct1DXt/XzCDa1q6DeA4Ay7SKPyI/q0wCQVl6Be3RLkCKdc4e4Z3WQ4hqkkhDOVpvVI7YdHpAuTxCe6iiMLD/YDLaO5U/SqradsIe8rGy0ieU9YSO72jY+qBDUA+dVaqDfR6uZbnQIDAQAB",
+	"ed._domainkey.news.example.com.":   "v=DKIM1; k=ed25519; p=761S66QRlkUBIfpsU01W5QVoeC0Krule2Rzd3ojYwWU=",
+	"arc._domainkey.relay.example.net.": "v=DKIM1; k=rsa; p=MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAidAfoIhvXNhfyRuDKWnFnsSGCyaB+q6dnp7hHvtw/GKzY+UQTXf3ZXJ8ayveHndabl3T6MCbsxVcflGULVykdSGPUisfa+t1A3g25BD3YrrO7scng5LyxfMcX2TNkvEEeOyLpOw+6bHtpwSFom6NEeVHNgIkVUdirKYGIQG9GY/76I9b5XjhVuXKmFIWhTQYbQypfcsopTH/jA7LIOvPrZLZA5mzzPdr3mjmFFGRjYUYIoq3XNeGtTvEWEeeHFdWgX8Zlx5mKEES7QVrX/CKvF4ol8tmDRebPd5C3a+FAE7bei5dzVHJkiFTAkYB+aJJLBGDC2qyCbfS2tgK4lgcGwIDAQAB",
+}
+
+// serveDNS answers TXT queries for records over UDP, answering NXDOMAIN for other names,
+// and returns a resolver which uses it
+func serveDNS(t *testing.T, records map[string]string) *net.Resolver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if query.Unpack(buf[:n]) != nil || len(query.Questions) != 1 {
+				continue
+			}
+			q := query.Questions[0]
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true, RCode: dnsmessage.RCodeSuccess},
+				Questions: query.Questions,
+			}
+			record, ok := records[strings.ToLower(q.Name.String())]
+			switch {
+			case !ok:
+				resp.RCode = dnsmessage.RCodeNameError
+			case q.Type == dnsmessage.TypeTXT:
+				// Character strings are at most 255 bytes, so long keys are split up
+				var txt []string
+				for len(record) > 255 {
+					txt = append(txt, record[:255])
+					record = record[255:]
+				}
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.TXTResource{TXT: append(txt, record)},
+				})
+			}
+			b, err := resp.Pack()
+			if err != nil {
+				t.Errorf("pack DNS response: %v", err)
+				continue
+			}
+			conn.WriteTo(b, addr)
+		}
+	}()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	b, err := fixtures.ReadFile("test/" + name)
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	return b
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	resolver := serveDNS(t, keys)
+	tests := []struct {
+		fixture string
+		domain  string
+		status  Status
+	}{
+		{"rsa.eml", "example.com", Pass},
+		{"ed25519.eml", "news.example.com", Pass},
+		{"tampered.eml", "example.com", Fail},
+		// The mailing list changed the subject
+		{"arc.eml", "example.com", Fail},
+	}
+	for _, test := range tests {
+		verifications, err := Verify(ctx, resolver, readFixture(t, test.fixture))
+		if err != nil {
+			t.Fatalf("verify %s: %v", test.fixture, err)
+		}
+		if len(verifications) != 1 {
+			t.Fatalf("%s has %d signatures", test.fixture, len(verifications))
+		}
+		v := verifications[0]
+		if v.Domain != test.domain || v.Status != test.status {
+			t.Errorf("%s verified as %s by %s (%v), expected %s by %s", test.fixture, v.Status, v.Domain, v.Err, test.status, test.domain)
+		}
+	}
+
+	// Line endings are normalised, as messages are often posted with bare LFs
+	raw := strings.ReplaceAll(string(readFixture(t, "rsa.eml")), "\r\n", "\n")
+	verifications, err := Verify(ctx, resolver, []byte(raw))
+	if err != nil || verifications[0].Status != Pass {
+		t.Errorf("message with LF line endings verified as %+v, %v", verifications[0], err)
+	}
+
+	// Without its key, a signature can't be verified
+	verifications, err = Verify(ctx, serveDNS(t, nil), readFixture(t, "rsa.eml"))
+	if err != nil || verifications[0].Status != PermError {
+		t.Errorf("signature without a key verified as %+v, %v", verifications[0], err)
+	}
+	revoked := map[string]string{"rsa2024._domainkey.example.com.": "v=DKIM1; k=rsa; p="}
+	verifications, err = Verify(ctx, serveDNS(t, revoked), readFixture(t, "rsa.eml"))
+	if err != nil || verifications[0].Status != PermError {
+		t.Errorf("signature with a revoked key verified as %+v, %v", verifications[0], err)
+	}
+}
+
+func TestARC(t *testing.T) {
+	msg, err := parseMessage(readFixture(t, "arc.eml"))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	arc := verifyARC(context.Background(), serveDNS(t, keys), msg)
+	if arc == nil || arc.Status != Pass {
+		t.Fatalf("ARC chain verified as %+v", arc)
+	}
+	if arc.Domain != "relay.example.net" || arc.Results.AuthServID != "mx.relay.example.net" || len(arc.Results.Results) != 2 {
+		t.Errorf("ARC chain is %+v with results %+v", arc, arc.Results)
+	}
+
+	// Changing the relay's results breaks its seal
+	raw := strings.Replace(string(readFixture(t, "arc.eml")), "dmarc=pass", "dmarc=fail", 1)
+	msg, err = parseMessage([]byte(raw))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	arc = verifyARC(context.Background(), serveDNS(t, keys), msg)
+	if arc == nil || arc.Status != Fail {
+		t.Errorf("tampered ARC chain verified as %+v", arc)
+	}
+}
+
+func TestParseAuthResults(t *testing.T) {
+	results, err := ParseAuthResults(` mx.example.net 1; (checked) dkim=pass (2048-bit key; unprotected)
+	 header.d=Example.com header.i="@example.com"; spf=softfail smtp.mailfrom=bounce@example.com; none`)
+	if err != nil {
+		t.Fatalf("parse results: %v", err)
+	}
+	if results.AuthServID != "mx.example.net" || len(results.Results) != 2 {
+		t.Fatalf("parsed %+v", results)
+	}
+	dkim := results.Results[0]
+	if dkim.Method != "dkim" || dkim.Result != "pass" || dkim.Properties["header.d"] != "Example.com" || dkim.Properties["header.i"] != "@example.com" {
+		t.Errorf("parsed %+v", dkim)
+	}
+	if spf := results.Results[1]; spf.Method != "spf" || spf.Result != "softfail" || spf.Properties["smtp.mailfrom"] != "bounce@example.com" {
+		t.Errorf("parsed %+v", spf)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	resolver := serveDNS(t, keys)
+	tests := []struct {
+		fixture string
+		policy  Policy
+		method  string
+		err     error
+	}{
+		{"rsa.eml", Policy{Domains: []string{"example.com"}}, "dkim", nil},
+		{"ed25519.eml", Policy{Domains: []string{"news.example.com"}}, "dkim", nil},
+		{"rsa.eml", Policy{Domains: []string{"example.org"}}, "", ErrUnauthenticated},
+		{"tampered.eml", Policy{Domains: []string{"example.com"}}, "", ErrUnauthenticated},
+		// Relays' headers are only believed on messages they submitted themselves
+		{"results.eml", Policy{Domains: []string{"example.com"}, Submitter: "relay.example.net"}, "authentication-results", nil},
+		{"results.eml", Policy{Domains: []string{"example.com"}, Relays: []string{"relay.example.net"}}, "", ErrUnauthenticated},
+		{"results.eml", Policy{Domains: []string{"example.com"}, Submitter: "other.example"}, "", ErrUnauthenticated},
+		{"results.eml", Policy{Domains: []string{"example.com"}}, "", ErrUnauthenticated},
+		// A passing result forged below the relay's own is ignored
+		{"forged.eml", Policy{Domains: []string{"example.com"}, Submitter: "relay.example.net"}, "", ErrUnauthenticated},
+		{"arc.eml", Policy{Domains: []string{"example.com"}, Relays: []string{"relay.example.net"}}, "arc", nil},
+		{"arc.eml", Policy{Domains: []string{"example.com"}, Relays: []string{"example.net"}}, "arc", nil},
+		{"arc.eml", Policy{Domains: []string{"example.com"}, Relays: []string{"other.example"}}, "", ErrUnauthenticated},
+	}
+	for _, test := range tests {
+		test.policy.Resolver = resolver
+		verdict, err := test.policy.Check(ctx, readFixture(t, test.fixture))
+		if !errors.Is(err, test.err) || (err == nil && verdict.Method != test.method) {
+			t.Errorf("%s with %v gave %+v, %v", test.fixture, test.policy.Domains, verdict, err)
+		}
+	}
+
+	// DNS failures may be temporary
+	policy := Policy{Domains: []string{"example.com"}, Resolver: &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("network is unreachable")
+		},
+	}}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err := policy.Check(ctx, readFixture(t, "rsa.eml"))
+	if !errors.Is(err, ErrTemporary) {
+		t.Errorf("check without DNS gave %v", err)
+	}
+}
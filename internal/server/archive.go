@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cptaffe/email2rss/internal/backend"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// archivePageSize is the number of items on each page of a feed's archive index
+const archivePageSize = 50
+
+// archivePathRegexp matches the paths of archive pages within a feed: the index, its pages and months
+var archivePathRegexp = regexp.MustCompile(`^(|page/[1-9][0-9]*/|[0-9]{4}/[0-9]{2}/)$`)
+
+// ArchivePage is passed to the archive template, for the pages of the index and for each month
+type ArchivePage struct {
+	Backend backend.Backend
+	// Title is empty on the pages of the index, and the month's name on month pages
+	Title   string
+	URL     string
+	FeedURL string
+	// Months are the items shown on this page, grouped by month
+	Months []*ArchiveMonth
+	// All lists every month of the archive, without items, for navigation
+	All []*ArchiveMonth
+	// Prev and Next are the URLs of the neighbouring pages, if any
+	Prev, Next  string
+	Page, Pages int
+}
+
+// ArchiveMonth groups the items published in a month, newest first
+type ArchiveMonth struct {
+	Name  string
+	URL   string
+	Count int
+	Items []ArchiveEntry
+}
+
+type ArchiveEntry struct {
+	Title     string
+	URL       string
+	Published time.Time
+	Summary   string
+}
+
+// archive is a set of pages, keyed by their path within the feed's archive, e.g. "2024/11/"
+type archive map[string]*ArchivePage
+
+// buildArchive lays out the archive of a feed's items, which are ordered newest first
+func (s *Server) buildArchive(back backend.Backend, items []backend.Item) archive {
+	base := fmt.Sprintf("%s/email2rss/%s/", strings.TrimRight(s.config.BaseURL, "/"), back.Name())
+	var entries []ArchiveEntry
+	var months []*ArchiveMonth
+	byPath := map[string]*ArchiveMonth{}
+	for _, item := range items {
+		listable, ok := item.(backend.Listable)
+		if !ok {
+			continue
+		}
+		published := listable.Published().UTC()
+		entry := ArchiveEntry{
+			Title:     listable.Title(),
+			URL:       base + "items/" + item.Key(),
+			Published: published,
+			Summary:   listable.Summary(),
+		}
+		entries = append(entries, entry)
+		path := published.Format("2006/01/")
+		month, ok := byPath[path]
+		if !ok {
+			month = &ArchiveMonth{Name: published.Format("January 2006"), URL: base + path}
+			byPath[path] = month
+			months = append(months, month)
+		}
+		month.Items = append(month.Items, entry)
+		month.Count++
+	}
+
+	// The navigation lists months without their items
+	all := make([]*ArchiveMonth, len(months))
+	for i, month := range months {
+		all[i] = &ArchiveMonth{Name: month.Name, URL: month.URL, Count: month.Count}
+	}
+
+	pages := archive{}
+	for path, month := range byPath {
+		pages[path] = &ArchivePage{Backend: back, Title: month.Name, URL: month.URL, Months: []*ArchiveMonth{month}, All: all, Page: 1, Pages: 1}
+	}
+	count := max(1, (len(entries)+archivePageSize-1)/archivePageSize)
+	pageURL := func(page int) string {
+		if page == 1 {
+			return base
+		}
+		return fmt.Sprintf("%spage/%d/", base, page)
+	}
+	for page := 1; page <= count; page++ {
+		p := &ArchivePage{Backend: back, URL: pageURL(page), All: all, Page: page, Pages: count}
+		if page > 1 {
+			p.Prev = pageURL(page - 1)
+		}
+		if page < count {
+			p.Next = pageURL(page + 1)
+		}
+		start := (page - 1) * archivePageSize
+		for _, entry := range entries[start:min(start+archivePageSize, len(entries))] {
+			path := entry.Published.Format("2006/01/")
+			if n := len(p.Months); n == 0 || p.Months[n-1].URL != base+path {
+				p.Months = append(p.Months, &ArchiveMonth{Name: byPath[path].Name, URL: base + path, Count: byPath[path].Count})
+			}
+			month := p.Months[len(p.Months)-1]
+			month.Items = append(month.Items, entry)
+		}
+		path := strings.TrimPrefix(pageURL(page), base)
+		pages[path] = p
+	}
+	for _, p := range pages {
+		p.FeedURL = strings.TrimSuffix(base, "/")
+	}
+	return pages
+}
+
+func archiveKey(feed, path string) string {
+	return fmt.Sprintf("%s/archive/%sindex.html", feed, path)
+}
+
+// writeArchive renders a feed's archive into the bucket, where it can be served
+// by GetArchive or straight from the bucket, and removes pages which no longer exist
+func (s *Server) writeArchive(ctx context.Context, back backend.Backend, items []backend.Item) error {
+	pages := s.buildArchive(back, items)
+	written := map[string]bool{}
+	for path, page := range pages {
+		var b bytes.Buffer
+		err := s.pages.ExecuteTemplate(&b, "archive.html.tmpl", page)
+		if err != nil {
+			return fmt.Errorf("execute archive template: %w", err)
+		}
+		key := archiveKey(back.Name(), path)
+		err = s.bucket.WriteAll(ctx, key, b.Bytes(), &blob.WriterOptions{ContentType: "text/html;charset=UTF-8"})
+		if err != nil {
+			return fmt.Errorf("write archive page: %w", err)
+		}
+		written[key] = true
+	}
+
+	iter := s.bucket.List(&blob.ListOptions{Prefix: fmt.Sprintf("%s/archive/", back.Name())})
+	for {
+		obj, err := iter.Next(ctx)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("list archive pages: %w", err)
+		}
+		if !written[obj.Key] {
+			err = s.bucket.Delete(ctx, obj.Key)
+			if err != nil {
+				return fmt.Errorf("delete old archive page: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// GetArchive serves a page of a feed's archive
+func (s *Server) GetArchive(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	feed := req.PathValue("feed")
+	path := strings.TrimPrefix(req.URL.Path, fmt.Sprintf("/email2rss/%s/", feed))
+	if !archivePathRegexp.MatchString(path) {
+		http.NotFound(w, req)
+		return
+	}
+	key := archiveKey(feed, path)
+	attrs, err := s.bucket.Attributes(ctx, key)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not fetch archive attributes", http.StatusInternalServerError)
+		log.Printf("fetch object attributes: %v", err)
+		return
+	}
+	blobReader, err := s.bucket.NewReader(ctx, key, nil)
+	if err != nil {
+		http.Error(w, "Could not access archive", http.StatusInternalServerError)
+		log.Printf("construct object reader: %v", err)
+		return
+	}
+	defer blobReader.Close()
+	b, err := io.ReadAll(blobReader)
+	if err != nil {
+		http.Error(w, "Could not read archive", http.StatusInternalServerError)
+		log.Printf("read archive page: %v", err)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/html;charset=UTF-8")
+	w.Header().Add("Content-Disposition", "inline")
+	w.Header().Add("Content-Security-Policy", itemCSP)
+	w.Header().Add("X-Content-Type-Options", "nosniff")
+	w.Header().Add("Cache-Control", "no-cache")
+	if _, ok := ctx.Value(tokenKey{}).(string); !ok {
+		w.Header().Add("ETag", attrs.ETag)
+	}
+	http.ServeContent(w, req, "index.html", blobReader.ModTime(), bytes.NewReader(s.capabilityURLs(ctx, feed, b)))
+}
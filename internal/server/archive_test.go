@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cptaffe/email2rss/internal/fetch"
+	"github.com/cptaffe/email2rss/internal/generic"
+	"gocloud.dev/blob"
+)
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	back, err := s.Backend("digest")
+	if err != nil {
+		t.Fatalf("load backend: %v", err)
+	}
+
+	// A daily newsletter from the 1st of October to the 24th of November
+	start := time.Date(2024, 10, 1, 8, 0, 0, 0, time.UTC)
+	var keys []string
+	for i := range 55 {
+		item := &generic.Message{
+			UUID:    fmt.Sprintf("item-%d", i),
+			Subject: fmt.Sprintf("Issue %d", i),
+			Date:    start.AddDate(0, 0, i),
+			Body:    fmt.Sprintf("<p>Body of issue %d</p>", i),
+		}
+		err = s.writeItem(ctx, "digest", item)
+		if err != nil {
+			t.Fatalf("write item: %v", err)
+		}
+		keys = append(keys, item.Key())
+	}
+	err = s.refreshFeed(ctx, back)
+	if err != nil {
+		t.Fatalf("refresh feed: %v", err)
+	}
+
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, index := get("/email2rss/digest/")
+	if code != http.StatusOK {
+		t.Fatalf("index gave %d", code)
+	}
+	for _, expected := range []string{
+		`<h2><a href="https://connor.zip/email2rss/digest/2024/11/">November 2024</a></h2>`,
+		`<h3><a href="https://connor.zip/email2rss/digest/items/2024-11-24T08:00:00Z">Issue 54</a></h3>`,
+		`<time datetime="2024-11-24T08:00:00Z">November 24, 2024</time>`,
+		"<p>Body of issue 54</p>",
+		`<a href="https://connor.zip/email2rss/digest/page/2/" rel="next">Older →</a>`,
+		"Page 1 of 2",
+		`<li><a href="https://connor.zip/email2rss/digest/2024/10/">October 2024</a> (31)</li>`,
+	} {
+		if !strings.Contains(index, expected) {
+			t.Errorf("index is missing %s:\n%s", expected, index)
+		}
+	}
+	if n := strings.Count(index, "<article>"); n != archivePageSize {
+		t.Errorf("index lists %d items, expected %d", n, archivePageSize)
+	}
+
+	code, page := get("/email2rss/digest/page/2/")
+	if code != http.StatusOK {
+		t.Fatalf("second page gave %d", code)
+	}
+	if n := strings.Count(page, "<article>"); n != 5 || !strings.Contains(page, ">Issue 0<") || !strings.Contains(page, `rel="prev">← Newer`) {
+		t.Errorf("second page lists %d items:\n%s", n, page)
+	}
+
+	code, month := get("/email2rss/digest/2024/11/")
+	if code != http.StatusOK {
+		t.Fatalf("month gave %d", code)
+	}
+	if n := strings.Count(month, "<article>"); n != 24 || !strings.Contains(month, "<title>November 2024 · digest</title>") {
+		t.Errorf("month lists %d items:\n%s", n, month)
+	}
+
+	for _, path := range []string{"/email2rss/digest/2024/12/", "/email2rss/digest/page/3/", "/email2rss/digest/page/0/"} {
+		if code, _ := get(path); code != http.StatusNotFound {
+			t.Errorf("%s gave %d, expected 404", path, code)
+		}
+	}
+
+	// Pages which no longer have any items are removed
+	for _, key := range keys[5:] {
+		err = bucket.Delete(ctx, "digest/items/"+key+".json")
+		if err != nil {
+			t.Fatalf("delete item: %v", err)
+		}
+	}
+	err = s.refreshFeed(ctx, back)
+	if err != nil {
+		t.Fatalf("refresh feed: %v", err)
+	}
+	for _, path := range []string{"/email2rss/digest/2024/11/", "/email2rss/digest/page/2/"} {
+		if code, _ := get(path); code != http.StatusNotFound {
+			t.Errorf("%s gave %d after its items were deleted", path, code)
+		}
+	}
+	if _, index := get("/email2rss/digest/"); strings.Count(index, "<article>") != 5 {
+		t.Errorf("index isn't updated:\n%s", index)
+	}
+}
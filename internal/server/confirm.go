@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cptaffe/email2rss/internal/config"
+	"github.com/cptaffe/email2rss/internal/confirm"
+	"github.com/cptaffe/email2rss/internal/sender"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+const (
+	// ConfirmationPending is the status of a confirmation whose link hasn't been followed successfully
+	ConfirmationPending = "pending"
+	// ConfirmationConfirmed is the status of a confirmation whose link has been followed
+	ConfirmationConfirmed = "confirmed"
+)
+
+// Confirmation is an email asking to confirm a subscription to a feed, stored under {feed}/confirmations/
+type Confirmation struct {
+	ID       string    `json:"id"`
+	Feed     string    `json:"feed"`
+	Received time.Time `json:"received"`
+	From     string    `json:"from"`
+	Subject  string    `json:"subject"`
+	// Link confirms the subscription when followed
+	Link      string     `json:"link"`
+	Status    string     `json:"status"`
+	Confirmed *time.Time `json:"confirmed,omitempty"`
+	// LastError is why following the link last failed
+	LastError string `json:"lastError,omitempty"`
+}
+
+func confirmationKey(feed, id string) string {
+	return fmt.Sprintf("%s/confirmations/%s.json", feed, id)
+}
+
+// newDetectors compiles the confirmation heuristics of each feed which has them
+func newDetectors(feeds map[string]config.Feed) (map[string]*confirm.Detector, error) {
+	detectors := map[string]*confirm.Detector{}
+	for name, feed := range feeds {
+		if feed.Confirmations == nil {
+			continue
+		}
+		d, err := confirm.New(feed.Confirmations.Subjects, feed.Confirmations.Links)
+		if err != nil {
+			return nil, fmt.Errorf("compile confirmations of feed %s: %w", name, err)
+		}
+		detectors[name] = d
+	}
+	return detectors, nil
+}
+
+// holdConfirmation records a confirmation email instead of adding it to the feed, following its
+// link straight away if the sender was authenticated and is allowlisted, and answers 202 Accepted
+func (s *Server) holdConfirmation(ctx context.Context, w http.ResponseWriter, feed string, msg *mail.Message, verdict *sender.Verdict, detected *confirm.Confirmation) {
+	now := time.Now().UTC()
+	var nonce [4]byte
+	rand.Read(nonce[:])
+	c := &Confirmation{
+		ID:       fmt.Sprintf("%s-%x", now.Format(versionLayout), nonce),
+		Feed:     feed,
+		Received: now,
+		Subject:  detected.Subject,
+		Link:     detected.Link,
+		Status:   ConfirmationPending,
+	}
+	if addrs, err := msg.Header.AddressList("From"); err == nil && len(addrs) > 0 {
+		c.From = addrs[0].Address
+	}
+	err := s.writeConfirmation(ctx, c)
+	if err != nil {
+		http.Error(w, "Could not store confirmation", http.StatusInternalServerError)
+		log.Printf("store confirmation: %v", err)
+		return
+	}
+	log.Printf("held back confirmation email from %s to feed %s as %s", c.From, feed, c.ID)
+	s.releaseRetried(ctx, feed)
+
+	if s.follows(feed, verdict, c.Link) {
+		err = s.confirm(ctx, c)
+		if err != nil {
+			log.Printf("confirm subscription %s of feed %s: %v", c.ID, feed, err)
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+	err = json.NewEncoder(w).Encode(&AddEmailResponse{ID: c.ID, Confirmation: true})
+	if err != nil {
+		log.Printf("encode response as json: %v", err)
+	}
+}
+
+// follows reports whether the feed automatically confirms a subscription, which it only does for
+// email authenticated as from an allowlisted domain whose link is within that domain
+func (s *Server) follows(feed string, verdict *sender.Verdict, link string) bool {
+	cfg := s.config.Feed(feed).Confirmations
+	if cfg == nil || verdict == nil {
+		return false
+	}
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range cfg.Follow {
+		allowed = strings.ToLower(strings.TrimSuffix(allowed, "."))
+		if withinDomain(verdict.From, allowed) && withinDomain(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// withinDomain reports whether a domain is parent or one of its subdomains
+func withinDomain(domain, parent string) bool {
+	return domain == parent || strings.HasSuffix(domain, "."+parent)
+}
+
+// confirm follows a confirmation's link, recording the outcome
+func (s *Server) confirm(ctx context.Context, c *Confirmation) error {
+	err := s.followLink(ctx, c.Link)
+	if err != nil {
+		c.LastError = err.Error()
+	} else {
+		now := time.Now().UTC()
+		c.Status = ConfirmationConfirmed
+		c.Confirmed = &now
+		c.LastError = ""
+	}
+	if werr := s.writeConfirmation(ctx, c); werr != nil {
+		return werr
+	}
+	return err
+}
+
+func (s *Server) followLink(ctx context.Context, link string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return fmt.Errorf("construct request: %w", err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("follow link: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("link answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *Server) writeConfirmation(ctx context.Context, c *Confirmation) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("encode confirmation: %w", err)
+	}
+	err = s.bucket.WriteAll(ctx, confirmationKey(c.Feed, c.ID), b, &blob.WriterOptions{ContentType: "application/json;charset=UTF-8"})
+	if err != nil {
+		return fmt.Errorf("write confirmation file: %w", err)
+	}
+	return nil
+}
+
+// Confirmations lists the confirmation emails received by a feed, newest first
+func (s *Server) Confirmations(ctx context.Context, feed string) ([]*Confirmation, error) {
+	var confirmations []*Confirmation
+	iter := s.bucket.List(&blob.ListOptions{Prefix: fmt.Sprintf("%s/confirmations/", feed)})
+	for {
+		obj, err := iter.Next(ctx)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("list confirmations: %w", err)
+		}
+		b, err := s.bucket.ReadAll(ctx, obj.Key)
+		if err != nil {
+			return nil, fmt.Errorf("read confirmation file: %w", err)
+		}
+		var c Confirmation
+		err = json.Unmarshal(b, &c)
+		if err != nil {
+			return nil, fmt.Errorf("parse confirmation file %s: %w", obj.Key, err)
+		}
+		confirmations = append(confirmations, &c)
+	}
+	slices.Reverse(confirmations)
+	return confirmations, nil
+}
+
+// GetConfirmations lists the feed's pending confirmations, or with ?all those already confirmed too
+func (s *Server) GetConfirmations(w http.ResponseWriter, req *http.Request) {
+	confirmations, err := s.Confirmations(req.Context(), req.PathValue("feed"))
+	if err != nil {
+		http.Error(w, "Could not list confirmations", http.StatusInternalServerError)
+		log.Printf("list confirmations: %v", err)
+		return
+	}
+	if !req.URL.Query().Has("all") {
+		confirmations = slices.DeleteFunc(confirmations, func(c *Confirmation) bool {
+			return c.Status != ConfirmationPending
+		})
+	}
+	if confirmations == nil {
+		confirmations = []*Confirmation{}
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	err = json.NewEncoder(w).Encode(confirmations)
+	if err != nil {
+		log.Printf("write confirmations: %v", err)
+	}
+}
+
+// Confirm follows a confirmation's link straight away, answering with the outcome
+func (s *Server) Confirm(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	feed := req.PathValue("feed")
+	b, err := s.bucket.ReadAll(ctx, confirmationKey(feed, req.PathValue("id")))
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		http.Error(w, "No such confirmation", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not read confirmation", http.StatusInternalServerError)
+		log.Printf("read confirmation: %v", err)
+		return
+	}
+	var c Confirmation
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		http.Error(w, "Could not parse confirmation", http.StatusInternalServerError)
+		log.Printf("parse confirmation: %v", err)
+		return
+	}
+	err = s.confirm(ctx, &c)
+	if err != nil {
+		log.Printf("confirm subscription %s of feed %s: %v", c.ID, feed, err)
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	err = json.NewEncoder(w).Encode(&c)
+	if err != nil {
+		log.Printf("write confirmation: %v", err)
+	}
+}
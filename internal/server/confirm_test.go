@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cptaffe/email2rss/internal/config"
+	"gocloud.dev/blob"
+)
+
+func TestConfirmations(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	confirmed := map[string]int{}
+	newsletter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := req.URL.Query().Get("token")
+		confirmed[token]++
+		if token == "flaky" && confirmed[token] == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		}
+	}))
+	defer newsletter.Close()
+
+	target, err := url.Parse(newsletter.URL)
+	if err != nil {
+		t.Fatalf("parse test server url: %v", err)
+	}
+
+	cfg := config.Default()
+	cfg.Admin = testAdmin
+	cfg.RelayAccess = map[string]*config.Access{"mx.example.org": {Tokens: []string{"relay-token"}}}
+	cfg.Feeds = map[string]config.Feed{
+		"digest": {Senders: &config.Senders{Domains: []string{"example.com"}}, Confirmations: &config.Confirmations{Follow: []string{"example.com"}}},
+		"weekly": {Confirmations: &config.Confirmations{}},
+		// Without senders, the From address can't be believed
+		"unverified": {Confirmations: &config.Confirmations{Follow: []string{"example.com"}}},
+	}
+	client := &http.Client{Transport: rewriteTransport{target: target}}
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(client), WithConfig(cfg))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := asAdmin(httptest.NewRequest(method, path, strings.NewReader(body)))
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+	list := func(path string) []*Confirmation {
+		rec := do(http.MethodGet, path, "")
+		var confirmations []*Confirmation
+		err := json.NewDecoder(rec.Body).Decode(&confirmations)
+		if err != nil {
+			t.Fatalf("decode confirmations: %v", err)
+		}
+		return confirmations
+	}
+	email := func(link string) string {
+		return "Authentication-Results: mx.example.org; dmarc=pass header.from=news.example.com\r\n" +
+			"From: Weekly Digest <digest@news.example.com>\r\n" +
+			"To: connor+digest@example.org\r\n" +
+			"Subject: Please confirm your subscription\r\n" +
+			"Date: Sun, 03 Nov 2024 13:55:35 +0000\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"\r\n" +
+			`<a href="https://news.example.com/unsubscribe">Unsubscribe</a> ` +
+			`<a href="` + link + `">Yes, subscribe me</a>`
+	}
+
+	// The relay's results aren't believed unless it submitted the email itself
+	rec := do(http.MethodPost, "/email2rss/digest/email", email("https://news.example.com/confirm?token=digest"))
+	if rec.Code != http.StatusForbidden || confirmed["digest"] != 0 {
+		t.Fatalf("email with forgeable results gave %d, expected 403: %s", rec.Code, rec.Body)
+	}
+
+	// Confirmations from allowlisted senders are followed straight away
+	rec = do(http.MethodPost, "/email2rss/digest/email?token=relay-token", email("https://news.example.com/confirm?token=digest"))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("confirmation email gave %d, expected 202: %s", rec.Code, rec.Body)
+	}
+	var resp AddEmailResponse
+	err = json.NewDecoder(rec.Body).Decode(&resp)
+	if err != nil || !resp.Confirmation {
+		t.Errorf("response is %+v, %v", resp, err)
+	}
+	if confirmed["digest"] != 1 {
+		t.Errorf("confirmation link was followed %d times, expected once", confirmed["digest"])
+	}
+	if pending := list("/email2rss/digest/confirmations"); len(pending) != 0 {
+		t.Errorf("digest has pending confirmations %+v", pending)
+	}
+	all := list("/email2rss/digest/confirmations?all")
+	if len(all) != 1 || all[0].Status != ConfirmationConfirmed || all[0].Confirmed == nil || all[0].From != "digest@news.example.com" {
+		t.Errorf("digest confirmations are %+v", all)
+	}
+	exists, err := bucket.Exists(ctx, "digest/items/2024-11-03T13:55:35Z.json")
+	if err != nil || exists {
+		t.Errorf("confirmation email was published: %v", err)
+	}
+
+	// Others wait to be confirmed through the admin API
+	rec = do(http.MethodPost, "/email2rss/weekly/email", email("https://news.example.com/confirm?token=flaky"))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("confirmation email gave %d, expected 202: %s", rec.Code, rec.Body)
+	}
+	pending := list("/email2rss/weekly/confirmations")
+	if len(pending) != 1 || pending[0].Link != "https://news.example.com/confirm?token=flaky" || confirmed["flaky"] != 0 {
+		t.Fatalf("weekly has pending confirmations %+v", pending)
+	}
+	// Only admins see or confirm them, and no one does without admin configured
+	for admin, code := range map[*config.Access]int{testAdmin: http.StatusUnauthorized, nil: http.StatusForbidden} {
+		s.config.Admin = admin
+		for _, target := range []string{"/email2rss/weekly/confirmations", "/email2rss/weekly/confirmations/" + pending[0].ID + "/confirm"} {
+			method := http.MethodGet
+			if strings.HasSuffix(target, "/confirm") {
+				method = http.MethodPost
+			}
+			rec = httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+			if rec.Code != code {
+				t.Errorf("%s %s without credentials gave %d, expected %d", method, target, rec.Code, code)
+			}
+		}
+	}
+	s.config.Admin = testAdmin
+	if confirmed["flaky"] != 0 {
+		t.Fatalf("confirmation link was followed without credentials")
+	}
+	for i, status := range []string{ConfirmationPending, ConfirmationConfirmed} {
+		rec = do(http.MethodPost, "/email2rss/weekly/confirmations/"+pending[0].ID+"/confirm", "")
+		var c Confirmation
+		err = json.NewDecoder(rec.Body).Decode(&c)
+		if err != nil {
+			t.Fatalf("decode confirmation: %v", err)
+		}
+		if c.Status != status || (status == ConfirmationPending) != (c.LastError != "") {
+			t.Errorf("confirmation after attempt %d is %+v, expected %s", i+1, c, status)
+		}
+	}
+	if pending := list("/email2rss/weekly/confirmations"); len(pending) != 0 {
+		t.Errorf("weekly has pending confirmations %+v", pending)
+	}
+	if rec = do(http.MethodPost, "/email2rss/weekly/confirmations/missing/confirm", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("confirming missing confirmation gave %d, expected 404", rec.Code)
+	}
+
+	// Links aren't followed unless the sender was authenticated, or outside the allowlisted domain
+	for feed, link := range map[string]string{
+		"unverified": "https://news.example.com/confirm?token=unverified",
+		"digest":     "https://tracker.example.net/confirm?token=elsewhere",
+	} {
+		rec = do(http.MethodPost, "/email2rss/"+feed+"/email?token=relay-token", email(link))
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("confirmation email to %s gave %d, expected 202: %s", feed, rec.Code, rec.Body)
+		}
+		if pending := list("/email2rss/" + feed + "/confirmations"); len(pending) != 1 || pending[0].Link != link {
+			t.Errorf("%s has pending confirmations %+v", feed, pending)
+		}
+	}
+	if confirmed["unverified"] != 0 || confirmed["elsewhere"] != 0 {
+		t.Errorf("links were followed automatically: %v", confirmed)
+	}
+
+	// Newsletters are still published
+	rec = do(http.MethodPost, "/email2rss/weekly/email", testMailchimpEmail)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("newsletter gave %d, expected 201: %s", rec.Code, rec.Body)
+	}
+}
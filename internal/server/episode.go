@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/cptaffe/email2rss/internal/backend"
+	"gocloud.dev/blob"
+)
+
+// number gives an item the next number in its feed, if its backend numbers items, so that numbers
+// don't change when an older email arrives late or is retried. An item replacing one already stored
+// keeps its number. Feeds whose items predate numbering are first numbered oldest first, as their
+// position in the feed numbered them before.
+func (s *Server) number(ctx context.Context, back backend.Backend, item backend.Item) error {
+	numbered, ok := item.(backend.Numbered)
+	if !ok {
+		return nil
+	}
+	type storedItem struct {
+		key  string
+		item backend.Item
+	}
+	var stored []storedItem
+	last := 0
+	prefix := fmt.Sprintf("%s/items/", back.Name())
+	iter := s.bucket.List(&blob.ListOptions{Prefix: prefix})
+	for {
+		obj, err := iter.Next(ctx)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("list items: %w", err)
+		}
+		key := strings.TrimSuffix(strings.TrimPrefix(obj.Key, prefix), ".json")
+		existing, err := s.readItem(ctx, back, key)
+		if err != nil {
+			return err
+		}
+		if n, ok := existing.(backend.Numbered); ok {
+			last = max(last, n.Number())
+			stored = append(stored, storedItem{key, existing})
+		}
+	}
+
+	if last == 0 {
+		slices.SortStableFunc(stored, func(a, b storedItem) int {
+			return compareKeys(a.key, b.key)
+		})
+		for _, existing := range stored {
+			last++
+			existing.item.(backend.Numbered).SetNumber(last)
+			err := s.writeItem(ctx, back.Name(), existing.item)
+			if err != nil {
+				return fmt.Errorf("number item %s: %w", existing.key, err)
+			}
+		}
+	}
+	for _, existing := range stored {
+		if existing.key == item.Key() {
+			numbered.SetNumber(existing.item.(backend.Numbered).Number())
+			return nil
+		}
+	}
+	numbered.SetNumber(last + 1)
+	return nil
+}
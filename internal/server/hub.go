@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/cptaffe/email2rss/internal/websub"
+)
+
+// feedContentType is the media type of published feeds, sent to WebSub subscribers
+const feedContentType = "application/rss+xml;charset=UTF-8"
+
+// selfURL is the address a feed is published at, which is its WebSub topic
+func (s *Server) selfURL(feed string) string {
+	baseURL := strings.TrimRight(s.config.BaseURL, "/")
+	if feed == "journalclub" {
+		// The address the feed had before email2rss hosted other feeds
+		return baseURL + "/journalclub/feed.xml"
+	}
+	return fmt.Sprintf("%s/email2rss/%s", baseURL, feed)
+}
+
+// hubURL is the WebSub hub feeds advertise, the built-in one unless an external hub is configured
+func (s *Server) hubURL() string {
+	if s.config.Hub != "" {
+		return s.config.Hub
+	}
+	return strings.TrimRight(s.config.BaseURL, "/") + "/email2rss/hub"
+}
+
+// topicFeed finds the feed a WebSub topic names
+func (s *Server) topicFeed(topic string) (string, bool) {
+	if topic == s.selfURL("journalclub") {
+		return "journalclub", true
+	}
+	feed, ok := strings.CutPrefix(topic, strings.TrimRight(s.config.BaseURL, "/")+"/email2rss/")
+	if !ok || feed == "" || strings.ContainsAny(feed, "/?#") {
+		return "", false
+	}
+	if s.config.Feed(feed).Private != nil {
+		return "", false
+	}
+	return feed, true
+}
+
+// notify tells the feed's subscribers that it's been published, through the configured hub
+func (s *Server) notify(ctx context.Context, feed string, content []byte) {
+	if s.config.Feed(feed).Private != nil {
+		return
+	}
+	if s.config.Hub == "" {
+		s.hub.Notify(ctx, feed, feedContentType, content)
+		return
+	}
+	err := websub.Ping(ctx, s.client, s.config.Hub, s.selfURL(feed))
+	if err != nil {
+		log.Printf("ping hub for feed %s: %v", feed, err)
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cptaffe/email2rss/internal/config"
+	"github.com/cptaffe/email2rss/internal/generic"
+	"github.com/cptaffe/email2rss/internal/journalclub"
+	"gocloud.dev/blob"
+)
+
+func TestHub(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	verified := make(chan string, 1)
+	delivered := make(chan string, 1)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			io.WriteString(w, req.URL.Query().Get("hub.challenge"))
+			verified <- req.URL.Query().Get("hub.topic")
+			return
+		}
+		b, _ := io.ReadAll(req.Body)
+		delivered <- string(b)
+	}))
+	defer subscriber.Close()
+
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(subscriber.Client()))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	form := url.Values{"hub.mode": {"subscribe"}, "hub.topic": {"https://connor.zip/email2rss/digest"}, "hub.callback": {subscriber.URL}}
+	req := httptest.NewRequest(http.MethodPost, "/email2rss/hub", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("subscribe gave %d: %s", rec.Code, rec.Body)
+	}
+	select {
+	case topic := <-verified:
+		if topic != "https://connor.zip/email2rss/digest" {
+			t.Errorf("verified topic %s", topic)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("subscription wasn't verified")
+	}
+	// Verification finishes in the background after the subscriber answers
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		subs, err := s.hub.Subscriptions(ctx, "digest")
+		if err != nil {
+			t.Fatalf("list subscriptions: %v", err)
+		}
+		if len(subs) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("subscription wasn't stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = s.writeItem(ctx, "digest", &generic.Message{UUID: "a", Subject: "Issue", Date: time.Date(2024, 11, 1, 8, 0, 0, 0, time.UTC), Body: "<p>Body</p>"})
+	if err != nil {
+		t.Fatalf("write item: %v", err)
+	}
+	back, err := s.Backend("digest")
+	if err != nil {
+		t.Fatalf("load backend: %v", err)
+	}
+	err = s.refreshFeed(ctx, back)
+	if err != nil {
+		t.Fatalf("refresh feed: %v", err)
+	}
+	select {
+	case feed := <-delivered:
+		for _, link := range []string{
+			`<atom:link href="https://connor.zip/email2rss/digest" rel="self"`,
+			`<atom:link href="https://connor.zip/email2rss/hub" rel="hub"`,
+		} {
+			if !strings.Contains(feed, link) {
+				t.Errorf("delivered feed doesn't contain %s", link)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("feed wasn't delivered")
+	}
+}
+
+func TestExternalHub(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	var pinged url.Values
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		pinged = req.PostForm
+	}))
+	defer hub.Close()
+
+	cfg := config.Default()
+	cfg.Hub = hub.URL
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(hub.Client()), WithConfig(cfg))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	err = s.writeItem(ctx, "journalclub", &journalclub.Message{
+		UUID:      "episode",
+		Subject:   "Dams & deep learning",
+		Date:      time.Date(2024, 11, 3, 13, 55, 35, 0, time.UTC),
+		AudioURL:  "https://example.com/episode.mp3",
+		AudioSize: 1024,
+	})
+	if err != nil {
+		t.Fatalf("write item: %v", err)
+	}
+	back, err := s.Backend("journalclub")
+	if err != nil {
+		t.Fatalf("load backend: %v", err)
+	}
+	err = s.refreshFeed(ctx, back)
+	if err != nil {
+		t.Fatalf("refresh feed: %v", err)
+	}
+	if pinged.Get("hub.url") != "https://connor.zip/journalclub/feed.xml" {
+		t.Errorf("hub was pinged with %v", pinged)
+	}
+	feed, err := bucket.ReadAll(ctx, "journalclub/feed.xml")
+	if err != nil {
+		t.Fatalf("read feed: %v", err)
+	}
+	if !strings.Contains(string(feed), `<atom:link href="`+hub.URL+`" rel="hub"`) {
+		t.Errorf("feed doesn't advertise the external hub")
+	}
+	// The podcast:guid is derived from the feed's configured address
+	if !strings.Contains(string(feed), "<podcast:guid>90ae3f88-240e-54b1-9b06-1eac8b494ded</podcast:guid>") {
+		t.Errorf("feed doesn't have the podcast:guid of its address")
+	}
+}
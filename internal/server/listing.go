@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// FeedInfo describes a feed hosted on the instance
+type FeedInfo struct {
+	Name  string `json:"name"`
+	Title string `json:"title"`
+	// URL is the feed itself, and HTMLURL its archive
+	URL     string `json:"url"`
+	HTMLURL string `json:"htmlURL"`
+	Items   int    `json:"items"`
+	// Updated is when the feed was last published
+	Updated time.Time `json:"updated"`
+}
+
+// listFeeds describes every prefix of the bucket which has a published feed
+func (s *Server) listFeeds(ctx context.Context) ([]FeedInfo, error) {
+	names, err := s.feeds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	baseURL := strings.TrimRight(s.config.BaseURL, "/")
+	var feeds []FeedInfo
+	for _, name := range names {
+		if s.config.Feed(name).Private != nil {
+			continue
+		}
+		attrs, err := s.bucket.Attributes(ctx, feedKey(name))
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			// Not a feed, or one which hasn't been published yet
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fetch feed attributes: %w", err)
+		}
+		title, err := s.feedTitle(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		items, err := s.countItems(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, FeedInfo{
+			Name:    name,
+			Title:   title,
+			URL:     fmt.Sprintf("%s/email2rss/%s", baseURL, name),
+			HTMLURL: fmt.Sprintf("%s/email2rss/%s/", baseURL, name),
+			Items:   items,
+			Updated: attrs.ModTime.UTC(),
+		})
+	}
+	return feeds, nil
+}
+
+// feedTitle reads the title of a published feed, falling back to its name
+func (s *Server) feedTitle(ctx context.Context, feed string) (string, error) {
+	r, err := s.bucket.NewReader(ctx, feedKey(feed), nil)
+	if err != nil {
+		return "", fmt.Errorf("construct feed object reader: %w", err)
+	}
+	defer r.Close()
+	var rss struct {
+		Title string `xml:"channel>title"`
+	}
+	err = xml.NewDecoder(r).Decode(&rss)
+	if err != nil || strings.TrimSpace(rss.Title) == "" {
+		return feed, nil
+	}
+	return strings.TrimSpace(rss.Title), nil
+}
+
+func (s *Server) countItems(ctx context.Context, feed string) (int, error) {
+	count := 0
+	iter := s.bucket.List(&blob.ListOptions{Prefix: fmt.Sprintf("%s/items/", feed)})
+	for {
+		_, err := iter.Next(ctx)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, fmt.Errorf("list items: %w", err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+type opml struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    struct {
+		Title       string `xml:"title"`
+		DateCreated string `xml:"dateCreated"`
+	} `xml:"head"`
+	Outlines []opmlOutline `xml:"body>outline"`
+}
+
+type opmlOutline struct {
+	Type    string `xml:"type,attr"`
+	Text    string `xml:"text,attr"`
+	Title   string `xml:"title,attr"`
+	XMLURL  string `xml:"xmlUrl,attr"`
+	HTMLURL string `xml:"htmlUrl,attr"`
+}
+
+// GetOPML lists the instance's feeds as OPML, for subscribing to all of them at once
+func (s *Server) GetOPML(w http.ResponseWriter, req *http.Request) {
+	feeds, err := s.listFeeds(req.Context())
+	if err != nil {
+		http.Error(w, "Could not list feeds", http.StatusInternalServerError)
+		log.Printf("list feeds: %v", err)
+		return
+	}
+	doc := opml{Version: "2.0"}
+	doc.Head.Title = "email2rss feeds"
+	doc.Head.DateCreated = time.Now().UTC().Format(RFC2822)
+	for _, feed := range feeds {
+		doc.Outlines = append(doc.Outlines, opmlOutline{Type: "rss", Text: feed.Title, Title: feed.Title, XMLURL: feed.URL, HTMLURL: feed.HTMLURL})
+	}
+	w.Header().Set("Content-Type", "text/x-opml;charset=UTF-8")
+	w.Header().Set("Content-Disposition", `inline; filename="feeds.opml"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(doc)
+	if err != nil {
+		log.Printf("write OPML: %v", err)
+	}
+}
+
+// GetFeeds lists the instance's feeds as JSON, with their item counts and when they were last updated
+func (s *Server) GetFeeds(w http.ResponseWriter, req *http.Request) {
+	feeds, err := s.listFeeds(req.Context())
+	if err != nil {
+		http.Error(w, "Could not list feeds", http.StatusInternalServerError)
+		log.Printf("list feeds: %v", err)
+		return
+	}
+	if feeds == nil {
+		feeds = []FeedInfo{}
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	err = json.NewEncoder(w).Encode(feeds)
+	if err != nil {
+		log.Printf("write feeds: %v", err)
+	}
+}
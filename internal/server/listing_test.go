@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cptaffe/email2rss/internal/fetch"
+	"github.com/cptaffe/email2rss/internal/generic"
+	"gocloud.dev/blob"
+)
+
+func TestListFeeds(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	for feed, count := range map[string]int{"digest": 2, "weekly": 1} {
+		for i := range count {
+			err = s.writeItem(ctx, feed, &generic.Message{UUID: feed + string(rune('a'+i)), Subject: "Issue", Date: time.Date(2024, 11, 1+i, 8, 0, 0, 0, time.UTC), Body: "<p>Body</p>"})
+			if err != nil {
+				t.Fatalf("write item: %v", err)
+			}
+		}
+		back, err := s.Backend(feed)
+		if err != nil {
+			t.Fatalf("load backend: %v", err)
+		}
+		err = s.refreshFeed(ctx, back)
+		if err != nil {
+			t.Fatalf("refresh feed: %v", err)
+		}
+	}
+	// Prefixes without a published feed aren't listed
+	err = bucket.WriteAll(ctx, "unpublished/items/2024-11-01T08:00:00Z.json", []byte("{}"), nil)
+	if err != nil {
+		t.Fatalf("write item: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/email2rss/feeds.json", nil))
+	var feeds []FeedInfo
+	err = json.NewDecoder(rec.Body).Decode(&feeds)
+	if err != nil {
+		t.Fatalf("parse feeds: %v", err)
+	}
+	if len(feeds) != 2 {
+		t.Fatalf("listed %d feeds, expected 2: %+v", len(feeds), feeds)
+	}
+	digest := feeds[0]
+	if digest.Name != "digest" || digest.Title != "digest" || digest.Items != 2 || digest.URL != "https://connor.zip/email2rss/digest" || digest.Updated.IsZero() {
+		t.Errorf("digest is listed as %+v", digest)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/email2rss/feeds.opml", nil))
+	var doc opml
+	err = xml.NewDecoder(rec.Body).Decode(&doc)
+	if err != nil {
+		t.Fatalf("parse OPML: %v", err)
+	}
+	if len(doc.Outlines) != 2 {
+		t.Fatalf("OPML has %d outlines, expected 2", len(doc.Outlines))
+	}
+	expected := opmlOutline{Type: "rss", Text: "weekly", Title: "weekly", XMLURL: "https://connor.zip/email2rss/weekly", HTMLURL: "https://connor.zip/email2rss/weekly/"}
+	if doc.Outlines[1] != expected {
+		t.Errorf("outline is %+v, expected %+v", doc.Outlines[1], expected)
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"gocloud.dev/blob"
+)
+
+// quarantineSize counts the emails held in a feed's quarantine and their size in bytes
+func (s *Server) quarantineSize(ctx context.Context, feed string) (count int, size int64, err error) {
+	iter := s.bucket.List(&blob.ListOptions{Prefix: fmt.Sprintf("%s/quarantine/", feed)})
+	for {
+		obj, err := iter.Next(ctx)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, 0, fmt.Errorf("list quarantine: %w", err)
+		}
+		if strings.HasSuffix(obj.Key, ".eml") {
+			count++
+			size += obj.Size
+		}
+	}
+	return count, size, nil
+}
+
+// GetMetrics serves gauges of the instance's state in the Prometheus text format
+func (s *Server) GetMetrics(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	feeds, err := s.feeds(ctx)
+	if err != nil {
+		http.Error(w, "Could not list feeds", http.StatusInternalServerError)
+		log.Printf("list feeds: %v", err)
+		return
+	}
+	var emails, bytes strings.Builder
+	fmt.Fprintln(&emails, "# HELP email2rss_quarantined_emails Emails held in a feed's quarantine.")
+	fmt.Fprintln(&emails, "# TYPE email2rss_quarantined_emails gauge")
+	fmt.Fprintln(&bytes, "# HELP email2rss_quarantined_bytes Size of the emails held in a feed's quarantine.")
+	fmt.Fprintln(&bytes, "# TYPE email2rss_quarantined_bytes gauge")
+	for _, feed := range feeds {
+		count, size, err := s.quarantineSize(ctx, feed)
+		if err != nil {
+			http.Error(w, "Could not measure quarantine", http.StatusInternalServerError)
+			log.Printf("measure quarantine of feed %s: %v", feed, err)
+			return
+		}
+		fmt.Fprintf(&emails, "email2rss_quarantined_emails{feed=%q} %d\n", feed, count)
+		fmt.Fprintf(&bytes, "email2rss_quarantined_bytes{feed=%q} %d\n", feed, size)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, emails.String()+bytes.String())
+}
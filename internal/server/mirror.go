@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cptaffe/email2rss/internal/backend"
+	"gocloud.dev/blob"
+)
+
+const (
+	// maxAssetSize bounds each mirrored file, which may be a long episode's audio
+	maxAssetSize = 512 * 1024 * 1024
+	// assetTimeout bounds downloading each mirrored file
+	assetTimeout = 10 * time.Minute
+)
+
+// assetURL is the public URL of a mirrored file
+func (s *Server) assetURL(feed, name string) string {
+	return fmt.Sprintf("%s/email2rss/%s/assets/%s", s.config.BaseURL, feed, name)
+}
+
+// mirror copies the remote files an item references into {feed}/assets/ and points the item at the copies
+func (s *Server) mirror(ctx context.Context, feed string, item backend.Mirrorable) error {
+	replacements := map[string]string{}
+	for _, u := range item.RemoteURLs() {
+		if _, ok := replacements[u]; ok || strings.HasPrefix(u, s.assetURL(feed, "")) {
+			continue
+		}
+		name, err := s.mirrorAsset(ctx, feed, u)
+		if err != nil {
+			return fmt.Errorf("mirror %s: %w", u, err)
+		}
+		replacements[u] = s.assetURL(feed, name)
+	}
+	item.ReplaceURLs(replacements)
+	return nil
+}
+
+// mirrorAsset downloads a file into the bucket, named by the hash of its contents
+func (s *Server) mirrorAsset(ctx context.Context, feed, u string) (string, error) {
+	if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return "", fmt.Errorf("refuse to mirror %s: not an http or https URL", u)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", fmt.Errorf("construct request: %w", err)
+	}
+	// Files such as audio take longer than the client's usual timeout
+	client := &http.Client{Transport: s.client.Transport, Timeout: assetTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("GET %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	if resp.ContentLength > maxAssetSize {
+		return "", fmt.Errorf("file of %d bytes exceeds the %d byte limit", resp.ContentLength, maxAssetSize)
+	}
+	return s.storeAsset(ctx, feed, u, resp.Header.Get("Content-Type"), resp.Body)
+}
+
+// storeAsset copies a file into the bucket, named by the hash of its contents.
+// The source, a URL or filename, is used to pick an extension when the type doesn't suggest one.
+func (s *Server) storeAsset(ctx context.Context, feed, source, contentType string, r io.Reader) (string, error) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// The name depends on the contents, so stream them to a temporary
+	// object while hashing and then copy that to its final name
+	var nonce [8]byte
+	rand.Read(nonce[:])
+	tmpKey := fmt.Sprintf("%s/assets/tmp-%x", feed, nonce)
+	w, err := s.bucket.NewWriter(ctx, tmpKey, &blob.WriterOptions{ContentType: contentType})
+	if err != nil {
+		return "", fmt.Errorf("new object writer: %w", err)
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), io.LimitReader(r, maxAssetSize+1))
+	if err == nil && n > maxAssetSize {
+		err = fmt.Errorf("file exceeds the %d byte limit", maxAssetSize)
+	}
+	if err != nil {
+		w.Close()
+		s.bucket.Delete(ctx, tmpKey)
+		return "", fmt.Errorf("copy file into bucket: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return "", fmt.Errorf("close asset file: %w", err)
+	}
+	defer func() {
+		err := s.bucket.Delete(ctx, tmpKey)
+		if err != nil {
+			log.Printf("delete temporary asset file: %v", err)
+		}
+	}()
+
+	name := hex.EncodeToString(h.Sum(nil)) + assetExtension(source, contentType)
+	key := fmt.Sprintf("%s/assets/%s", feed, name)
+	exists, err := s.bucket.Exists(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("check if asset exists: %w", err)
+	}
+	if !exists {
+		err = s.bucket.Copy(ctx, key, tmpKey, nil)
+		if err != nil {
+			return "", fmt.Errorf("copy asset file: %w", err)
+		}
+	}
+	return name, nil
+}
+
+// storeEmbedded stores the files an email carries, pointing the item's cid: URLs
+// at them and publishing attachments the feed allows as enclosures
+func (s *Server) storeEmbedded(ctx context.Context, feed string, item backend.Item) error {
+	embedded, ok := item.(backend.Embedded)
+	if !ok {
+		return nil
+	}
+	attachments := s.config.Feed(feed).Attachments
+	attachable, canAttach := item.(backend.Attachable)
+	replacements := map[string]string{}
+	for _, asset := range embedded.EmbeddedAssets() {
+		if asset.Attachment {
+			if !canAttach || !attachments.Allows(asset.ContentType, int64(len(asset.Data))) {
+				continue
+			}
+		}
+		name, err := s.storeAsset(ctx, feed, asset.Filename, asset.ContentType, bytes.NewReader(asset.Data))
+		if err != nil {
+			return fmt.Errorf("store %s: %w", asset.Filename, err)
+		}
+		if asset.ContentID != "" {
+			replacements["cid:"+asset.ContentID] = s.assetURL(feed, name)
+		}
+		if asset.Attachment {
+			attachable.Attach(backend.Enclosure{
+				URL:    s.assetURL(feed, name),
+				Length: int64(len(asset.Data)),
+				Type:   asset.ContentType,
+				Title:  asset.Filename,
+			})
+		}
+	}
+	if mirrorable, ok := item.(backend.Mirrorable); ok && len(replacements) > 0 {
+		mirrorable.ReplaceURLs(replacements)
+	}
+	return nil
+}
+
+// assetExtension picks a file extension for a stored file, so that its name hints at its type
+func assetExtension(source, contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil {
+		switch mediaType {
+		case "audio/mpeg":
+			return ".mp3"
+		case "image/jpeg":
+			return ".jpg"
+		}
+		exts, err := mime.ExtensionsByType(mediaType)
+		if err == nil && len(exts) > 0 {
+			return exts[0]
+		}
+	}
+	if i := strings.IndexAny(source, "?#"); i >= 0 {
+		source = source[:i]
+	}
+	ext := path.Ext(source)
+	if len(ext) > 5 || strings.ContainsAny(ext, "/:") {
+		return ""
+	}
+	return ext
+}
+
+func (s *Server) GetAsset(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	name := req.PathValue("name")
+	if strings.HasPrefix(name, "tmp-") {
+		http.NotFound(w, req)
+		return
+	}
+	key := fmt.Sprintf("%s/assets/%s", req.PathValue("feed"), name)
+	attrs, err := s.bucket.Attributes(ctx, key)
+	if err != nil {
+		http.Error(w, "Could not find asset", http.StatusNotFound)
+		log.Printf("fetch object attributes: %v", err)
+		return
+	}
+	blobReader, err := s.bucket.NewReader(ctx, key, nil)
+	if err != nil {
+		http.Error(w, "Could not access asset", http.StatusInternalServerError)
+		log.Printf("construct object reader: %v", err)
+		return
+	}
+	defer blobReader.Close()
+
+	// Only serve types which can't run script on our domain
+	contentType := attrs.ContentType
+	if !safeAssetType(contentType) {
+		contentType = "application/octet-stream"
+		w.Header().Add("Content-Disposition", "attachment")
+	}
+	w.Header().Add("Content-Type", contentType)
+	w.Header().Add("X-Content-Type-Options", "nosniff")
+	// Assets are named by their contents, so they never change
+	w.Header().Add("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Add("ETag", attrs.ETag)
+	http.ServeContent(w, req, name, blobReader.ModTime(), blobReader)
+}
+
+func safeAssetType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "audio/"), strings.HasPrefix(mediaType, "video/"):
+		return true
+	default:
+		return mediaType == "application/pdf"
+	}
+}
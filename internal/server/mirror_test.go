@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	_ "embed"
+
+	"github.com/cptaffe/email2rss/internal/backend"
+	"github.com/cptaffe/email2rss/internal/config"
+	"github.com/cptaffe/email2rss/internal/fetch"
+	"github.com/cptaffe/email2rss/internal/generic"
+	"gocloud.dev/blob"
+)
+
+// testImage stands in for every image referenced by the test email
+var testImage = []byte("\x89PNG\r\n\x1a\nnot really an image")
+
+func TestMirrorAssets(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	client := stubClient(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testImage)
+	}))
+	cfg := &config.Config{BaseURL: "https://example.com", Feeds: map[string]config.Feed{"test": {Mirror: true}}}
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(client), WithConfig(cfg))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/email2rss/test/email", strings.NewReader(testEmail))
+	if err != nil {
+		t.Fatalf("construct request: %v", err)
+	}
+	req.SetPathValue("feed", "test")
+	s.AddEmail(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status is %d, expected 201", rec.Code)
+	}
+
+	key := "2024-10-21T12:45:12Z"
+	waitForTask(t, bucket, "test", key, func(task *Task) bool { return task == nil })
+
+	b, err := bucket.ReadAll(ctx, "test/items/"+key+".json")
+	if err != nil {
+		t.Fatalf("read item: %v", err)
+	}
+	var stored generic.Message
+	err = json.Unmarshal(b, &stored)
+	if err != nil {
+		t.Fatalf("parse item: %v", err)
+	}
+	hash := sha256.Sum256(testImage)
+	name := hex.EncodeToString(hash[:]) + ".png"
+	assetURL := "https://example.com/email2rss/test/assets/" + name
+	if strings.Contains(stored.Body, "https://embed.filekitcdn.com/") {
+		t.Error("body still references the remote image")
+	}
+	if !strings.Contains(stored.Body, `src="`+assetURL+`"`) {
+		t.Errorf("body does not reference the mirrored image %s", assetURL)
+	}
+
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodGet, "/email2rss/test/assets/"+name, nil)
+	if err != nil {
+		t.Fatalf("construct request: %v", err)
+	}
+	req.Header.Set("Range", "bytes=0-7")
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status is %d, expected 206", rec.Code)
+	}
+	if body := rec.Body.String(); body != string(testImage[:8]) {
+		t.Errorf("range of asset is %q, expected %q", body, testImage[:8])
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "image/png" {
+		t.Errorf("Content-Type is %s, expected image/png", contentType)
+	}
+}
+
+//go:embed test/related.rfc822
+var testRelatedEmail string
+
+func TestInlineImages(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	cfg := &config.Config{BaseURL: "https://example.com"}
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})), WithConfig(cfg))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/email2rss/test/email", strings.NewReader(testRelatedEmail))
+	if err != nil {
+		t.Fatalf("construct request: %v", err)
+	}
+	req.SetPathValue("feed", "test")
+	s.AddEmail(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status is %d, expected 201", rec.Code)
+	}
+
+	b, err := bucket.ReadAll(ctx, "test/items/2024-11-05T09:30:00Z.json")
+	if err != nil {
+		t.Fatalf("read item: %v", err)
+	}
+	var stored generic.Message
+	err = json.Unmarshal(b, &stored)
+	if err != nil {
+		t.Fatalf("parse item: %v", err)
+	}
+	logo := []byte("\x89PNG\r\n\x1a\ninline logo")
+	hash := sha256.Sum256(logo)
+	name := hex.EncodeToString(hash[:]) + ".png"
+	expected := `<img src="https://example.com/email2rss/test/assets/` + name + `" alt="Logo">`
+	if !strings.Contains(stored.Body, expected) {
+		t.Errorf("body does not reference the stored image:\nhave:    %s\nexpected:%s", stored.Body, expected)
+	}
+
+	asset, err := bucket.ReadAll(ctx, "test/assets/"+name)
+	if err != nil {
+		t.Fatalf("read asset: %v", err)
+	}
+	if string(asset) != string(logo) {
+		t.Errorf("asset is %q, expected %q", asset, logo)
+	}
+	// cid: URLs may be %-encoded
+	hash = sha256.Sum256([]byte("\x89PNG\r\n\x1a\nbanner"))
+	expected = `<img src="https://example.com/email2rss/test/assets/` + hex.EncodeToString(hash[:]) + `.png" alt="Banner">`
+	if !strings.Contains(stored.Body, expected) {
+		t.Errorf("body does not reference the stored banner:\nhave:    %s\nexpected:%s", stored.Body, expected)
+	}
+
+	// Only referenced parts are kept
+	iter := bucket.List(&blob.ListOptions{Prefix: "test/assets/"})
+	count := 0
+	for {
+		_, err := iter.Next(ctx)
+		if err != nil {
+			break
+		}
+		count++
+	}
+	if count != 2 {
+		t.Errorf("found %d assets, expected 2", count)
+	}
+}
+
+//go:embed test/attachments.rfc822
+var testAttachmentsEmail string
+
+func TestAttachments(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	cfg := &config.Config{BaseURL: "https://example.com", Feeds: map[string]config.Feed{
+		"reports": {Attachments: &config.Attachments{Types: []string{"application/pdf"}, MaxSize: 4096}},
+	}}
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})), WithConfig(cfg))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/email2rss/reports/email", strings.NewReader(testAttachmentsEmail))
+	if err != nil {
+		t.Fatalf("construct request: %v", err)
+	}
+	req.SetPathValue("feed", "reports")
+	s.AddEmail(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status is %d, expected 201", rec.Code)
+	}
+
+	b, err := bucket.ReadAll(ctx, "reports/items/2024-11-06T14:00:00Z.json")
+	if err != nil {
+		t.Fatalf("read item: %v", err)
+	}
+	var stored generic.Message
+	err = json.Unmarshal(b, &stored)
+	if err != nil {
+		t.Fatalf("parse item: %v", err)
+	}
+
+	// Only the PDFs are allowed, the program is left out
+	report := []byte("%PDF-1.4\n% quarterly report\n%%EOF\n")
+	hash := sha256.Sum256(report)
+	appendix := []byte("%PDF-1.4\n" + strings.Repeat("0", 2048) + "\n%%EOF\n")
+	appendixHash := sha256.Sum256(appendix)
+	expected := []backend.Enclosure{{
+		URL:    "https://example.com/email2rss/reports/assets/" + hex.EncodeToString(hash[:]) + ".pdf",
+		Length: int64(len(report)),
+		Type:   "application/pdf",
+		Title:  "report.pdf",
+	}, {
+		URL:    "https://example.com/email2rss/reports/assets/" + hex.EncodeToString(appendixHash[:]) + ".pdf",
+		Length: int64(len(appendix)),
+		Type:   "application/pdf",
+		Title:  "appendix.pdf",
+	}}
+	if !reflect.DeepEqual(stored.Attachments, expected) {
+		t.Errorf("attachments do not match expected value:\nhave:    %+v\nexpected:%+v", stored.Attachments, expected)
+	}
+
+	back, err := s.Backend("reports")
+	if err != nil {
+		t.Fatalf("load backend: %v", err)
+	}
+	err = s.refreshFeed(ctx, back)
+	if err != nil {
+		t.Fatalf("refresh feed: %v", err)
+	}
+	feed, err := bucket.ReadAll(ctx, "reports/feed.xml")
+	if err != nil {
+		t.Fatalf("read feed: %v", err)
+	}
+	enclosure := `<enclosure url="` + expected[0].URL + `" length="34" type="application/pdf" />`
+	if !strings.Contains(string(feed), enclosure) {
+		t.Errorf("feed does not contain %s", enclosure)
+	}
+	// The item has one enclosure, and the appendix is linked from its content instead
+	if n := strings.Count(string(feed), "<enclosure "); n != 1 {
+		t.Errorf("feed has %d enclosures, expected 1", n)
+	}
+	link := `<li><a href="` + expected[1].URL + `">appendix.pdf</a></li>`
+	if !strings.Contains(string(feed), link) {
+		t.Errorf("feed does not contain %s", link)
+	}
+}
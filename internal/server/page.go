@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cptaffe/email2rss/internal/backend"
+	"github.com/cptaffe/email2rss/internal/readability"
+	"github.com/cptaffe/email2rss/internal/sanitize"
+	"gocloud.dev/blob"
+)
+
+// parsePages parses the HTML item templates, which html/template escapes for their context
+func parsePages(templatePath string) (*htmltemplate.Template, error) {
+	ht := htmltemplate.New("html").Funcs(htmltemplate.FuncMap{
+		// sanitize marks email HTML as safe to include once it's been through the sanitizer
+		"sanitize": func(s string) htmltemplate.HTML {
+			return htmltemplate.HTML(sanitize.HTML(s))
+		},
+		// body drops the head and style sheets of email HTML, which would restyle the page
+		"body": readability.Body,
+		"text": readability.Text,
+		"rfc3339": func(t time.Time) string {
+			return t.Format(time.RFC3339)
+		},
+		"date": func(t time.Time) string {
+			return t.Format("January 2, 2006")
+		},
+		"timecode": func(seconds float64) string {
+			d := time.Duration(seconds) * time.Second
+			return fmt.Sprintf("%d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+		},
+	})
+	_, err := ht.ParseGlob(path.Join(templatePath, "*.html.tmpl"))
+	if err != nil {
+		return nil, fmt.Errorf("parse HTML templates at `%s`: %w", templatePath, err)
+	}
+	return ht, nil
+}
+
+// ItemPage is passed to a backend's HTML item template
+type ItemPage struct {
+	Backend backend.Backend
+	Item    backend.Item
+	// URL is the page's own address, and FeedURL the feed it belongs to
+	URL     string
+	FeedURL string
+	// Prev and Next are the items published before and after this one, if any
+	Prev, Next backend.Item
+
+	baseURL string
+}
+
+// ItemURL is the address of another item's page in the same feed
+func (p *ItemPage) ItemURL(item backend.Item) string {
+	return fmt.Sprintf("%s/email2rss/%s/items/%s", p.baseURL, p.Backend.Name(), item.Key())
+}
+
+// itemPage gathers what an item's page shows besides the item itself
+func (s *Server) itemPage(ctx context.Context, back backend.Backend, item backend.Item) (*ItemPage, error) {
+	baseURL := strings.TrimRight(s.config.BaseURL, "/")
+	page := &ItemPage{
+		Backend: back,
+		Item:    item,
+		FeedURL: fmt.Sprintf("%s/email2rss/%s", baseURL, back.Name()),
+		baseURL: baseURL,
+	}
+	page.URL = page.ItemURL(item)
+
+	prev, next, err := s.neighbours(ctx, back.Name(), item.Key())
+	if err != nil {
+		return nil, err
+	}
+	if prev != "" {
+		page.Prev, err = s.readItem(ctx, back, prev)
+		if err != nil {
+			return nil, err
+		}
+		s.redact(back.Name(), nil, page.Prev)
+	}
+	if next != "" {
+		page.Next, err = s.readItem(ctx, back, next)
+		if err != nil {
+			return nil, err
+		}
+		s.redact(back.Name(), nil, page.Next)
+	}
+	return page, nil
+}
+
+// compareKeys orders item keys by when their items were sent. Keys are dates in the sender's
+// time zone, so they are compared as times rather than in the order they're listed.
+func compareKeys(a, b string) int {
+	ta, _ := time.Parse(time.RFC3339, a)
+	tb, _ := time.Parse(time.RFC3339, b)
+	return ta.Compare(tb)
+}
+
+// neighbours finds the keys of the items before and after key, in the order they were published
+func (s *Server) neighbours(ctx context.Context, feed, key string) (prev, next string, err error) {
+	prefix := fmt.Sprintf("%s/items/", feed)
+	iter := s.bucket.List(&blob.ListOptions{Prefix: prefix})
+	var keys []string
+	for {
+		obj, err := iter.Next(ctx)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", "", fmt.Errorf("list items: %w", err)
+		}
+		keys = append(keys, strings.TrimSuffix(strings.TrimPrefix(obj.Key, prefix), ".json"))
+	}
+	slices.SortStableFunc(keys, compareKeys)
+	i := slices.Index(keys, key)
+	if i < 0 {
+		return "", "", nil
+	}
+	if i > 0 {
+		prev = keys[i-1]
+	}
+	if i < len(keys)-1 {
+		next = keys[i+1]
+	}
+	return prev, next, nil
+}
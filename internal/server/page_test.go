@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cptaffe/email2rss/internal/fetch"
+	"github.com/cptaffe/email2rss/internal/generic"
+	"github.com/cptaffe/email2rss/internal/journalclub"
+	"gocloud.dev/blob"
+)
+
+func TestItemPage(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	var items []*generic.Message
+	for i := range 3 {
+		item := &generic.Message{
+			UUID:    fmt.Sprintf("item-%d", i),
+			Subject: fmt.Sprintf("Issue <%d>", i),
+			Date:    time.Date(2024, 11, 1+i, 8, 0, 0, 0, time.UTC),
+			Body:    fmt.Sprintf(`<html><head><style>body { background: red; }</style></head><body><p>Body of issue %d</p></body></html>`, i),
+		}
+		err = s.writeItem(ctx, "digest", item)
+		if err != nil {
+			t.Fatalf("write item: %v", err)
+		}
+		items = append(items, item)
+	}
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/email2rss/digest/items/"+items[1].Key(), "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status is %d, expected 200", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, expected := range []string{
+		"<title>Issue &lt;1&gt; · digest</title>",
+		`<meta property="og:title" content="Issue &lt;1&gt;">`,
+		`<meta property="og:description" content="Body of issue 1">`,
+		`<meta property="og:url" content="https://connor.zip/email2rss/digest/items/2024-11-02T08:00:00Z">`,
+		"<p>Body of issue 1</p>",
+		`<a href="https://connor.zip/email2rss/digest/items/2024-11-01T08:00:00Z" rel="prev">← Issue &lt;0&gt;</a>`,
+		`<a href="https://connor.zip/email2rss/digest/items/2024-11-03T08:00:00Z" rel="next">Issue &lt;2&gt; →</a>`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("page is missing %s:\n%s", expected, body)
+		}
+	}
+	// The email's document is embedded without the head and style sheets which would restyle the page
+	if strings.Contains(body, "background: red") || strings.Count(body, "<body") != 1 {
+		t.Errorf("page embeds the email's document whole:\n%s", body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/html;charset=UTF-8" {
+		t.Errorf("Content-Type is %s", ct)
+	}
+
+	// The oldest and newest items only link one way
+	body = get("/email2rss/digest/items/"+items[0].Key(), "").Body.String()
+	if strings.Contains(body, `rel="prev"`) || !strings.Contains(body, `rel="next"`) {
+		t.Errorf("oldest item's navigation is wrong:\n%s", body)
+	}
+	body = get("/email2rss/digest/items/"+items[2].Key(), "").Body.String()
+	if !strings.Contains(body, `rel="prev"`) || strings.Contains(body, `rel="next"`) {
+		t.Errorf("newest item's navigation is wrong:\n%s", body)
+	}
+
+	// Items are ordered by when they were sent, whatever time zone their keys are in
+	late := &generic.Message{
+		Subject: "Issue <late>",
+		Date:    time.Date(2024, 11, 2, 6, 0, 0, 0, time.FixedZone("EST", -5*60*60)),
+		Body:    "<p>Body of the late issue</p>",
+	}
+	err = s.writeItem(ctx, "digest", late)
+	if err != nil {
+		t.Fatalf("write item: %v", err)
+	}
+	body = get("/email2rss/digest/items/"+items[1].Key(), "").Body.String()
+	for _, expected := range []string{
+		`<a href="https://connor.zip/email2rss/digest/items/2024-11-01T08:00:00Z" rel="prev">← Issue &lt;0&gt;</a>`,
+		`<a href="https://connor.zip/email2rss/digest/items/2024-11-02T06:00:00-05:00" rel="next">Issue &lt;late&gt; →</a>`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("page is missing %s:\n%s", expected, body)
+		}
+	}
+
+	rec = get("/email2rss/digest/items/"+items[1].Key(), "application/json")
+	var decoded generic.Message
+	err = json.NewDecoder(rec.Body).Decode(&decoded)
+	if err != nil || decoded.UUID != items[1].UUID {
+		t.Errorf("JSON item is %+v, %v", decoded, err)
+	}
+
+	if rec := get("/email2rss/digest/items/2020-01-01T00:00:00Z", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("missing item gave %d, expected 404", rec.Code)
+	}
+}
+
+func TestJournalClubItemPage(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	item := &journalclub.Message{
+		UUID:        "episode",
+		Subject:     "Dams & deep learning",
+		Description: `Today's article comes from the <i>PeerJ</i> journal.<script>alert(1)</script>`,
+		Date:        time.Date(2024, 11, 3, 13, 55, 35, 0, time.UTC),
+		ImageURL:    "https://embed.filekitcdn.com/e/image",
+		AudioURL:    "https://example.com/episode.mp3",
+		PaperURL:    "javascript:alert(1)",
+		PaperTitle:  "Employing deep learning",
+	}
+	err = s.writeItem(ctx, "journalclub", item)
+	if err != nil {
+		t.Fatalf("write item: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/email2rss/journalclub/items/"+item.Key(), nil)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status is %d, expected 200: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	for _, expected := range []string{
+		"<h1>Dams &amp; deep learning</h1>",
+		`<meta property="og:image" content="https://embed.filekitcdn.com/e/image">`,
+		`<meta property="og:audio" content="https://example.com/episode.mp3">`,
+		`<meta property="og:description" content="Today&#39;s article comes from the PeerJ journal.">`,
+		`<audio controls preload="none" src="https://example.com/episode.mp3"></audio>`,
+		"<p>Today&#39;s article comes from the <i>PeerJ</i> journal.</p>",
+		"<i>Employing deep learning</i>",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("page is missing %s:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, "alert") {
+		t.Errorf("page contains script:\n%s", body)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/cptaffe/email2rss/internal/backend"
+	"github.com/cptaffe/email2rss/internal/privacy"
+)
+
+// filterTracking removes tracking pixels from an item and unwraps the tracked links whose destinations it embeds
+func filterTracking(item backend.Item) {
+	filterable, ok := item.(backend.Filterable)
+	if !ok {
+		return
+	}
+	filterable.Filter(func(s string) string { return privacy.HTML(s, privacy.URL) }, privacy.URL)
+}
+
+// trackedLinks lists an item's links which can only be unwrapped by following their redirect
+func trackedLinks(item backend.Item) []string {
+	filterable, ok := item.(backend.Filterable)
+	if !ok {
+		return nil
+	}
+	var links []string
+	record := func(u string) string {
+		if privacy.Tracked(u) {
+			links = append(links, u)
+		}
+		return u
+	}
+	filterable.Filter(func(s string) string { return privacy.HTML(s, record) }, record)
+	return links
+}
+
+// resolveTracking follows the redirects of an item's remaining tracked links, replacing them with their destinations.
+// Links which don't redirect are left as they are, while network failures are retried.
+func (s *Server) resolveTracking(ctx context.Context, item backend.Item) error {
+	links := trackedLinks(item)
+	if len(links) == 0 {
+		return nil
+	}
+	resolver := &privacy.Resolver{Client: s.client}
+	replacements := map[string]string{}
+	for _, u := range links {
+		if _, ok := replacements[u]; ok {
+			continue
+		}
+		target, err := resolver.Resolve(ctx, u)
+		if errors.Is(err, privacy.ErrUnresolvable) {
+			log.Printf("resolve tracked link: %v", err)
+			target = u
+		} else if err != nil {
+			return fmt.Errorf("resolve %s: %w", u, err)
+		}
+		replacements[u] = target
+	}
+	replace := func(u string) string {
+		if target, ok := replacements[u]; ok {
+			return target
+		}
+		return u
+	}
+	item.(backend.Filterable).Filter(func(s string) string { return privacy.HTML(s, replace) }, replace)
+	return nil
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	_ "embed"
+
+	"github.com/cptaffe/email2rss/internal/config"
+	"github.com/cptaffe/email2rss/internal/generic"
+	"gocloud.dev/blob"
+)
+
+//go:embed test/mailchimp.rfc822
+var testMailchimpEmail string
+
+func TestTrackingRemoval(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	// Mailchimp's click tracker only reveals the destination by redirecting
+	client := stubClient(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/track/click" || req.URL.Query().Get("id") != "def" {
+			t.Errorf("unexpected request for %s", req.URL)
+			http.NotFound(w, req)
+			return
+		}
+		http.Redirect(w, req, "https://example.com/article?utm_source=mailchimp", http.StatusFound)
+	}))
+	cfg := &config.Config{Feeds: map[string]config.Feed{"digest": {ResolveLinks: true}}}
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(client), WithConfig(cfg))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/email2rss/digest/email", strings.NewReader(testMailchimpEmail))
+	if err != nil {
+		t.Fatalf("construct request: %v", err)
+	}
+	req.SetPathValue("feed", "digest")
+	s.AddEmail(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status is %d, expected 201", rec.Code)
+	}
+
+	key := "2024-11-07T16:00:00Z"
+	waitForTask(t, bucket, "digest", key, func(task *Task) bool { return task == nil })
+
+	b, err := bucket.ReadAll(ctx, "digest/items/"+key+".json")
+	if err != nil {
+		t.Fatalf("read item: %v", err)
+	}
+	var stored generic.Message
+	err = json.Unmarshal(b, &stored)
+	if err != nil {
+		t.Fatalf("parse item: %v", err)
+	}
+	if strings.Contains(stored.Body, "list-manage.com") || strings.Contains(stored.Body, "utm_") {
+		t.Errorf("body still contains tracking: %s", stored.Body)
+	}
+	for _, link := range []string{`href="https://example.com/article"`, `href="https://example.com/archive"`} {
+		if !strings.Contains(stored.Body, link) {
+			t.Errorf("body does not contain %s: %s", link, stored.Body)
+		}
+	}
+}
+
+func TestTrackingUnresolved(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	// Following a tracked link registers a click, so feeds don't unless they ask to
+	client := stubClient(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected request for %s", req.URL)
+		http.NotFound(w, req)
+	}))
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(client))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/email2rss/digest/email", strings.NewReader(testMailchimpEmail))
+	if err != nil {
+		t.Fatalf("construct request: %v", err)
+	}
+	req.SetPathValue("feed", "digest")
+	s.AddEmail(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status is %d, expected 201", rec.Code)
+	}
+
+	key := "2024-11-07T16:00:00Z"
+	exists, err := bucket.Exists(ctx, taskKey("digest", key))
+	if err != nil || exists {
+		t.Errorf("item was queued to resolve its links: %v", err)
+	}
+	b, err := bucket.ReadAll(ctx, "digest/items/"+key+".json")
+	if err != nil {
+		t.Fatalf("read item: %v", err)
+	}
+	var stored generic.Message
+	err = json.Unmarshal(b, &stored)
+	if err != nil {
+		t.Fatalf("parse item: %v", err)
+	}
+	// Links are still cleaned offline, while the tracked link is left for the reader to follow
+	for _, link := range []string{`href="https://example.us1.list-manage.com/track/click?`, `href="https://example.com/archive"`} {
+		if !strings.Contains(stored.Body, link) {
+			t.Errorf("body does not contain %s: %s", link, stored.Body)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/cptaffe/email2rss/internal/config"
+)
+
+// tokenKey is the context key of the capability token a private feed was accessed with
+type tokenKey struct{}
+
+// authorized reports whether a request may read a feed, along with the capability
+// token it presented, which is empty for public feeds and requests using HTTP Basic auth
+func (s *Server) authorized(req *http.Request, feed string) (string, bool) {
+	access := s.config.Feed(feed).Private
+	if access == nil {
+		return "", true
+	}
+	return allowed(req, access)
+}
+
+// allowed reports whether a request presents a token or credentials from access,
+// along with the token, which is empty for requests using HTTP Basic auth
+func allowed(req *http.Request, access *config.Access) (string, bool) {
+	if token := req.URL.Query().Get("token"); token != "" {
+		for _, t := range access.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				return token, true
+			}
+		}
+	}
+	if user, password, ok := req.BasicAuth(); ok {
+		expected, ok := access.Users[user]
+		if ok && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 {
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// private guards a handler of a feed's content, so that private feeds are only served
+// to requests with a capability token or credentials
+func (s *Server) private(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		feed := req.PathValue("feed")
+		token, ok := s.authorized(req, feed)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="email2rss", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if token != "" {
+			req = req.WithContext(context.WithValue(req.Context(), tokenKey{}, token))
+		}
+		h(w, req)
+	}
+}
+
+// relay finds the relay a request authenticated as, whose Authentication-Results headers are then believed
+func (s *Server) relay(req *http.Request) string {
+	for name, access := range s.config.RelayAccess {
+		if _, ok := allowed(req, access); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// admin guards a handler which manages the instance, so that it's only served to requests with
+// the admin token or credentials, and to no one without them configured
+func (s *Server) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.config.Admin == nil {
+			http.Error(w, "Administration is disabled, as no admin credentials are configured", http.StatusForbidden)
+			return
+		}
+		if _, ok := allowed(req, s.config.Admin); !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="email2rss", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// capabilityURLs adds the capability token a private feed was accessed with to the links
+// a document makes to the feed's own pages and assets, so that readers given the
+// capability URL rather than credentials can follow them
+func (s *Server) capabilityURLs(ctx context.Context, feed string, b []byte) []byte {
+	token, ok := ctx.Value(tokenKey{}).(string)
+	if !ok {
+		return b
+	}
+	prefix := regexp.QuoteMeta(fmt.Sprintf("%s/email2rss/%s", strings.TrimRight(s.config.BaseURL, "/"), feed))
+	// Links end at the quote or angle bracket around them, and those already with a query are left alone
+	linkRegexp := regexp.MustCompile(`(?:` + prefix + `(?:/[^"'<>\s?#]*)?|` + regexp.QuoteMeta(s.selfURL(feed)) + `)["'<\s]`)
+	query := []byte("?token=" + url.QueryEscape(token))
+	return linkRegexp.ReplaceAllFunc(b, func(link []byte) []byte {
+		end := len(link) - 1
+		return bytes.Join([][]byte{link[:end], query, link[end:]}, nil)
+	})
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cptaffe/email2rss/internal/config"
+	"github.com/cptaffe/email2rss/internal/fetch"
+	"github.com/cptaffe/email2rss/internal/generic"
+	"gocloud.dev/blob"
+)
+
+func TestPrivateFeed(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	const token = "4f3c2a1b0e9d8c7b"
+	// A host other than the default, so that the links templates make are checked to use it
+	cfg := &config.Config{BaseURL: "https://feeds.example.com"}
+	cfg.Feeds = map[string]config.Feed{"premium": {Private: &config.Access{Tokens: []string{token}, Users: map[string]string{"reader": "hunter2"}}}}
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})), WithConfig(cfg))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	item := &generic.Message{UUID: "a", Subject: "Issue", Date: time.Date(2024, 11, 1, 8, 0, 0, 0, time.UTC), Body: "<p>Body</p>"}
+	for _, feed := range []string{"premium", "free"} {
+		err = s.writeItem(ctx, feed, item)
+		if err != nil {
+			t.Fatalf("write item: %v", err)
+		}
+		back, err := s.Backend(feed)
+		if err != nil {
+			t.Fatalf("load backend: %v", err)
+		}
+		err = s.refreshFeed(ctx, back)
+		if err != nil {
+			t.Fatalf("refresh feed: %v", err)
+		}
+	}
+
+	get := func(target string, auth func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if auth != nil {
+			auth(req)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+	basic := func(user, password string) func(*http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth(user, password) }
+	}
+	itemPath := "/email2rss/premium/items/" + item.Key()
+	tests := []struct {
+		target string
+		auth   func(*http.Request)
+		code   int
+	}{
+		{"/email2rss/premium", nil, http.StatusUnauthorized},
+		{"/email2rss/premium?token=guess", nil, http.StatusUnauthorized},
+		{"/email2rss/premium", basic("reader", "guess"), http.StatusUnauthorized},
+		{"/email2rss/premium/", nil, http.StatusUnauthorized},
+		{itemPath, nil, http.StatusUnauthorized},
+		{itemPath + "/chapters.json", nil, http.StatusUnauthorized},
+		{"/email2rss/premium/assets/" + strings.Repeat("0", 64), nil, http.StatusUnauthorized},
+		{"/email2rss/premium", basic("reader", "hunter2"), http.StatusOK},
+		{"/email2rss/premium?token=" + token, nil, http.StatusOK},
+		{"/email2rss/premium/?token=" + token, nil, http.StatusOK},
+		{itemPath + "?token=" + token, nil, http.StatusOK},
+		{"/email2rss/free", nil, http.StatusOK},
+	}
+	for _, test := range tests {
+		rec := get(test.target, test.auth)
+		if rec.Code != test.code {
+			t.Errorf("GET %s gave %d, expected %d", test.target, rec.Code, test.code)
+		}
+		if rec.Code == http.StatusUnauthorized && !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Basic ") {
+			t.Errorf("GET %s didn't ask for credentials", test.target)
+		}
+	}
+
+	// Links to the feed's own pages carry the token they were accessed with
+	body := get("/email2rss/premium?token="+token, nil).Body.String()
+	for _, link := range []string{
+		`<atom:link href="https://feeds.example.com/email2rss/premium?token=` + token + `" rel="self"`,
+		`<link>https://feeds.example.com` + itemPath + `?token=` + token + `</link>`,
+	} {
+		if !strings.Contains(body, link) {
+			t.Errorf("feed doesn't contain %s:\n%s", link, body)
+		}
+	}
+	if strings.Contains(body, `rel="hub"`) {
+		t.Errorf("private feed advertises a hub")
+	}
+	body = get("/email2rss/premium/?token="+token, nil).Body.String()
+	if !strings.Contains(body, `href="https://feeds.example.com`+itemPath+`?token=`+token+`"`) {
+		t.Errorf("archive doesn't link to items with the token:\n%s", body)
+	}
+	body = get("/email2rss/premium", basic("reader", "hunter2")).Body.String()
+	if strings.Contains(body, "token=") {
+		t.Errorf("feed accessed with credentials contains a token")
+	}
+
+	// Private feeds aren't listed or distributed by the hub
+	var feeds []FeedInfo
+	err = json.NewDecoder(get("/email2rss/feeds.json", nil).Body).Decode(&feeds)
+	if err != nil {
+		t.Fatalf("parse feeds: %v", err)
+	}
+	if len(feeds) != 1 || feeds[0].Name != "free" {
+		t.Errorf("listed feeds %+v", feeds)
+	}
+	if opml := get("/email2rss/feeds.opml", nil).Body.String(); strings.Contains(opml, "premium") {
+		t.Errorf("OPML lists the private feed")
+	}
+	form := url.Values{"hub.mode": {"subscribe"}, "hub.topic": {"https://feeds.example.com/email2rss/premium"}, "hub.callback": {"https://example.com/callback"}}
+	req := httptest.NewRequest(http.MethodPost, "/email2rss/hub", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("subscribing to a private feed gave %d", rec.Code)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	// A server left with the default configuration can't be managed at all
+	defaults, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	for _, target := range []string{"/email2rss/journalclub/quarantine", "/email2rss/metrics"} {
+		rec := httptest.NewRecorder()
+		defaults.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("GET %s with the default configuration gave %d, expected 403", target, rec.Code)
+		}
+	}
+
+	const token, adminToken = "4f3c2a1b0e9d8c7b", "9e8d7c6b5a4f3e2d"
+	cfg := config.Default()
+	cfg.Feeds = map[string]config.Feed{"premium": {Private: &config.Access{Tokens: []string{token}}}}
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})), WithConfig(cfg))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	item := &generic.Message{UUID: "a", Subject: "Issue", Date: time.Date(2024, 11, 1, 8, 0, 0, 0, time.UTC), Body: "<p>Body</p>"}
+	for _, feed := range []string{"premium", "free"} {
+		err = s.writeItem(ctx, feed, item)
+		if err != nil {
+			t.Fatalf("write item: %v", err)
+		}
+	}
+	get := func(target string, auth func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if auth != nil {
+			auth(req)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+	basic := func(user, password string) func(*http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth(user, password) }
+	}
+	tests := []struct {
+		target string
+		auth   func(*http.Request)
+		code   int
+	}{
+		{"/email2rss/premium/quarantine", nil, http.StatusForbidden},
+		{"/email2rss/premium/quarantine/" + item.Key(), nil, http.StatusForbidden},
+		{"/email2rss/premium/deliveries", nil, http.StatusForbidden},
+		{"/email2rss/premium/history", nil, http.StatusForbidden},
+		{"/email2rss/premium/confirmations", nil, http.StatusForbidden},
+		{"/email2rss/premium/subscriptions", nil, http.StatusForbidden},
+		// Neither a feed's readers nor anyone at all for public feeds manage it in place of admins
+		{"/email2rss/premium/quarantine?token=" + token, nil, http.StatusForbidden},
+		{"/email2rss/free/quarantine", nil, http.StatusForbidden},
+		{"/email2rss/free/confirmations", nil, http.StatusForbidden},
+		{"/email2rss/free/subscriptions", nil, http.StatusForbidden},
+		{"/email2rss/metrics", nil, http.StatusForbidden},
+		{"/email2rss/free/items/" + item.Key(), nil, http.StatusOK},
+	}
+	for _, test := range tests {
+		if rec := get(test.target, test.auth); rec.Code != test.code {
+			t.Errorf("GET %s without admin gave %d, expected %d", test.target, rec.Code, test.code)
+		}
+	}
+
+	s.config.Admin = &config.Access{Tokens: []string{adminToken}, Users: map[string]string{"admin": "hunter2"}}
+	tests = []struct {
+		target string
+		auth   func(*http.Request)
+		code   int
+	}{
+		{"/email2rss/free/quarantine", nil, http.StatusUnauthorized},
+		{"/email2rss/premium/quarantine?token=" + token, nil, http.StatusUnauthorized},
+		{"/email2rss/free/quarantine", basic("admin", "guess"), http.StatusUnauthorized},
+		{"/email2rss/metrics", nil, http.StatusUnauthorized},
+		{"/email2rss/free/confirmations", nil, http.StatusUnauthorized},
+		{"/email2rss/free/subscriptions", nil, http.StatusUnauthorized},
+		{"/email2rss/free/quarantine", basic("admin", "hunter2"), http.StatusOK},
+		{"/email2rss/premium/quarantine?token=" + adminToken, nil, http.StatusOK},
+		{"/email2rss/free/deliveries?token=" + adminToken, nil, http.StatusOK},
+		{"/email2rss/free/history?token=" + adminToken, nil, http.StatusOK},
+		// Feeds' content isn't affected
+		{"/email2rss/free/items/" + item.Key(), nil, http.StatusOK},
+	}
+	for _, test := range tests {
+		rec := get(test.target, test.auth)
+		if rec.Code != test.code {
+			t.Errorf("GET %s with admin gave %d, expected %d", test.target, rec.Code, test.code)
+		}
+		if rec.Code == http.StatusUnauthorized && !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Basic ") {
+			t.Errorf("GET %s didn't ask for credentials", test.target)
+		}
+	}
+	metrics := get("/email2rss/metrics?token="+adminToken, nil).Body.String()
+	if !strings.Contains(metrics, `feed="premium"`) || !strings.Contains(metrics, `feed="free"`) {
+		t.Errorf("metrics for admins are\n%s", metrics)
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cptaffe/email2rss/internal/validate"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// versionLayout names the versions of a feed under {feed}/history/ by when they were
+// published, with a fixed width so that they sort in order
+const versionLayout = "20060102T150405.000000000Z"
+
+// ErrNoVersion is returned when rolling back to a version which isn't in the feed's history
+var ErrNoVersion = errors.New("no such version of the feed")
+
+// Version is a previously published feed, kept so that it can be restored
+type Version struct {
+	Version   string    `json:"version"`
+	Published time.Time `json:"published"`
+	Size      int64     `json:"size"`
+}
+
+func feedKey(feed string) string {
+	return fmt.Sprintf("%s/feed.xml", feed)
+}
+
+func historyKey(feed, version string) string {
+	return fmt.Sprintf("%s/history/%s.xml", feed, version)
+}
+
+// publish replaces a feed once its new contents are completely stored and valid,
+// keeping the previous version in the feed's history
+func (s *Server) publish(ctx context.Context, feed string, b []byte) error {
+	// Abort the write rather than storing a truncated feed if it fails partway through
+	stageCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var nonce [8]byte
+	rand.Read(nonce[:])
+	stagingKey := fmt.Sprintf("%s/staging/feed-%x.xml", feed, nonce)
+	w, err := s.bucket.NewWriter(stageCtx, stagingKey, nil)
+	if err != nil {
+		return fmt.Errorf("new object writer: %w", err)
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		cancel()
+		w.Close()
+		return fmt.Errorf("write staged feed file: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("close staged feed file: %w", err)
+	}
+	defer func() {
+		err := s.bucket.Delete(ctx, stagingKey)
+		if err != nil {
+			log.Printf("delete staged feed file: %v", err)
+		}
+	}()
+
+	// Validate what was stored, rather than what was meant to be
+	staged, err := s.bucket.ReadAll(ctx, stagingKey)
+	if err != nil {
+		return fmt.Errorf("read staged feed file: %w", err)
+	}
+	err = validate.Feed(staged)
+	if err != nil {
+		return fmt.Errorf("validate feed: %w", err)
+	}
+
+	return swapFeed(ctx, s.bucket, feed, stagingKey, s.config.Feed(feed).HistoryLength())
+}
+
+// swapFeed archives a feed's current version and replaces it with the object at key
+func swapFeed(ctx context.Context, bucket *blob.Bucket, feed, key string, keep int) error {
+	attrs, err := bucket.Attributes(ctx, feedKey(feed))
+	switch {
+	case gcerrors.Code(err) == gcerrors.NotFound:
+		// The feed is being published for the first time
+	case err != nil:
+		return fmt.Errorf("fetch feed attributes: %w", err)
+	default:
+		err = bucket.Copy(ctx, historyKey(feed, attrs.ModTime.UTC().Format(versionLayout)), feedKey(feed), nil)
+		if err != nil {
+			return fmt.Errorf("copy feed file to history: %w", err)
+		}
+	}
+
+	err = bucket.Copy(ctx, feedKey(feed), key, nil)
+	if err != nil {
+		return fmt.Errorf("copy feed file: %w", err)
+	}
+	return pruneHistory(ctx, bucket, feed, keep)
+}
+
+// pruneHistory deletes all but the newest keep versions of a feed
+func pruneHistory(ctx context.Context, bucket *blob.Bucket, feed string, keep int) error {
+	versions, err := History(ctx, bucket, feed)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions[min(keep, len(versions)):] {
+		err = bucket.Delete(ctx, historyKey(feed, version.Version))
+		if err != nil {
+			return fmt.Errorf("delete old feed version: %w", err)
+		}
+	}
+	return nil
+}
+
+// History lists the previous versions of a feed, newest first
+func History(ctx context.Context, bucket *blob.Bucket, feed string) ([]Version, error) {
+	var versions []Version
+	prefix := fmt.Sprintf("%s/history/", feed)
+	iter := bucket.List(&blob.ListOptions{Prefix: prefix})
+	for {
+		obj, err := iter.Next(ctx)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("list feed history: %w", err)
+		}
+		version := strings.TrimSuffix(strings.TrimPrefix(obj.Key, prefix), ".xml")
+		published, err := time.Parse(versionLayout, version)
+		if err != nil {
+			// Not a version written by publish
+			continue
+		}
+		versions = append(versions, Version{Version: version, Published: published, Size: obj.Size})
+	}
+	slices.SortFunc(versions, func(a, b Version) int {
+		return strings.Compare(b.Version, a.Version)
+	})
+	return versions, nil
+}
+
+// Rollback restores a previous version of a feed, the most recent one if version is empty,
+// returning the version restored. The version being replaced is kept in the history,
+// so a rollback can itself be undone, until the next refresh publishes the feed again.
+func Rollback(ctx context.Context, bucket *blob.Bucket, feed, version string, keep int) (string, error) {
+	if version == "" {
+		versions, err := History(ctx, bucket, feed)
+		if err != nil {
+			return "", err
+		}
+		if len(versions) == 0 {
+			return "", ErrNoVersion
+		}
+		version = versions[0].Version
+	}
+	_, err := time.Parse(versionLayout, version)
+	if err != nil {
+		return "", ErrNoVersion
+	}
+	key := historyKey(feed, version)
+	exists, err := bucket.Exists(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("check if version exists: %w", err)
+	}
+	if !exists {
+		return "", ErrNoVersion
+	}
+	return version, swapFeed(ctx, bucket, feed, key, keep)
+}
+
+// GetHistory lists the versions of a feed which can be restored
+func (s *Server) GetHistory(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	versions, err := History(ctx, s.bucket, req.PathValue("feed"))
+	if err != nil {
+		http.Error(w, "Could not list feed history", http.StatusInternalServerError)
+		log.Printf("list feed history: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	err = json.NewEncoder(w).Encode(versions)
+	if err != nil {
+		log.Printf("write feed history: %v", err)
+	}
+}
+
+// Rollback restores the version of a feed given by the version query parameter, or the most recent one
+func (s *Server) Rollback(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	feed := req.PathValue("feed")
+	version, err := Rollback(ctx, s.bucket, feed, req.URL.Query().Get("version"), s.config.Feed(feed).HistoryLength())
+	if errors.Is(err, ErrNoVersion) {
+		http.Error(w, "No such version of the feed", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not roll back feed", http.StatusInternalServerError)
+		log.Printf("roll back feed %s: %v", feed, err)
+		return
+	}
+	log.Printf("rolled back feed %s to version %s", feed, version)
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	err = json.NewEncoder(w).Encode(map[string]string{"version": version})
+	if err != nil {
+		log.Printf("write rollback response: %v", err)
+	}
+}
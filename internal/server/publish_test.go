@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cptaffe/email2rss/internal/config"
+	"github.com/cptaffe/email2rss/internal/fetch"
+	"gocloud.dev/blob"
+)
+
+func testFeed(title string) []byte {
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0"><channel><title>%s</title><link>https://connor.zip</link><description>Test</description></channel></rss>`, title))
+}
+
+func TestPublish(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	cfg := config.Default()
+	cfg.Admin = testAdmin
+	cfg.Feeds = map[string]config.Feed{"test": {History: 2}}
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})), WithConfig(cfg))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+
+	for _, title := range []string{"one", "two", "three", "four"} {
+		err = s.publish(ctx, "test", testFeed(title))
+		if err != nil {
+			t.Fatalf("publish feed %s: %v", title, err)
+		}
+	}
+	// Truncated feeds are never published
+	err = s.publish(ctx, "test", testFeed("five")[:100])
+	if err == nil {
+		t.Errorf("published a truncated feed")
+	}
+
+	b, err := bucket.ReadAll(ctx, "test/feed.xml")
+	if err != nil {
+		t.Fatalf("read feed: %v", err)
+	}
+	if string(b) != string(testFeed("four")) {
+		t.Errorf("feed is\n%s\nexpected the last valid version", b)
+	}
+	versions, err := History(ctx, bucket, "test")
+	if err != nil {
+		t.Fatalf("list history: %v", err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("history has %d versions, expected 2", len(versions))
+	}
+	for i, title := range []string{"three", "two"} {
+		b, err := bucket.ReadAll(ctx, historyKey("test", versions[i].Version))
+		if err != nil {
+			t.Fatalf("read version: %v", err)
+		}
+		if !strings.Contains(string(b), "<title>"+title+"</title>") {
+			t.Errorf("version %d is\n%s\nexpected %s", i, b, title)
+		}
+	}
+	iter := bucket.List(&blob.ListOptions{Prefix: "test/staging/"})
+	if obj, err := iter.Next(ctx); err == nil {
+		t.Errorf("staged feed %s was left behind", obj.Key)
+	}
+
+	// Roll back to the oldest version over HTTP
+	req := asAdmin(httptest.NewRequest(http.MethodPost, "/email2rss/test/rollback?version="+versions[1].Version, nil))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("rollback gave %d: %s", w.Code, w.Body)
+	}
+	b, err = bucket.ReadAll(ctx, "test/feed.xml")
+	if err != nil {
+		t.Fatalf("read feed: %v", err)
+	}
+	if string(b) != string(testFeed("two")) {
+		t.Errorf("feed is\n%s\nexpected the restored version", b)
+	}
+
+	// The replaced version can be restored in turn
+	req = asAdmin(httptest.NewRequest(http.MethodGet, "/email2rss/test/history", nil))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	versions = nil
+	err = json.NewDecoder(w.Body).Decode(&versions)
+	if err != nil {
+		t.Fatalf("parse history: %v", err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("history has %d versions, expected 2", len(versions))
+	}
+	_, err = Rollback(ctx, bucket, "test", "", cfg.Feed("test").HistoryLength())
+	if err != nil {
+		t.Fatalf("roll back: %v", err)
+	}
+	b, err = bucket.ReadAll(ctx, "test/feed.xml")
+	if err != nil {
+		t.Fatalf("read feed: %v", err)
+	}
+	if string(b) != string(testFeed("four")) {
+		t.Errorf("feed is\n%s\nexpected the version replaced by the rollback", b)
+	}
+
+	_, err = Rollback(ctx, bucket, "test", "20240101T000000.000000000Z", 2)
+	if !errors.Is(err, ErrNoVersion) {
+		t.Errorf("rolling back to a missing version gave %v, expected ErrNoVersion", err)
+	}
+	req = asAdmin(httptest.NewRequest(http.MethodPost, "/email2rss/test/rollback?version=../feed", nil))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("rollback to an invalid version gave %d, expected 404", w.Code)
+	}
+}
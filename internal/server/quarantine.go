@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cptaffe/email2rss/internal/backend"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// Quarantined is an email held back from a feed, stored under {feed}/quarantine/ alongside the message
+type Quarantined struct {
+	ID       string    `json:"id"`
+	Feed     string    `json:"feed"`
+	Received time.Time `json:"received"`
+	// Reason is why the email was held back
+	Reason string `json:"reason"`
+	// Backend and Version identify the code which last failed to add the email,
+	// so that it can be retried once a fixed version is deployed
+	Backend string `json:"backend,omitempty"`
+	Version string `json:"version,omitempty"`
+	// Attempts counts how many times the email has been tried, including when it was received
+	Attempts int        `json:"attempts"`
+	Retried  *time.Time `json:"retried,omitempty"`
+}
+
+// retryKey is the context key of the quarantined email being retried
+type retryKey struct{}
+
+func quarantineKey(feed, id, ext string) string {
+	return fmt.Sprintf("%s/quarantine/%s.%s", feed, id, ext)
+}
+
+// buildVersion identifies the build of the server and so of its backends, from its VCS revision
+var buildVersion = sync.OnceValue(func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if revision == "" {
+		return info.Main.Version
+	}
+	if modified == "true" {
+		revision += "+dirty"
+	}
+	return revision
+})
+
+// quarantine stores an email which can't be added to a feed, so that it can be examined and retried.
+// An email which fails again when retried has its record updated instead.
+func (s *Server) quarantine(ctx context.Context, feed string, back backend.Backend, raw []byte, reason error) (*Quarantined, error) {
+	now := time.Now().UTC()
+	q, retrying := ctx.Value(retryKey{}).(*Quarantined)
+	if retrying {
+		q.Retried = &now
+	} else {
+		var nonce [4]byte
+		rand.Read(nonce[:])
+		q = &Quarantined{
+			ID:       fmt.Sprintf("%s-%x", now.Format(versionLayout), nonce),
+			Feed:     feed,
+			Received: now,
+		}
+		err := s.bucket.WriteAll(ctx, quarantineKey(feed, q.ID, "eml"), raw, &blob.WriterOptions{ContentType: "message/rfc822"})
+		if err != nil {
+			return nil, fmt.Errorf("write quarantined email: %w", err)
+		}
+	}
+	q.Reason = reason.Error()
+	q.Backend = back.Name()
+	q.Version = buildVersion()
+	q.Attempts++
+	b, err := json.Marshal(q)
+	if err != nil {
+		return nil, fmt.Errorf("encode quarantine record: %w", err)
+	}
+	err = s.bucket.WriteAll(ctx, quarantineKey(feed, q.ID, "json"), b, &blob.WriterOptions{ContentType: "application/json;charset=UTF-8"})
+	if err != nil {
+		return nil, fmt.Errorf("write quarantine record: %w", err)
+	}
+	return q, nil
+}
+
+// holdBack quarantines an email, answering 202 Accepted so that the sender doesn't retry it
+func (s *Server) holdBack(ctx context.Context, w http.ResponseWriter, feed string, back backend.Backend, raw []byte, reason error) {
+	q, err := s.quarantine(ctx, feed, back, raw, reason)
+	if err != nil {
+		http.Error(w, "Could not quarantine email", http.StatusInternalServerError)
+		log.Printf("quarantine email: %v", err)
+		return
+	}
+	log.Printf("quarantined email to feed %s as %s: %v", feed, q.ID, reason)
+	w.WriteHeader(http.StatusAccepted)
+	err = json.NewEncoder(w).Encode(&AddEmailResponse{ID: q.ID, Quarantined: true})
+	if err != nil {
+		log.Printf("encode response as json: %v", err)
+	}
+}
+
+// release removes an email from the quarantine once it's been added to its feed
+func (s *Server) release(ctx context.Context, q *Quarantined) error {
+	for _, ext := range []string{"json", "eml"} {
+		err := s.bucket.Delete(ctx, quarantineKey(q.Feed, q.ID, ext))
+		if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return fmt.Errorf("delete quarantined email: %w", err)
+		}
+	}
+	return nil
+}
+
+// releaseRetried releases the quarantined email being retried, if any, once it's been handled
+func (s *Server) releaseRetried(ctx context.Context, feed string) {
+	q, ok := ctx.Value(retryKey{}).(*Quarantined)
+	if !ok {
+		return
+	}
+	err := s.release(ctx, q)
+	if err != nil {
+		log.Printf("release email %s from quarantine of feed %s: %v", q.ID, feed, err)
+	}
+}
+
+func (s *Server) readQuarantined(ctx context.Context, feed, id string) (*Quarantined, error) {
+	b, err := s.bucket.ReadAll(ctx, quarantineKey(feed, id, "json"))
+	if err != nil {
+		return nil, fmt.Errorf("read quarantine record: %w", err)
+	}
+	var q Quarantined
+	err = json.Unmarshal(b, &q)
+	if err != nil {
+		return nil, fmt.Errorf("parse quarantine record %s: %w", id, err)
+	}
+	return &q, nil
+}
+
+// QuarantinedEmails lists the emails held back from a feed, newest first
+func (s *Server) QuarantinedEmails(ctx context.Context, feed string) ([]*Quarantined, error) {
+	var quarantined []*Quarantined
+	iter := s.bucket.List(&blob.ListOptions{Prefix: fmt.Sprintf("%s/quarantine/", feed)})
+	for {
+		obj, err := iter.Next(ctx)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("list quarantine: %w", err)
+		}
+		id, ok := strings.CutSuffix(strings.TrimPrefix(obj.Key, fmt.Sprintf("%s/quarantine/", feed)), ".json")
+		if !ok {
+			continue
+		}
+		q, err := s.readQuarantined(ctx, feed, id)
+		if err != nil {
+			return nil, err
+		}
+		quarantined = append(quarantined, q)
+	}
+	slices.Reverse(quarantined)
+	return quarantined, nil
+}
+
+func (s *Server) GetQuarantine(w http.ResponseWriter, req *http.Request) {
+	quarantined, err := s.QuarantinedEmails(req.Context(), req.PathValue("feed"))
+	if err != nil {
+		http.Error(w, "Could not list quarantine", http.StatusInternalServerError)
+		log.Printf("list quarantine: %v", err)
+		return
+	}
+	if quarantined == nil {
+		quarantined = []*Quarantined{}
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	err = json.NewEncoder(w).Encode(quarantined)
+	if err != nil {
+		log.Printf("write quarantine: %v", err)
+	}
+}
+
+// GetQuarantined serves a quarantined email as it was received
+func (s *Server) GetQuarantined(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	raw, err := s.bucket.ReadAll(ctx, quarantineKey(req.PathValue("feed"), req.PathValue("id"), "eml"))
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		http.Error(w, "No such quarantined email", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not read quarantined email", http.StatusInternalServerError)
+		log.Printf("read quarantined email: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Write(raw)
+}
+
+// RetryQuarantined tries to add a quarantined email to its feed again, answering as AddEmail does.
+// The email leaves the quarantine if it's added, and otherwise its record is updated with the new failure.
+func (s *Server) RetryQuarantined(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	feed := req.PathValue("feed")
+	q, err := s.readQuarantined(ctx, feed, req.PathValue("id"))
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		http.Error(w, "No such quarantined email", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not read quarantine record", http.StatusInternalServerError)
+		log.Printf("read quarantine record: %v", err)
+		return
+	}
+	raw, err := s.bucket.ReadAll(ctx, quarantineKey(feed, q.ID, "eml"))
+	if err != nil {
+		http.Error(w, "Could not read quarantined email", http.StatusInternalServerError)
+		log.Printf("read quarantined email: %v", err)
+		return
+	}
+	req = req.WithContext(context.WithValue(ctx, retryKey{}, q))
+	req.Body = io.NopCloser(bytes.NewReader(raw))
+	s.AddEmail(w, req)
+}
+
+// DeleteQuarantined discards a quarantined email
+func (s *Server) DeleteQuarantined(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	q, err := s.readQuarantined(ctx, req.PathValue("feed"), req.PathValue("id"))
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		http.Error(w, "No such quarantined email", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not read quarantine record", http.StatusInternalServerError)
+		log.Printf("read quarantine record: %v", err)
+		return
+	}
+	err = s.release(ctx, q)
+	if err != nil {
+		http.Error(w, "Could not delete quarantined email", http.StatusInternalServerError)
+		log.Printf("delete quarantined email: %v", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/cptaffe/email2rss/internal/backend"
+	"github.com/cptaffe/email2rss/internal/config"
+	"github.com/cptaffe/email2rss/internal/fetch"
+	"github.com/cptaffe/email2rss/internal/generic"
+	"gocloud.dev/blob"
+)
+
+// fixableBackend fails to parse emails until it's fixed
+type fixableBackend struct {
+	backend.Backend
+	fixed bool
+}
+
+func (b *fixableBackend) FromMessage(msg *mail.Message) (backend.Item, error) {
+	if !b.fixed {
+		return nil, errors.New("template changed")
+	}
+	return b.Backend.FromMessage(msg)
+}
+
+func TestQuarantine(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	cfg := config.Default()
+	cfg.Admin = testAdmin
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})), WithConfig(cfg))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	back := &fixableBackend{Backend: generic.NewBackend("notes")}
+	s.backends["notes"] = back
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := asAdmin(httptest.NewRequest(method, path, strings.NewReader(body)))
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+	list := func() []*Quarantined {
+		rec := do(http.MethodGet, "/email2rss/notes/quarantine", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("listing quarantine gave %d: %s", rec.Code, rec.Body)
+		}
+		var quarantined []*Quarantined
+		err := json.NewDecoder(rec.Body).Decode(&quarantined)
+		if err != nil {
+			t.Fatalf("decode quarantine: %v", err)
+		}
+		return quarantined
+	}
+	metric := func(expected string) {
+		rec := do(http.MethodGet, "/email2rss/metrics", "")
+		if !strings.Contains(rec.Body.String(), expected+"\n") {
+			t.Errorf("metrics don't contain %q:\n%s", expected, rec.Body)
+		}
+	}
+
+	// An email the backend can't parse is kept rather than lost
+	rec := do(http.MethodPost, "/email2rss/notes/email", testMailchimpEmail)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("unparseable email gave %d, expected 202: %s", rec.Code, rec.Body)
+	}
+	quarantined := list()
+	if len(quarantined) != 1 {
+		t.Fatalf("quarantine has %d emails, expected 1", len(quarantined))
+	}
+	q := quarantined[0]
+	if q.Attempts != 1 || q.Backend != "notes" || q.Version == "" || !strings.Contains(q.Reason, "template changed") {
+		t.Errorf("quarantine record is %+v", q)
+	}
+	rec = do(http.MethodGet, "/email2rss/notes/quarantine/"+q.ID, "")
+	if rec.Body.String() != testMailchimpEmail {
+		t.Errorf("quarantined email differs from the one posted")
+	}
+	metric(`email2rss_quarantined_emails{feed="notes"} 1`)
+
+	// Failing again updates the record
+	rec = do(http.MethodPost, "/email2rss/notes/quarantine/"+q.ID+"/retry", "")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("retrying email gave %d, expected 202: %s", rec.Code, rec.Body)
+	}
+	quarantined = list()
+	if len(quarantined) != 1 || quarantined[0].ID != q.ID || quarantined[0].Attempts != 2 || quarantined[0].Retried == nil {
+		t.Errorf("quarantine after failed retry is %+v", quarantined)
+	}
+
+	// Once the backend is fixed, retrying adds the email and releases it
+	back.fixed = true
+	rec = do(http.MethodPost, "/email2rss/notes/quarantine/"+q.ID+"/retry", "")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("retrying email gave %d, expected 201: %s", rec.Code, rec.Body)
+	}
+	var resp AddEmailResponse
+	err = json.NewDecoder(rec.Body).Decode(&resp)
+	if err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	exists, err := bucket.Exists(ctx, "notes/items/"+resp.ID+".json")
+	if err != nil || !exists {
+		t.Errorf("item %s wasn't added: %v", resp.ID, err)
+	}
+	if quarantined = list(); len(quarantined) != 0 {
+		t.Errorf("quarantine still has %+v", quarantined)
+	}
+	metric(`email2rss_quarantined_emails{feed="notes"} 0`)
+	if rec = do(http.MethodPost, "/email2rss/notes/quarantine/"+q.ID+"/retry", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("retrying released email gave %d, expected 404", rec.Code)
+	}
+
+	// Quarantined emails can be discarded
+	back.fixed = false
+	rec = do(http.MethodPost, "/email2rss/notes/email", testRelatedEmail)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("unparseable email gave %d, expected 202: %s", rec.Code, rec.Body)
+	}
+	err = json.NewDecoder(rec.Body).Decode(&resp)
+	if err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if rec = do(http.MethodDelete, "/email2rss/notes/quarantine/"+resp.ID, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("deleting quarantined email gave %d, expected 204", rec.Code)
+	}
+	if quarantined = list(); len(quarantined) != 0 {
+		t.Errorf("quarantine still has %+v", quarantined)
+	}
+}
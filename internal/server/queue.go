@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/cptaffe/email2rss/internal/backend"
+	"gocloud.dev/blob"
+)
+
+const (
+	// enrichInterval is how often the queue is checked for tasks due to be retried
+	enrichInterval = time.Minute
+	// maxEnrichBackoff caps the delay between attempts to enrich an item
+	maxEnrichBackoff = 6 * time.Hour
+	// maxEnrichAttempts is how many times an item is enriched before giving up, about two days
+	maxEnrichAttempts = 15
+)
+
+// Task is a pending enrichment of an item, stored under {feed}/queue/ until it succeeds
+type Task struct {
+	Feed      string    `json:"feed"`
+	Key       string    `json:"key"`
+	Attempts  int       `json:"attempts"`
+	NotBefore time.Time `json:"notBefore"`
+	LastError string    `json:"lastError,omitempty"`
+	// Failed is set once enrichment has been abandoned, leaving the item as it is
+	Failed bool `json:"failed,omitempty"`
+}
+
+func taskKey(feed, key string) string {
+	return fmt.Sprintf("%s/queue/%s.json", feed, key)
+}
+
+// enqueue schedules an item to be enriched as soon as possible
+func (s *Server) enqueue(ctx context.Context, feed, key string) error {
+	err := s.writeTask(ctx, &Task{Feed: feed, Key: key})
+	if err != nil {
+		return err
+	}
+	// Wake the enricher without blocking if it's already been woken
+	select {
+	case s.enrichments <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *Server) writeTask(ctx context.Context, task *Task) error {
+	w, err := s.bucket.NewWriter(ctx, taskKey(task.Feed, task.Key), &blob.WriterOptions{ContentType: "application/json;charset=UTF-8"})
+	if err != nil {
+		return fmt.Errorf("new object writer: %w", err)
+	}
+	err = json.NewEncoder(w).Encode(task)
+	if err != nil {
+		w.Close()
+		return fmt.Errorf("write task file: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("close task file: %w", err)
+	}
+	return nil
+}
+
+// Enricher works through the queue whenever an item is added and periodically to retry failures
+func (s *Server) Enricher(ctx context.Context) {
+	ticker := time.NewTicker(enrichInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.enrichments:
+		case <-ticker.C:
+		}
+		err := s.processQueue(ctx, time.Now())
+		if err != nil {
+			log.Printf("process enrichment queue: %v", err)
+		}
+	}
+}
+
+// feeds lists the top-level prefixes of the bucket, some of which may not be feeds
+func (s *Server) feeds(ctx context.Context) ([]string, error) {
+	var feeds []string
+	iter := s.bucket.List(&blob.ListOptions{Delimiter: "/"})
+	for {
+		obj, err := iter.Next(ctx)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("list feeds: %w", err)
+		}
+		if obj.IsDir {
+			feeds = append(feeds, strings.TrimSuffix(obj.Key, "/"))
+		}
+	}
+	return feeds, nil
+}
+
+// tasks lists the tasks queued for a feed, skipping any which can't be read
+func (s *Server) tasks(ctx context.Context, feed string) ([]*Task, error) {
+	var tasks []*Task
+	iter := s.bucket.List(&blob.ListOptions{Prefix: fmt.Sprintf("%s/queue/", feed)})
+	for {
+		obj, err := iter.Next(ctx)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("list tasks: %w", err)
+		}
+		b, err := s.bucket.ReadAll(ctx, obj.Key)
+		if err != nil {
+			log.Printf("read task file %s: %v", obj.Key, err)
+			continue
+		}
+		var task Task
+		err = json.Unmarshal(b, &task)
+		if err != nil {
+			log.Printf("parse task file %s: %v", obj.Key, err)
+			continue
+		}
+		tasks = append(tasks, &task)
+	}
+	return tasks, nil
+}
+
+// processQueue attempts every task which is due at now, so that one feed's failures don't hold up the others
+func (s *Server) processQueue(ctx context.Context, now time.Time) error {
+	feeds, err := s.feeds(ctx)
+	if err != nil {
+		return err
+	}
+	for _, feed := range feeds {
+		tasks, err := s.tasks(ctx, feed)
+		if err != nil {
+			log.Printf("list enrichment tasks of feed %s: %v", feed, err)
+			continue
+		}
+		for _, task := range tasks {
+			if task.Failed || task.NotBefore.After(now) {
+				continue
+			}
+			err := s.runTask(ctx, task)
+			if err == nil {
+				continue
+			}
+			task.Attempts++
+			task.LastError = err.Error()
+			if task.Attempts >= maxEnrichAttempts {
+				log.Printf("abandon enrichment of item %s of feed %s: %v", task.Key, task.Feed, err)
+				task.Failed = true
+			} else {
+				log.Printf("enrich item %s of feed %s: %v", task.Key, task.Feed, err)
+				task.NotBefore = now.Add(min(enrichInterval<<min(task.Attempts, 16), maxEnrichBackoff))
+			}
+			err = s.writeTask(ctx, task)
+			if err != nil {
+				log.Printf("reschedule enrichment of item %s of feed %s: %v", task.Key, task.Feed, err)
+				continue
+			}
+			if task.Failed {
+				// Publish whatever was stored for the item, as it won't be enriched
+				s.refreshes <- task.Feed
+			}
+		}
+	}
+	return nil
+}
+
+// needsEnrichment reports whether an item has anything to fetch from the network
+func (s *Server) needsEnrichment(feed string, back backend.Backend, item backend.Item) bool {
+	if _, ok := back.(backend.Enricher); ok {
+		return true
+	}
+	if s.config.Feed(feed).ResolveLinks && len(trackedLinks(item)) > 0 {
+		return true
+	}
+	_, ok := item.(backend.Mirrorable)
+	return ok && s.config.Feed(feed).Mirror
+}
+
+// runTask enriches an item, then removes the task and refreshes the feed
+func (s *Server) runTask(ctx context.Context, task *Task) error {
+	back, err := s.Backend(task.Feed)
+	if err != nil {
+		return fmt.Errorf("load backend for feed %s: %w", task.Feed, err)
+	}
+	item, err := s.readItem(ctx, back, task.Key)
+	if err != nil {
+		return err
+	}
+
+	if s.config.Feed(task.Feed).ResolveLinks {
+		err = s.resolveTracking(ctx, item)
+		if err != nil {
+			return err
+		}
+		// Resolved links may carry the recipient's details
+		s.redact(task.Feed, nil, item)
+	}
+	if enricher, ok := back.(backend.Enricher); ok {
+		err = enricher.Enrich(ctx, item)
+		if err != nil {
+			return err
+		}
+		// Enriching may find files, such as the audio's artwork, to store alongside the item
+		err = s.storeEmbedded(ctx, task.Feed, item)
+		if err != nil {
+			return fmt.Errorf("store files found enriching item: %w", err)
+		}
+	}
+	// Mirror after enriching, since enrichment may need the original URLs
+	if mirrorable, ok := item.(backend.Mirrorable); ok && s.config.Feed(task.Feed).Mirror {
+		err = s.mirror(ctx, task.Feed, mirrorable)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.writeItem(ctx, task.Feed, item)
+	if err != nil {
+		return fmt.Errorf("write item to object store: %w", err)
+	}
+	s.fireWebhooks(ctx, task.Feed, task.Key, EventUpdated)
+	err = s.bucket.Delete(ctx, taskKey(task.Feed, task.Key))
+	if err != nil {
+		return fmt.Errorf("delete task file: %w", err)
+	}
+	s.refreshes <- task.Feed
+	return nil
+}
+
+// readItem reads and decodes an item of a feed
+func (s *Server) readItem(ctx context.Context, back backend.Backend, key string) (backend.Item, error) {
+	r, err := s.bucket.NewReader(ctx, fmt.Sprintf("%s/items/%s.json", back.Name(), key), nil)
+	if err != nil {
+		return nil, fmt.Errorf("construct item object reader: %w", err)
+	}
+	defer r.Close()
+	item, err := back.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("parse item from file: %w", err)
+	}
+	return item, nil
+}
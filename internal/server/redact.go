@@ -0,0 +1,23 @@
+package server
+
+import (
+	"net/mail"
+
+	"github.com/cptaffe/email2rss/internal/backend"
+	"github.com/cptaffe/email2rss/internal/redact"
+)
+
+// redact removes the details of a feed's recipient from an item, along with
+// those found in the headers of the email it was parsed from, if given
+func (s *Server) redact(feed string, msg *mail.Message, item backend.Item) {
+	filterable, ok := item.(backend.Filterable)
+	if !ok {
+		return
+	}
+	identity := s.config.Feed(feed).Identity
+	redactor := &redact.Redactor{Names: identity.Names, Addresses: identity.Addresses}
+	if msg != nil {
+		redactor = redactor.ForMessage(msg)
+	}
+	filterable.Filter(redactor.HTML, redactor.URL)
+}
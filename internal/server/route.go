@@ -0,0 +1,66 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+
+	"github.com/cptaffe/email2rss/internal/config"
+	"github.com/cptaffe/email2rss/internal/route"
+)
+
+// newRouter compiles the configured routes
+func newRouter(routes []config.Route) (*route.Router, error) {
+	rules := make([]route.Rule, len(routes))
+	for i, r := range routes {
+		rules[i] = route.Rule{Name: r.Name, Feed: r.Feed, ListID: r.ListID, From: r.From, Tag: r.Tag, Subject: r.Subject, Headers: r.Headers}
+	}
+	router, err := route.New(rules)
+	if err != nil {
+		return nil, fmt.Errorf("compile routes: %w", err)
+	}
+	return router, nil
+}
+
+// RouteEmail adds an email to the feed picked by the configured routes,
+// or with ?dry-run reports which route matched without adding it
+func (s *Server) RouteEmail(w http.ResponseWriter, req *http.Request) {
+	raw, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "Could not read message", http.StatusBadRequest)
+		log.Printf("read message: %v", err)
+		return
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		http.Error(w, "Could not parse message", http.StatusBadRequest)
+		log.Printf("parse message: %v", err)
+		return
+	}
+	m, ok := s.router.Route(msg.Header)
+	if !ok {
+		http.Error(w, "No route matches the email", http.StatusUnprocessableEntity)
+		log.Printf("route email from %s: no route matches", msg.Header.Get("From"))
+		return
+	}
+
+	if req.URL.Query().Has("dry-run") {
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		err = json.NewEncoder(w).Encode(m)
+		if err != nil {
+			log.Printf("encode response as json: %v", err)
+		}
+		return
+	}
+
+	log.Printf("routed email from %s to feed %s by route %s", msg.Header.Get("From"), m.Feed, m.Rule)
+	w.Header().Set("X-Email2rss-Feed", m.Feed)
+	w.Header().Set("X-Email2rss-Route", m.Rule)
+	req.SetPathValue("feed", m.Feed)
+	req.Body = io.NopCloser(bytes.NewReader(raw))
+	s.AddEmail(w, req)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cptaffe/email2rss/internal/config"
+	"github.com/cptaffe/email2rss/internal/fetch"
+	"github.com/cptaffe/email2rss/internal/route"
+	"gocloud.dev/blob"
+)
+
+func TestRouteEmail(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	cfg := config.Default()
+	cfg.Routes = []config.Route{
+		{Name: "journalclub", Feed: "journalclub", From: `@journalclub\.io$`},
+		{Name: "reports", Feed: "reports", Subject: `\breport$`},
+	}
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})), WithConfig(cfg))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	post := func(query, email string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/email2rss/email"+query, strings.NewReader(email))
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// A dry run reports the route without adding the email
+	rec := post("?dry-run", testEmail)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("dry run gave %d, expected 200: %s", rec.Code, rec.Body)
+	}
+	var m route.Match
+	err = json.NewDecoder(rec.Body).Decode(&m)
+	if err != nil {
+		t.Fatalf("decode match: %v", err)
+	}
+	expected := route.Match{Rule: "journalclub", Feed: "journalclub", Matched: map[string]string{"From": "members@journalclub.io"}}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("match is %+v, expected %+v", m, expected)
+	}
+	list, err := bucket.List(&blob.ListOptions{Prefix: "journalclub/items/"}).Next(ctx)
+	if err == nil {
+		t.Errorf("dry run stored %s", list.Key)
+	}
+
+	rec = post("", testAttachmentsEmail)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("routing email gave %d, expected 201: %s", rec.Code, rec.Body)
+	}
+	if feed, rule := rec.Header().Get("X-Email2rss-Feed"), rec.Header().Get("X-Email2rss-Route"); feed != "reports" || rule != "reports" {
+		t.Errorf("routed to feed %q by route %q, expected reports", feed, rule)
+	}
+	var resp AddEmailResponse
+	err = json.NewDecoder(rec.Body).Decode(&resp)
+	if err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	exists, err := bucket.Exists(ctx, "reports/items/"+resp.ID+".json")
+	if err != nil || !exists {
+		t.Errorf("item %s wasn't stored in the reports feed: %v", resp.ID, err)
+	}
+
+	for _, query := range []string{"", "?dry-run"} {
+		rec = post(query, testMailchimpEmail)
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("unroutable email%s gave %d, expected 422", query, rec.Code)
+		}
+	}
+
+	cfg.Routes = []config.Route{{Feed: "reports", Subject: `(`}}
+	_, err = NewServer(ctx, "../../templates", bucket, WithConfig(cfg))
+	if err == nil {
+		t.Errorf("constructed server with an invalid route")
+	}
+}
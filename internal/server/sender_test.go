@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cptaffe/email2rss/internal/config"
+	"github.com/cptaffe/email2rss/internal/fetch"
+	"gocloud.dev/blob"
+)
+
+var (
+	// signedEmail is signed by example.com, and forgedEmail is the same email with its body changed
+	//go:embed test/signed.rfc822
+	signedEmail []byte
+	//go:embed test/forged.rfc822
+	forgedEmail []byte
+)
+
+// stubResolver serves DNS TXT records from a map
+type stubResolver map[string]string
+
+func (r stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	record, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return []string{record}, nil
+}
+
+func TestSenderAuthentication(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	cfg := config.Default()
+	cfg.Feeds = map[string]config.Feed{
+		"digest":  {Senders: &config.Senders{Domains: []string{"example.com"}}},
+		"weekly":  {Senders: &config.Senders{Domains: []string{"example.com"}, Action: config.ActionQuarantine}},
+		"monthly": {Senders: &config.Senders{Domains: []string{"example.org"}}},
+	}
+	resolver := stubResolver{"rsa2024._domainkey.example.com": "v=DKIM1; k=rsa; p=MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAnEDkaaezJsVUUausmKPeeMah1oQosEoj6YSWurd79emLIu59oDaoqLBNlcpyRSt2/Dvw/p13Wexr5kyKKxVRCpePWFlssVEU+CDzYE8erJgwWQlPqEFun9uNB077FZ7tYIS8l96zudiqoAM3/CXsBpTIneric63yEJ/RnPSwlFP3upULIHQx5HTri0WnEkscZV3AfHB9IWwzb2Ct1DXt/XzCDa1q6DeA4Ay7SKPyI/q0wCQVl6Be3RLkCKdc4e4Z3WQ4hqkkhDOVpvVI7YdHpAuTxCe6iiMLD/YDLaO5U/SqradsIe8rGy0ieU9YSO72jY+qBDUA+dVaqDfR6uZbnQIDAQAB"}
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})), WithConfig(cfg), WithResolver(resolver))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	post := func(feed string, email []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/email2rss/"+feed+"/email", bytes.NewReader(email))
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		feed  string
+		email []byte
+		code  int
+	}{
+		{"digest", signedEmail, http.StatusCreated},
+		{"digest", forgedEmail, http.StatusForbidden},
+		{"monthly", signedEmail, http.StatusForbidden},
+		{"weekly", forgedEmail, http.StatusAccepted},
+	}
+	for _, test := range tests {
+		rec := post(test.feed, test.email)
+		if rec.Code != test.code {
+			t.Errorf("POST email to %s gave %d, expected %d: %s", test.feed, rec.Code, test.code, rec.Body)
+		}
+		if rec.Code != http.StatusAccepted {
+			continue
+		}
+		var resp AddEmailResponse
+		err = json.NewDecoder(rec.Body).Decode(&resp)
+		if err != nil {
+			t.Fatalf("parse response: %v", err)
+		}
+		if !resp.Quarantined {
+			t.Errorf("email wasn't quarantined: %+v", resp)
+		}
+		stored, err := bucket.ReadAll(ctx, quarantineKey(test.feed, resp.ID, "eml"))
+		if err != nil {
+			t.Fatalf("read quarantined email: %v", err)
+		}
+		if !bytes.Equal(stored, test.email) {
+			t.Errorf("quarantined email differs from the one posted")
+		}
+		var q Quarantined
+		b, err := bucket.ReadAll(ctx, quarantineKey(test.feed, resp.ID, "json"))
+		if err != nil {
+			t.Fatalf("read quarantine record: %v", err)
+		}
+		err = json.Unmarshal(b, &q)
+		if err != nil || q.Reason == "" {
+			t.Errorf("quarantine record is %s, %v", b, err)
+		}
+	}
+
+	// Neither of the unauthenticated emails were added
+	for _, feed := range []string{"weekly", "monthly"} {
+		exists, err := bucket.Exists(ctx, feed+"/items/2024-11-03T13:55:35Z.json")
+		if err != nil || exists {
+			t.Errorf("item was added to %s: %v", feed, err)
+		}
+	}
+}
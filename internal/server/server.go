@@ -3,12 +3,16 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/sha1"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	htmltemplate "html/template"
 	"io"
 	"iter"
 	"log"
+	"net"
 	"net/http"
 	"net/mail"
 	"path"
@@ -17,25 +21,91 @@ import (
 	"time"
 
 	"github.com/cptaffe/email2rss/internal/backend"
+	"github.com/cptaffe/email2rss/internal/config"
+	"github.com/cptaffe/email2rss/internal/confirm"
+	"github.com/cptaffe/email2rss/internal/fetch"
 	"github.com/cptaffe/email2rss/internal/generic"
 	"github.com/cptaffe/email2rss/internal/journalclub"
+	"github.com/cptaffe/email2rss/internal/route"
+	"github.com/cptaffe/email2rss/internal/sanitize"
+	"github.com/cptaffe/email2rss/internal/sender"
+	"github.com/cptaffe/email2rss/internal/websub"
 	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
 )
 
 const (
-	RFC2822 string = "Mon, 02 Jan 2006 15:04:05 MST"
+	// RFC2822 uses a numeric zone, as readers can't interpret abbreviations such as "CEST"
+	RFC2822 string = "Mon, 02 Jan 2006 15:04:05 -0700"
+	// itemCSP lets item pages show images, media and styles but never run script, submit forms or be framed
+	itemCSP = "default-src 'none'; img-src http: https: data:; media-src http: https:; style-src 'unsafe-inline' http: https:; font-src http: https:; base-uri 'none'; form-action 'none'; frame-ancestors 'none'; sandbox allow-popups allow-popups-to-escape-sandbox"
 )
 
 type Server struct {
-	template  *template.Template
-	bucket    *blob.Bucket
-	backends  map[string]backend.Backend
-	refreshes chan string
+	template *template.Template
+	pages    *htmltemplate.Template
+	hub      *websub.Hub
+	bucket   *blob.Bucket
+	client   *http.Client
+	// webhookClient delivers to webhooks, which the configuration rather than emails names
+	webhookClient *http.Client
+	config        *config.Config
+	backends      map[string]backend.Backend
+	refreshes     chan string
+	enrichments   chan struct{}
+	deliveries    chan struct{}
+	resolver      sender.Resolver
+	router        *route.Router
+	detectors     map[string]*confirm.Detector
+}
+
+// publicOptions configure the default client, which only requests public addresses
+// as most of the URLs it's given come from emails
+var publicOptions = func() fetch.Options {
+	opts := fetch.DefaultOptions
+	opts.PublicOnly = true
+	return opts
+}()
+
+// WebhookOptions configure the client webhooks are delivered with. Webhooks are configured by the
+// operator, so they may be on the local network, and failed deliveries are retried by the deliverer
+// rather than the client, which would POST them again at once after a 5xx.
+var WebhookOptions = fetch.Options{Timeout: fetch.DefaultOptions.Timeout}
+
+type Option func(*Server)
+
+// WithConfig sets the per-feed configuration
+func WithConfig(cfg *config.Config) Option {
+	return func(s *Server) {
+		s.config = cfg
+	}
+}
+
+// WithHTTPClient sets the client backends use to fetch data from the network
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *Server) {
+		s.client = client
+	}
+}
+
+// WithWebhookClient sets the client items are delivered to webhooks with
+func WithWebhookClient(client *http.Client) Option {
+	return func(s *Server) {
+		s.webhookClient = client
+	}
+}
+
+// WithResolver sets the resolver used to look up the keys which sign email
+func WithResolver(resolver sender.Resolver) Option {
+	return func(s *Server) {
+		s.resolver = resolver
+	}
 }
 
 // TODO: Abstract the implementation of email -> item state and item states -> feed
-func NewServer(ctx context.Context, templatePath string, bucket *blob.Bucket) (*Server, error) {
-	xt := template.New("text").Funcs(template.FuncMap{
+func NewServer(ctx context.Context, templatePath string, bucket *blob.Bucket, opts ...Option) (*Server, error) {
+	xt := template.New("text")
+	xt.Funcs(template.FuncMap{
 		"escape": func(html string) (string, error) {
 			var b bytes.Buffer
 			err := xml.EscapeText(&b, []byte(html))
@@ -50,22 +120,70 @@ func NewServer(ctx context.Context, templatePath string, bucket *blob.Bucket) (*
 		"timestamp": func(t time.Time) string {
 			return t.Format(time.RFC3339)
 		},
+		"duration": func(d time.Duration) string {
+			d = d.Round(time.Second)
+			return fmt.Sprintf("%02d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+		},
+		"podcastguid": podcastGUID,
+		"cdata":       cdata,
+		"sanitize":    sanitize.HTML,
+		// include executes a named template to a string, e.g. to wrap its output in CDATA
+		"include": func(name string, data any) (string, error) {
+			var b strings.Builder
+			err := xt.ExecuteTemplate(&b, name, data)
+			return b.String(), err
+		},
 	})
 	_, err := xt.ParseGlob(path.Join(templatePath, "*.xml.tmpl"))
 	if err != nil {
 		return nil, fmt.Errorf("parse template at `%s`: %w", templatePath, err)
 	}
-	s := &Server{template: xt, bucket: bucket, backends: map[string]backend.Backend{
-		"journalclub": &journalclub.Backend{},
-	}}
+	pages, err := parsePages(templatePath)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{template: xt, pages: pages, bucket: bucket, client: fetch.NewClient(publicOptions), webhookClient: fetch.NewClient(WebhookOptions), config: config.Default(), refreshes: make(chan string), enrichments: make(chan struct{}, 1), deliveries: make(chan struct{}, 1), resolver: net.DefaultResolver}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.router, err = newRouter(s.config.Routes)
+	if err != nil {
+		return nil, err
+	}
+	s.detectors, err = newDetectors(s.config.Feeds)
+	if err != nil {
+		return nil, err
+	}
+	s.hub = websub.NewHub(s.hubURL(), bucket, s.topicFeed, websub.WithHTTPClient(s.client))
+	s.backends = map[string]backend.Backend{
+		"journalclub": journalclub.NewBackend(s.client),
+	}
 	go s.Refresher(ctx)
+	go s.Enricher(ctx)
+	go s.Deliverer(ctx)
 	return s, nil
 }
 
+// cdata wraps text in a CDATA section, splitting any ]]> which would end it early
+// and dropping characters XML doesn't allow even within CDATA
+func cdata(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' || (r >= 0x20 && r <= 0xD7FF) || (r >= 0xE000 && r <= 0xFFFD) || (r >= 0x10000 && r <= 0x10FFFF) {
+			return r
+		}
+		return -1
+	}, s)
+	return "<![CDATA[" + strings.ReplaceAll(s, "]]>", "]]]]><![CDATA[>") + "]]>"
+}
+
 func (s *Server) Backend(feed string) (backend.Backend, error) {
 	back, ok := s.backends[feed]
 	if !ok {
-		return generic.NewBackend(feed), nil
+		var opts []generic.Option
+		if s.config.Feed(feed).Extract {
+			opts = append(opts, generic.WithExtraction())
+		}
+		return generic.NewBackend(feed, opts...), nil
 	}
 	return back, nil
 }
@@ -90,11 +208,23 @@ func (s *Server) GetFeed(w http.ResponseWriter, req *http.Request) {
 	w.Header().Add("Content-Type", "application/xml+rss;charset=UTF-8")
 	w.Header().Add("Content-Disposition", "inline")
 	w.Header().Add("Cache-Control", "no-cache")
+	if _, ok := ctx.Value(tokenKey{}).(string); ok {
+		// The feed's links are rewritten for the capability URL it was accessed with
+		b, err := io.ReadAll(blobReader)
+		if err != nil {
+			http.Error(w, "Could not read feed", http.StatusInternalServerError)
+			log.Printf("read feed: %v", err)
+			return
+		}
+		http.ServeContent(w, req, "feed.xml", blobReader.ModTime(), bytes.NewReader(s.capabilityURLs(ctx, req.PathValue("feed"), b)))
+		return
+	}
 	w.Header().Add("ETag", attrs.ETag)
 	http.ServeContent(w, req, "feed.xml", blobReader.ModTime(), blobReader)
 }
 
-// TODO: serve an item-specific HTML page, possibly the original email or extracted HTML
+// GetItem serves an item's page, rendered with its backend's HTML template,
+// or the item itself to clients which accept JSON
 func (s *Server) GetItem(w http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
 	feed := req.PathValue("feed")
@@ -107,6 +237,10 @@ func (s *Server) GetItem(w http.ResponseWriter, req *http.Request) {
 
 	key := fmt.Sprintf("%s/items/%s.json", req.PathValue("feed"), req.PathValue("key"))
 	attrs, err := s.bucket.Attributes(ctx, key)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		http.Error(w, "No such item", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Could not fetch item attributes", http.StatusInternalServerError)
 		log.Printf("fetch object attributes: %v", err)
@@ -126,25 +260,90 @@ func (s *Server) GetItem(w http.ResponseWriter, req *http.Request) {
 		log.Printf("parse item from file: %v", err)
 		return
 	}
+	s.redact(feed, nil, item)
 
-	switch i := item.(type) {
-	case *generic.Message:
-		w.Header().Add("Content-Type", "text/html;charset=UTF-8")
-		w.Header().Add("Content-Disposition", "inline")
-		w.Header().Add("Cache-Control", "no-cache")
-		w.Header().Add("ETag", attrs.ETag)
-		http.ServeContent(w, req, "item.html", blobReader.ModTime(), strings.NewReader(i.Body))
-	default:
+	var b bytes.Buffer
+	if strings.Contains(req.Header.Get("Accept"), "application/json") {
+		err = item.Encode(&b)
+		if err != nil {
+			http.Error(w, "Could not encode item", http.StatusInternalServerError)
+			log.Printf("encode item: %v", err)
+			return
+		}
 		w.Header().Add("Content-Type", "application/json;charset=UTF-8")
 		w.Header().Add("Content-Disposition", "inline")
 		w.Header().Add("Cache-Control", "no-cache")
 		w.Header().Add("ETag", attrs.ETag)
-		http.ServeContent(w, req, "item.html", blobReader.ModTime(), blobReader)
+		http.ServeContent(w, req, "item.json", blobReader.ModTime(), bytes.NewReader(s.capabilityURLs(ctx, feed, b.Bytes())))
+		return
+	}
+
+	page, err := s.itemPage(ctx, back, item)
+	if err != nil {
+		http.Error(w, "Could not load neighbouring items", http.StatusInternalServerError)
+		log.Printf("load item page: %v", err)
+		return
+	}
+	err = s.pages.ExecuteTemplate(&b, back.ItemTemplatePath(), page)
+	if err != nil {
+		http.Error(w, "Could not render item", http.StatusInternalServerError)
+		log.Printf("execute item template: %v", err)
+		return
+	}
+	w.Header().Add("Content-Type", "text/html;charset=UTF-8")
+	w.Header().Add("Content-Disposition", "inline")
+	w.Header().Add("Content-Security-Policy", itemCSP)
+	w.Header().Add("X-Content-Type-Options", "nosniff")
+	w.Header().Add("Cache-Control", "no-cache")
+	// The page links to neighbouring items, so it can change without the item changing
+	http.ServeContent(w, req, "item.html", time.Time{}, bytes.NewReader(s.capabilityURLs(ctx, feed, b.Bytes())))
+}
+
+// ChaptersResponse is the Podcasting 2.0 JSON chapters format
+type ChaptersResponse struct {
+	Version  string            `json:"version"`
+	Chapters []backend.Chapter `json:"chapters"`
+}
+
+func (s *Server) GetChapters(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	feed := req.PathValue("feed")
+	back, err := s.Backend(feed)
+	if err != nil {
+		http.Error(w, "Could not load backend for feed", http.StatusBadRequest)
+		log.Printf("load backend for feed %s: %v", feed, err)
+		return
+	}
+
+	item, err := s.readItem(ctx, back, req.PathValue("key"))
+	if err != nil {
+		http.Error(w, "Could not access item", http.StatusNotFound)
+		log.Printf("read item: %v", err)
+		return
+	}
+	chaptered, ok := item.(backend.Chaptered)
+	if !ok || len(chaptered.Chapters()) == 0 {
+		http.Error(w, "Item has no chapters", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json+chapters;charset=UTF-8")
+	w.Header().Add("Cache-Control", "no-cache")
+	err = json.NewEncoder(w).Encode(&ChaptersResponse{Version: "1.2.0", Chapters: chaptered.Chapters()})
+	if err != nil {
+		log.Printf("encode chapters as json: %v", err)
+		return
 	}
 }
 
 type AddEmailResponse struct {
 	ID string `json:"id"`
+	// Quarantined is set if the email was held back rather than added to the feed,
+	// in which case ID identifies it in the quarantine
+	Quarantined bool `json:"quarantined,omitempty"`
+	// Confirmation is set if the email asked to confirm a subscription to the feed,
+	// in which case ID identifies it among the feed's confirmations
+	Confirmation bool `json:"confirmation,omitempty"`
 }
 
 func (s *Server) AddEmail(w http.ResponseWriter, req *http.Request) {
@@ -157,12 +356,49 @@ func (s *Server) AddEmail(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	msg, err := mail.ReadMessage(req.Body)
+	raw, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "Could not read message", http.StatusBadRequest)
+		log.Printf("read message: %v", err)
+		return
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
 	if err != nil {
 		http.Error(w, "Could not parse message", http.StatusBadRequest)
 		log.Printf("parse message: %v", err)
 		return
 	}
+	// verdict is only set if the feed authenticates its senders
+	var verdict *sender.Verdict
+	if senders := s.config.Feed(feed).Senders; senders != nil {
+		policy := &sender.Policy{Domains: senders.Domains, Relays: s.config.Relays, Submitter: s.relay(req), Resolver: s.resolver}
+		verdict, err = policy.Check(ctx, raw)
+		switch {
+		case errors.Is(err, sender.ErrTemporary):
+			http.Error(w, "Could not authenticate sender, try again later", http.StatusServiceUnavailable)
+			log.Printf("authenticate sender of email to feed %s: %v", feed, err)
+			return
+		case err != nil && senders.Action == config.ActionQuarantine:
+			s.holdBack(ctx, w, feed, back, raw, err)
+			return
+		case err != nil:
+			http.Error(w, "Sender is not authenticated", http.StatusForbidden)
+			log.Printf("reject email to feed %s: %v", feed, err)
+			return
+		}
+		log.Printf("authenticated sender of email to feed %s as %s by %s", feed, verdict.Domain, verdict.Method)
+	}
+	err = s.recordSubscription(ctx, feed, msg, verdict)
+	if err != nil {
+		log.Printf("record List-Unsubscribe of email to feed %s: %v", feed, err)
+	}
+	if detector := s.detectors[feed]; detector != nil {
+		if detected, ok := detector.Detect(raw); ok {
+			s.holdConfirmation(ctx, w, feed, msg, verdict, detected)
+			return
+		}
+	}
+
 	date, err := msg.Header.Date()
 	if err != nil {
 		http.Error(w, "Could not parse Date header", http.StatusBadRequest)
@@ -187,17 +423,43 @@ func (s *Server) AddEmail(w http.ResponseWriter, req *http.Request) {
 
 	item, err := back.FromMessage(msg)
 	if err != nil {
-		http.Error(w, "Could not parse email", http.StatusBadRequest)
-		log.Printf("parse email: %v", err)
+		// Keep the email so that it can be retried once the backend can parse it
+		s.holdBack(ctx, w, feed, back, raw, fmt.Errorf("parse email: %w", err))
 		return
 	}
+	filterTracking(item)
+	s.redact(feed, msg, item)
 
+	err = s.storeEmbedded(ctx, feed, item)
+	if err != nil {
+		http.Error(w, "Could not store files from email", http.StatusInternalServerError)
+		log.Printf("store files embedded in email: %v", err)
+		return
+	}
+
+	err = s.number(ctx, back, item)
+	if err != nil {
+		http.Error(w, "Could not number item", http.StatusInternalServerError)
+		log.Printf("number item: %v", err)
+		return
+	}
 	err = s.writeItem(ctx, feed, item)
 	if err != nil {
 		http.Error(w, "Could not store item", http.StatusBadRequest)
 		log.Printf("write item to object store: %v", err)
 		return
 	}
+	s.releaseRetried(ctx, feed)
+	s.fireWebhooks(ctx, feed, item.Key(), EventCreated)
+	// Fetch anything from the network after storing the item, so that it isn't lost to network failures
+	if s.needsEnrichment(feed, back, item) {
+		err = s.enqueue(ctx, feed, item.Key())
+		if err != nil {
+			http.Error(w, "Could not queue item for enrichment", http.StatusInternalServerError)
+			log.Printf("queue item for enrichment: %v", err)
+			return
+		}
+	}
 	s.refreshes <- feed
 
 	w.WriteHeader(http.StatusCreated)
@@ -320,6 +582,29 @@ func (s *Server) writeItem(ctx context.Context, feed string, item backend.Item)
 type TemplateContext struct {
 	Backend backend.Backend
 	Items   []backend.Item
+	// BaseURL is where the server is reachable, without a trailing slash
+	BaseURL string
+	// Self is the feed's address, and Hub the WebSub hub which pushes it to subscribers
+	Self string
+	Hub  string
+	// Locked is set for podcasts which mustn't be imported into another account
+	Locked bool
+}
+
+// podcastNamespace is the UUIDv5 namespace used to derive podcast:guid values
+var podcastNamespace = [16]byte{0xea, 0xd4, 0xc2, 0x36, 0xbf, 0x58, 0x58, 0xc6, 0xa2, 0xc6, 0xa6, 0xb2, 0x8d, 0x12, 0x8c, 0xb6}
+
+// podcastGUID derives a feed's podcast:guid from its URL, per the Podcasting 2.0 namespace
+func podcastGUID(feedURL string) string {
+	feedURL = strings.TrimPrefix(strings.TrimPrefix(feedURL, "https://"), "http://")
+	feedURL = strings.TrimRight(feedURL, "/")
+	h := sha1.New()
+	h.Write(podcastNamespace[:])
+	h.Write([]byte(feedURL))
+	u := h.Sum(nil)[:16]
+	u[6] = (u[6] & 0x0f) | 0x50
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
 }
 
 func (s *Server) refreshFeed(ctx context.Context, back backend.Backend) error {
@@ -345,6 +630,8 @@ func (s *Server) refreshFeed(ctx context.Context, back backend.Backend) error {
 		if err != nil {
 			return fmt.Errorf("parse item from file: %w", err)
 		}
+		// Items stored before the recipient's identity was configured are redacted here
+		s.redact(back.Name(), nil, item)
 		// Prepend item, so that the most recent is first
 		items = append(items, item)
 		copy(items[1:], items)
@@ -356,22 +643,32 @@ func (s *Server) refreshFeed(ctx context.Context, back backend.Backend) error {
 		}
 	}
 
-	// Write a new feed file
-	feedWriter, err := s.bucket.NewWriter(ctx, fmt.Sprintf("%s/feed.xml", back.Name()), nil)
-	if err != nil {
-		return fmt.Errorf("new object writer: %w", err)
+	// Render the feed in full before publishing it, so a failure partway through can't truncate it
+	var feed bytes.Buffer
+	tctx := &TemplateContext{
+		Backend: back,
+		Items:   items,
+		BaseURL: strings.TrimRight(s.config.BaseURL, "/"),
+		Self:    s.selfURL(back.Name()),
+		Locked:  s.config.Feed(back.Name()).Locked,
+	}
+	// Private feeds can't be distributed by a hub, which would have to be able to read them
+	if s.config.Feed(back.Name()).Private == nil {
+		tctx.Hub = s.hubURL()
 	}
-	defer feedWriter.Close()
-	tctx := &TemplateContext{Backend: back, Items: items}
-	err = s.template.ExecuteTemplate(feedWriter, back.TemplatePath(), tctx)
+	err := s.template.ExecuteTemplate(&feed, back.TemplatePath(), tctx)
 	if err != nil {
 		return fmt.Errorf("execute feed template: %w", err)
 	}
-	err = feedWriter.Close()
+	err = s.publish(ctx, back.Name(), feed.Bytes())
 	if err != nil {
-		return fmt.Errorf("close feed file: %w", err)
+		return err
+	}
+	s.notify(ctx, back.Name(), feed.Bytes())
+	err = s.writeArchive(ctx, back, items)
+	if err != nil {
+		return fmt.Errorf("write archive: %w", err)
 	}
-
 	return nil
 }
 
@@ -380,12 +677,35 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// special case, backwards compatibility with old system
 	mux.HandleFunc("GET /journalclub/feed.xml", func(w http.ResponseWriter, r *http.Request) {
 		r.SetPathValue("feed", "journalclub")
-		s.GetFeed(w, r)
+		s.private(s.GetFeed)(w, r)
 	})
-	mux.HandleFunc("GET /email2rss/{feed}", s.GetFeed)
-	mux.HandleFunc("GET /email2rss/{feed}/items/{key}", s.GetItem)
+	mux.Handle("POST /email2rss/hub", s.hub)
+	mux.HandleFunc("GET /email2rss/feeds.opml", s.GetOPML)
+	mux.HandleFunc("GET /email2rss/feeds.json", s.GetFeeds)
+	mux.HandleFunc("GET /email2rss/{feed}", s.private(s.GetFeed))
+	mux.HandleFunc("GET /email2rss/{feed}/{$}", s.private(s.GetArchive))
+	mux.HandleFunc("GET /email2rss/{feed}/page/{page}/{$}", s.private(s.GetArchive))
+	mux.HandleFunc("GET /email2rss/{feed}/{year}/{month}/{$}", s.private(s.GetArchive))
+	mux.HandleFunc("GET /email2rss/{feed}/items/{key}", s.private(s.GetItem))
+	mux.HandleFunc("GET /email2rss/{feed}/items/{key}/chapters.json", s.private(s.GetChapters))
+	mux.HandleFunc("GET /email2rss/{feed}/assets/{name}", s.private(s.GetAsset))
+	mux.HandleFunc("POST /email2rss/{feed}/items/{key}/redeliver", s.admin(s.Redeliver))
+	mux.HandleFunc("GET /email2rss/{feed}/deliveries", s.admin(s.GetDeliveries))
+	mux.HandleFunc("GET /email2rss/{feed}/quarantine", s.admin(s.GetQuarantine))
+	mux.HandleFunc("GET /email2rss/{feed}/quarantine/{id}", s.admin(s.GetQuarantined))
+	mux.HandleFunc("DELETE /email2rss/{feed}/quarantine/{id}", s.admin(s.DeleteQuarantined))
+	mux.HandleFunc("POST /email2rss/{feed}/quarantine/{id}/retry", s.admin(s.RetryQuarantined))
+	mux.HandleFunc("GET /email2rss/metrics", s.admin(s.GetMetrics))
+	mux.HandleFunc("POST /email2rss/{feed}/refresh", s.admin(s.Refresh))
+	mux.HandleFunc("GET /email2rss/{feed}/history", s.admin(s.GetHistory))
+	mux.HandleFunc("POST /email2rss/{feed}/rollback", s.admin(s.Rollback))
+	mux.HandleFunc("GET /email2rss/{feed}/confirmations", s.admin(s.GetConfirmations))
+	mux.HandleFunc("POST /email2rss/{feed}/confirmations/{id}/confirm", s.admin(s.Confirm))
+	mux.HandleFunc("GET /email2rss/{feed}/subscriptions", s.admin(s.GetSubscriptions))
+	mux.HandleFunc("POST /email2rss/{feed}/subscriptions/{sender}/unsubscribe", s.admin(s.Unsubscribe))
+	mux.HandleFunc("POST /email2rss/{feed}/unsubscribe", s.admin(s.Unsubscribe))
 	// TODO: authenticate
+	mux.HandleFunc("POST /email2rss/email", s.RouteEmail)
 	mux.HandleFunc("POST /email2rss/{feed}/email", s.AddEmail)
-	mux.HandleFunc("POST /email2rss/{feed}/refresh", s.Refresh)
 	mux.ServeHTTP(w, r)
 }
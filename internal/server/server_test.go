@@ -1,21 +1,37 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	_ "embed"
 
+	"github.com/cptaffe/email2rss/internal/config"
+	"github.com/cptaffe/email2rss/internal/fetch"
 	"github.com/cptaffe/email2rss/internal/generic"
 	"github.com/cptaffe/email2rss/internal/journalclub"
+	"github.com/cptaffe/email2rss/internal/privacy"
+	"github.com/cptaffe/email2rss/internal/redact"
+	"github.com/cptaffe/email2rss/internal/sanitize"
+	"github.com/cptaffe/email2rss/internal/validate"
 	"gocloud.dev/blob"
 	_ "gocloud.dev/blob/memblob"
+	"gocloud.dev/gcerrors"
 )
 
 //go:embed test/email.rfc822
@@ -24,6 +40,96 @@ var testEmail string
 //go:embed test/email.html
 var testHTML string
 
+// zeros is an endless source of zero bytes
+type zeros struct{}
+
+func (zeros) ReadAt(p []byte, off int64) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// rewriteTransport sends every request to a test server, whatever host it was meant for
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// testAdmin lets tests manage a server, which can't be managed without admin configured
+var testAdmin = &config.Access{Users: map[string]string{"admin": "correct-horse"}}
+
+// asAdmin authenticates a request with testAdmin's credentials
+func asAdmin(req *http.Request) *http.Request {
+	req.SetBasicAuth("admin", "correct-horse")
+	return req
+}
+
+// stubClient constructs a client whose requests are all answered by handler
+func stubClient(t *testing.T, handler http.Handler) *http.Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("parse test server url: %v", err)
+	}
+	opts := fetch.DefaultOptions
+	opts.Transport = rewriteTransport{target: target}
+	opts.Backoff = time.Millisecond
+	return fetch.NewClient(opts)
+}
+
+// paperCSL is the citation metadata doi.org returns for the test email's paper
+const paperCSL = `{"title":"A Scalable Real-Time SDN-Based MQTT Framework for Industrial Applications","author":[{"given":"Ehsan","family":"Shahri"},{"given":"Paulo","family":"Pedreiras"},{"given":"Luis","family":"Almeida"}]}`
+
+// networkHandler serves silent audio the size of the test email's audio, and its paper's metadata
+func networkHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/journalclub.io/mqtt-full.mp3":
+			http.ServeContent(w, req, "mqtt-full.mp3", time.Time{}, io.NewSectionReader(zeros{}, 0, 18218972))
+		case "/10.1109/OJIES.2024.3373232":
+			w.Header().Set("Content-Type", "application/vnd.citationstyles.csl+json")
+			io.WriteString(w, paperCSL)
+		default:
+			t.Errorf("unexpected request for %s", req.URL)
+			http.NotFound(w, req)
+		}
+	})
+}
+
+// readTask reads an item's enrichment task, returning nil once the task has completed
+func readTask(t *testing.T, bucket *blob.Bucket, feed, key string) *Task {
+	b, err := bucket.ReadAll(context.Background(), taskKey(feed, key))
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("read task: %v", err)
+	}
+	var task Task
+	err = json.Unmarshal(b, &task)
+	if err != nil {
+		t.Fatalf("parse task: %v", err)
+	}
+	return &task
+}
+
+// waitForTask polls until cond holds for an item's enrichment task
+func waitForTask(t *testing.T, bucket *blob.Bucket, feed, key string, cond func(*Task) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond(readTask(t, bucket, feed, key)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for task of item %s", key)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestAddJournalClubEmail(t *testing.T) {
 	ctx := context.Background()
 	bucket, err := blob.OpenBucket(ctx, "mem://")
@@ -32,7 +138,7 @@ func TestAddJournalClubEmail(t *testing.T) {
 	}
 	defer bucket.Close()
 
-	s, err := NewServer("../../templates", bucket)
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(stubClient(t, networkHandler(t))))
 	if err != nil {
 		t.Fatalf("construct server: %v", err)
 	}
@@ -49,13 +155,16 @@ func TestAddJournalClubEmail(t *testing.T) {
 		t.Errorf("status is %d, expected 201", rec.Code)
 	}
 
-	var resp journalclub.Message
+	var resp AddEmailResponse
 	err = json.NewDecoder(rec.Body).Decode(&resp)
 	if err != nil {
-		t.Errorf("deserialize body into email: %v", err)
+		t.Errorf("deserialize response body: %v", err)
 	}
 
 	timestamp := "2024-10-21T12:45:12Z"
+	if resp.ID != timestamp {
+		t.Errorf("response id is %s, expected %s", resp.ID, timestamp)
+	}
 	expectedDate, err := time.Parse(time.RFC3339, timestamp)
 	if err != nil {
 		t.Errorf("parse date: %v", err)
@@ -69,11 +178,17 @@ func TestAddJournalClubEmail(t *testing.T) {
 		AudioURL:    "https://s3.amazonaws.com/journalclub.io/mqtt-full.mp3",
 		AudioSize:   18218972,
 		PaperURL:    "https://doi.org/10.1109/OJIES.2024.3373232",
+		PaperTitle:  "A Scalable Real-Time SDN-Based MQTT Framework for Industrial Applications",
+		Episode:     1,
+		Persons: []journalclub.Person{
+			{Name: "Ehsan Shahri", Role: "author", Group: "writing"},
+			{Name: "Paulo Pedreiras", Role: "author", Group: "writing"},
+			{Name: "Luis Almeida", Role: "author", Group: "writing"},
+		},
 	}
 
-	if resp != expected {
-		t.Errorf("response does not match expected value:\nhave:    %v\nexpected:%v", resp, expected)
-	}
+	// The audio and paper are fetched in the background
+	waitForTask(t, bucket, "journalclub", timestamp, func(task *Task) bool { return task == nil })
 
 	key := fmt.Sprintf("journalclub/items/%s.json", timestamp)
 	itemReader, err := bucket.NewReader(ctx, key, nil)
@@ -86,8 +201,19 @@ func TestAddJournalClubEmail(t *testing.T) {
 		t.Errorf("deserialize body into email: %v", err)
 	}
 
-	if resp != expected {
-		t.Errorf("stored does not match expected value:\nhave:    %v\nexpected:%v", resp, expected)
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("stored does not match expected value:\nhave:    %v\nexpected:%v", stored, expected)
+	}
+
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/email2rss/journalclub/refresh", nil)
+	if err != nil {
+		t.Fatalf("construct request: %v", err)
+	}
+	req.SetPathValue("feed", "journalclub")
+	s.Refresh(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("refresh status is %d, expected 200", rec.Code)
 	}
 
 	ok, err := bucket.Exists(ctx, "journalclub/feed.xml")
@@ -107,7 +233,7 @@ func TestAddEmail(t *testing.T) {
 	}
 	defer bucket.Close()
 
-	s, err := NewServer("../../templates", bucket)
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})))
 	if err != nil {
 		t.Fatalf("construct server: %v", err)
 	}
@@ -124,26 +250,30 @@ func TestAddEmail(t *testing.T) {
 		t.Errorf("status is %d, expected 201", rec.Code)
 	}
 
-	var resp generic.Message
+	var resp AddEmailResponse
 	err = json.NewDecoder(rec.Body).Decode(&resp)
 	if err != nil {
-		t.Errorf("deserialize body into email: %v", err)
+		t.Errorf("deserialize response body: %v", err)
 	}
 
 	timestamp := "2024-10-21T12:45:12Z"
+	if resp.ID != timestamp {
+		t.Errorf("response id is %s, expected %s", resp.ID, timestamp)
+	}
 	expectedDate, err := time.Parse(time.RFC3339, timestamp)
 	if err != nil {
 		t.Errorf("parse date: %v", err)
 	}
+	msg, err := mail.ReadMessage(strings.NewReader(testEmail))
+	if err != nil {
+		t.Fatalf("parse email: %v", err)
+	}
+	redactor := redact.Redactor{}.ForMessage(msg)
 	expected := generic.Message{
 		UUID:    "4489904c-91ae-4fbf-b4e7-915007267da1",
 		Subject: "A Scalable Real-Time SDN-Based MQTT Framework for Industrial Applications",
 		Date:    expectedDate,
-		Body:    testHTML,
-	}
-
-	if resp != expected {
-		t.Errorf("response does not match expected value:\nhave:    %v\nexpected:%v", resp, expected)
+		Body:    redactor.HTML(privacy.HTML(sanitize.HTML(testHTML), privacy.URL)),
 	}
 
 	key := fmt.Sprintf("test/items/%s.json", timestamp)
@@ -157,8 +287,36 @@ func TestAddEmail(t *testing.T) {
 		t.Errorf("deserialize body into email: %v", err)
 	}
 
-	if resp != expected {
-		t.Errorf("stored does not match expected value:\nhave:    %v\nexpected:%v", resp, expected)
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("stored does not match expected value:\nhave:    %v\nexpected:%v", stored, expected)
+	}
+	for _, tracker := range []string{"click.convertkit-mail2.com", "open.convertkit-mail2.com"} {
+		if strings.Contains(stored.Body, tracker) {
+			t.Errorf("body still contains %s", tracker)
+		}
+	}
+	if !strings.Contains(stored.Body, `href="https://doi.org/10.1109/OJIES.2024.3373232"`) {
+		t.Error("body does not link directly to the paper")
+	}
+	// The subscriber ID from List-Unsubscribe marks the unsubscribe and preferences links
+	for _, secret := range []string{"Connor", "92u9qde2d0fnhq8p7o3c9hz3vmd33aw", ">Unsubscribe<", ">Preferences<"} {
+		if strings.Contains(stored.Body, secret) {
+			t.Errorf("body still contains %s", secret)
+		}
+	}
+	if !strings.Contains(stored.Body, "Hi, today&#39;s article") {
+		t.Error("body does not greet the reader anonymously")
+	}
+
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/email2rss/test/refresh", nil)
+	if err != nil {
+		t.Fatalf("construct request: %v", err)
+	}
+	req.SetPathValue("feed", "test")
+	s.Refresh(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("refresh status is %d, expected 200", rec.Code)
 	}
 
 	ok, err := bucket.Exists(ctx, "test/feed.xml")
@@ -169,3 +327,586 @@ func TestAddEmail(t *testing.T) {
 		t.Error("Expected a new test/feed.xml file")
 	}
 }
+
+// Emails sent from elsewhere than iCloud have no X-Apple-UUID, so their items are identified by key
+func TestAddEmailWithoutUUID(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+
+	for _, feed := range []string{"test", "journalclub"} {
+		email := strings.Replace(testEmail, "X-Apple-UUID: 4489904c-91ae-4fbf-b4e7-915007267da1\r\n", "", 1)
+		if email == testEmail {
+			t.Fatal("test email has no X-Apple-UUID to remove")
+		}
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/email2rss/"+feed+"/email", strings.NewReader(email))
+		req.SetPathValue("feed", feed)
+		s.AddEmail(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("status is %d, expected 201: %s", rec.Code, rec.Body)
+		}
+
+		back, err := s.Backend(feed)
+		if err != nil {
+			t.Fatalf("load backend: %v", err)
+		}
+		err = s.refreshFeed(ctx, back)
+		if err != nil {
+			t.Fatalf("refresh feed %s: %v", feed, err)
+		}
+		b, err := bucket.ReadAll(ctx, feed+"/feed.xml")
+		if err != nil {
+			t.Fatalf("read feed: %v", err)
+		}
+		guid := fmt.Sprintf(`<guid isPermaLink="false">https://connor.zip/email2rss/%s/items/2024-10-21T12:45:12Z</guid>`, feed)
+		if !strings.Contains(string(b), guid) {
+			t.Errorf("feed %s does not contain %s:\n%s", feed, guid, b)
+		}
+	}
+}
+
+func TestAddJournalClubEmailOffline(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/email2rss/journalclub/email", strings.NewReader(testEmail))
+	if err != nil {
+		t.Fatalf("construct request: %v", err)
+	}
+	req.SetPathValue("feed", "journalclub")
+	s.AddEmail(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status is %d, expected 201", rec.Code)
+	}
+
+	itemReader, err := bucket.NewReader(ctx, "journalclub/items/2024-10-21T12:45:12Z.json", nil)
+	if err != nil {
+		t.Fatalf("failed to read from bucket: %v", err)
+	}
+	defer itemReader.Close()
+	var stored journalclub.Message
+	err = json.NewDecoder(itemReader).Decode(&stored)
+	if err != nil {
+		t.Fatalf("deserialize body into email: %v", err)
+	}
+	if stored.AudioURL != "https://s3.amazonaws.com/journalclub.io/mqtt-full.mp3" {
+		t.Errorf("audio url is %s, expected it to be parsed from the email", stored.AudioURL)
+	}
+	if stored.AudioSize != 0 {
+		t.Errorf("audio size is %d, expected it to be left empty when offline", stored.AudioSize)
+	}
+
+	// Enrichment is deferred until the network is available
+	waitForTask(t, bucket, "journalclub", stored.Key(), func(task *Task) bool { return task != nil && task.Attempts > 0 })
+}
+
+func TestEnrichmentRetry(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	var available atomic.Bool
+	handler := networkHandler(t)
+	client := stubClient(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !available.Load() {
+			http.Error(w, "Slow down", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(client))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/email2rss/journalclub/email", strings.NewReader(testEmail))
+	if err != nil {
+		t.Fatalf("construct request: %v", err)
+	}
+	req.SetPathValue("feed", "journalclub")
+	s.AddEmail(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status is %d, expected 201 despite the audio being unavailable", rec.Code)
+	}
+
+	key := "2024-10-21T12:45:12Z"
+	waitForTask(t, bucket, "journalclub", key, func(task *Task) bool { return task != nil && task.Attempts > 0 })
+	task := readTask(t, bucket, "journalclub", key)
+	if task.LastError == "" || !task.NotBefore.After(time.Now()) {
+		t.Errorf("expected the failed task to be rescheduled with its error, have %+v", task)
+	}
+
+	// Not yet due, so nothing happens
+	available.Store(true)
+	err = s.processQueue(ctx, time.Now())
+	if err != nil {
+		t.Fatalf("process queue: %v", err)
+	}
+	if readTask(t, bucket, "journalclub", key) == nil {
+		t.Fatal("task ran before it was due")
+	}
+
+	err = s.processQueue(ctx, task.NotBefore)
+	if err != nil {
+		t.Fatalf("process queue: %v", err)
+	}
+	if task := readTask(t, bucket, "journalclub", key); task != nil {
+		t.Fatalf("expected task to complete, have %+v", task)
+	}
+	b, err := bucket.ReadAll(ctx, "journalclub/items/"+key+".json")
+	if err != nil {
+		t.Fatalf("read item: %v", err)
+	}
+	var stored journalclub.Message
+	err = json.Unmarshal(b, &stored)
+	if err != nil {
+		t.Fatalf("parse item: %v", err)
+	}
+	if stored.AudioSize != 18218972 {
+		t.Errorf("audio size is %d, expected 18218972", stored.AudioSize)
+	}
+}
+
+// The audio's ID3 artwork and title stand in for the image and subject an email doesn't have
+func TestAudioArtwork(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	audio, err := os.ReadFile("../mp3/test/cbr.mp3")
+	if err != nil {
+		t.Fatalf("read audio: %v", err)
+	}
+	client := stubClient(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "episode.mp3", time.Time{}, bytes.NewReader(audio))
+	}))
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(client))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	item := &journalclub.Message{UUID: "episode", Date: time.Date(2024, 11, 3, 13, 55, 35, 0, time.UTC), AudioURL: "https://example.com/episode.mp3"}
+	err = s.writeItem(ctx, "journalclub", item)
+	if err != nil {
+		t.Fatalf("write item: %v", err)
+	}
+	err = s.enqueue(ctx, "journalclub", item.Key())
+	if err != nil {
+		t.Fatalf("enqueue item: %v", err)
+	}
+	waitForTask(t, bucket, "journalclub", item.Key(), func(task *Task) bool { return task == nil })
+
+	b, err := bucket.ReadAll(ctx, "journalclub/items/"+item.Key()+".json")
+	if err != nil {
+		t.Fatalf("read item: %v", err)
+	}
+	var stored journalclub.Message
+	err = json.Unmarshal(b, &stored)
+	if err != nil {
+		t.Fatalf("parse item: %v", err)
+	}
+	if stored.Subject != "Test Episode" {
+		t.Errorf("subject is %q, expected the audio's title", stored.Subject)
+	}
+	name, ok := strings.CutPrefix(stored.ImageURL, "https://connor.zip/email2rss/journalclub/assets/")
+	if !ok {
+		t.Fatalf("image is %q, expected the stored artwork", stored.ImageURL)
+	}
+	artwork, err := bucket.ReadAll(ctx, "journalclub/assets/"+name)
+	if err != nil {
+		t.Fatalf("read artwork: %v", err)
+	}
+	if string(artwork) != "\x89PNG\r\n\x1a\nfakeimage" {
+		t.Errorf("artwork is %q", artwork)
+	}
+}
+
+func TestEnrichmentGivesUp(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	// A task which can't be read doesn't hold up those of other feeds
+	err = bucket.WriteAll(ctx, "digest/queue/broken.json", []byte("{"), nil)
+	if err != nil {
+		t.Fatalf("write task: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/email2rss/journalclub/email", strings.NewReader(testEmail))
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status is %d, expected 201", rec.Code)
+	}
+	key := "2024-10-21T12:45:12Z"
+	waitForTask(t, bucket, "journalclub", key, func(task *Task) bool { return task != nil && task.Attempts > 0 })
+
+	task := readTask(t, bucket, "journalclub", key)
+	task.Attempts = maxEnrichAttempts - 1
+	err = s.writeTask(ctx, task)
+	if err != nil {
+		t.Fatalf("write task: %v", err)
+	}
+	for range 2 {
+		err = s.processQueue(ctx, task.NotBefore)
+		if err != nil {
+			t.Fatalf("process queue: %v", err)
+		}
+	}
+	task = readTask(t, bucket, "journalclub", key)
+	if task == nil || !task.Failed || task.Attempts != maxEnrichAttempts || task.LastError == "" {
+		t.Errorf("expected the task to be abandoned after %d attempts, have %+v", maxEnrichAttempts, task)
+	}
+}
+
+func TestEpisodeNumbers(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	cfg := config.Default()
+	cfg.Feeds = map[string]config.Feed{"journalclub": {Locked: true}}
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})), WithConfig(cfg))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	back, err := s.Backend("journalclub")
+	if err != nil {
+		t.Fatalf("load backend: %v", err)
+	}
+	// Items stored before episodes were numbered, the second sent from a time zone whose key sorts first
+	for i, date := range []time.Time{
+		time.Date(2024, 11, 1, 8, 0, 0, 0, time.UTC),
+		time.Date(2024, 11, 1, 5, 0, 0, 0, time.FixedZone("EST", -5*60*60)),
+	} {
+		err = s.writeItem(ctx, "journalclub", &journalclub.Message{UUID: fmt.Sprint(i), Subject: "Issue", Date: date})
+		if err != nil {
+			t.Fatalf("write item: %v", err)
+		}
+	}
+	episode := func(key string) int {
+		item, err := s.readItem(ctx, back, key)
+		if err != nil {
+			t.Fatalf("read item: %v", err)
+		}
+		return item.(*journalclub.Message).Episode
+	}
+
+	// An email arriving late is numbered after those already published, even when it's replaced
+	for _, target := range []string{"/email2rss/journalclub/email", "/email2rss/journalclub/email?overwrite=true"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(testEmail))
+		req.SetPathValue("feed", "journalclub")
+		s.AddEmail(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("POST %s gave %d: %s", target, rec.Code, rec.Body)
+		}
+		for key, expected := range map[string]int{"2024-11-01T08:00:00Z": 1, "2024-11-01T05:00:00-05:00": 2, "2024-10-21T12:45:12Z": 3} {
+			if n := episode(key); n != expected {
+				t.Errorf("after POST %s, item %s is episode %d, expected %d", target, key, n, expected)
+			}
+		}
+	}
+
+	err = s.refreshFeed(ctx, back)
+	if err != nil {
+		t.Fatalf("refresh feed: %v", err)
+	}
+	feed, err := bucket.ReadAll(ctx, "journalclub/feed.xml")
+	if err != nil {
+		t.Fatalf("read feed: %v", err)
+	}
+	for _, expected := range []string{"<itunes:episode>3</itunes:episode>", "<podcast:locked>yes</podcast:locked>"} {
+		if !strings.Contains(string(feed), expected) {
+			t.Errorf("feed doesn't contain %s:\n%s", expected, feed)
+		}
+	}
+}
+
+func TestPodcastGUID(t *testing.T) {
+	// The scheme and trailing slashes are not part of the name
+	guid := podcastGUID("https://connor.zip/journalclub/feed.xml/")
+	expected := "90ae3f88-240e-54b1-9b06-1eac8b494ded"
+	if guid != expected {
+		t.Errorf("podcast guid is %s, expected %s", guid, expected)
+	}
+}
+
+func TestGetItemSanitized(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+
+	// An item stored before bodies were sanitized at ingest
+	item := &generic.Message{
+		UUID:    "b1946ac9-2a0f-4a5b-9d3e-7f5c1d2e3a4b",
+		Subject: "Unsanitized",
+		Date:    time.Date(2024, 11, 1, 8, 0, 0, 0, time.UTC),
+		Body:    `<p onclick="alert(1)">Hello</p><script>alert(document.cookie)</script><a href="javascript:alert(1)">link</a>`,
+	}
+	err = s.writeItem(ctx, "test", item)
+	if err != nil {
+		t.Fatalf("write item: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodGet, "/email2rss/test/items/"+item.Key(), nil)
+	if err != nil {
+		t.Fatalf("construct request: %v", err)
+	}
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status is %d, expected 200", rec.Code)
+	}
+	expected := `<p>Hello</p><a rel="noopener noreferrer nofollow">link</a>`
+	if body := rec.Body.String(); !strings.Contains(body, expected) || strings.Contains(body, "alert") {
+		t.Errorf("body is %s, expected it to contain %s", body, expected)
+	}
+	csp := rec.Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "default-src 'none'") || strings.Contains(csp, "script-src") {
+		t.Errorf("Content-Security-Policy %q allows script", csp)
+	}
+}
+
+func TestExtraction(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	cfg := &config.Config{BaseURL: "https://example.com", Feeds: map[string]config.Feed{"articles": {Extract: true}}}
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})), WithConfig(cfg))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/email2rss/articles/email", strings.NewReader(testEmail))
+	if err != nil {
+		t.Fatalf("construct request: %v", err)
+	}
+	req.SetPathValue("feed", "articles")
+	s.AddEmail(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status is %d, expected 201", rec.Code)
+	}
+
+	b, err := bucket.ReadAll(ctx, "articles/items/2024-10-21T12:45:12Z.json")
+	if err != nil {
+		t.Fatalf("read item: %v", err)
+	}
+	var stored generic.Message
+	err = json.Unmarshal(b, &stored)
+	if err != nil {
+		t.Fatalf("parse item: %v", err)
+	}
+	if !strings.Contains(stored.Body, "Oompa Loompas in a chocolate factory") {
+		t.Error("body does not contain the article")
+	}
+	for _, boilerplate := range []string{"113 Cherry St", "<style>", "@media"} {
+		if strings.Contains(stored.Body, boilerplate) {
+			t.Errorf("body still contains %s", boilerplate)
+		}
+	}
+
+	back, err := s.Backend("articles")
+	if err != nil {
+		t.Fatalf("load backend: %v", err)
+	}
+	err = s.refreshFeed(ctx, back)
+	if err != nil {
+		t.Fatalf("refresh feed: %v", err)
+	}
+	feed, err := bucket.ReadAll(ctx, "articles/feed.xml")
+	if err != nil {
+		t.Fatalf("read feed: %v", err)
+	}
+	description := "<description>Let’s say you and I are Oompa Loompas in a chocolate factory."
+	if !strings.Contains(string(feed), description) {
+		t.Errorf("feed does not contain %s", description)
+	}
+}
+
+func TestCDATA(t *testing.T) {
+	tests := []struct {
+		in, expected string
+	}{
+		{"<p>a &amp; b</p>", "<![CDATA[<p>a &amp; b</p>]]>"},
+		{"x]]>y", "<![CDATA[x]]]]><![CDATA[>y]]>"},
+		{"form\ffeed", "<![CDATA[formfeed]]>"},
+	}
+	for _, test := range tests {
+		if out := cdata(test.in); out != test.expected {
+			t.Errorf("cdata(%q) is %q, expected %q", test.in, out, test.expected)
+		}
+	}
+}
+
+func TestGenericFeedContent(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+
+	bodies := []string{
+		`<p>Arrays are indexed like a[b[0]]&gt;c, which would end a CDATA section.</p><p>]]></p>`,
+		"<p>Fish &amp; chips</p><p>A stray form feed\f and <b>bold</b> text</p>",
+	}
+	for i, body := range bodies {
+		err = s.writeItem(ctx, "test", &generic.Message{
+			UUID:    fmt.Sprintf("item-%d", i),
+			Subject: fmt.Sprintf("Item <%d> & more", i),
+			Date:    time.Date(2024, 11, 1+i, 8, 0, 0, 0, time.UTC),
+			Body:    body,
+		})
+		if err != nil {
+			t.Fatalf("write item: %v", err)
+		}
+	}
+	back, err := s.Backend("test")
+	if err != nil {
+		t.Fatalf("load backend: %v", err)
+	}
+	err = s.refreshFeed(ctx, back)
+	if err != nil {
+		t.Fatalf("refresh feed: %v", err)
+	}
+	b, err := bucket.ReadAll(ctx, "test/feed.xml")
+	if err != nil {
+		t.Fatalf("read feed: %v", err)
+	}
+
+	var feed struct {
+		Items []struct {
+			Title       string `xml:"title"`
+			Description string `xml:"description"`
+			Content     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+		} `xml:"channel>item"`
+	}
+	err = xml.Unmarshal(b, &feed)
+	if err != nil {
+		t.Fatalf("feed is not valid XML: %v\n%s", err, b)
+	}
+	if len(feed.Items) != len(bodies) {
+		t.Fatalf("feed has %d items, expected %d", len(feed.Items), len(bodies))
+	}
+	// Items are newest first
+	for i, item := range feed.Items {
+		body := bodies[len(bodies)-1-i]
+		if expected := strings.ReplaceAll(sanitize.HTML(body), "\f", ""); item.Content != expected {
+			t.Errorf("content:encoded is %q, expected %q", item.Content, expected)
+		}
+		if item.Description == "" || strings.Contains(item.Description, "<") {
+			t.Errorf("description %q is not a plain text excerpt", item.Description)
+		}
+	}
+	if feed.Items[1].Title != "Item <0> & more" {
+		t.Errorf("title is %q, expected %q", feed.Items[1].Title, "Item <0> & more")
+	}
+	if feed.Items[1].Description != "Arrays are indexed like a[b[0]]>c, which would end a CDATA section. ]]>" {
+		t.Errorf("description is %q", feed.Items[1].Description)
+	}
+}
+
+func TestRefreshRefusesInvalidFeed(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(fetch.Options{Offline: true})))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	back, err := s.Backend("test")
+	if err != nil {
+		t.Fatalf("load backend: %v", err)
+	}
+
+	item := &generic.Message{UUID: "item", Subject: "First", Date: time.Date(2024, 11, 1, 8, 0, 0, 0, time.UTC), Body: "<p>First</p>"}
+	err = s.writeItem(ctx, "test", item)
+	if err != nil {
+		t.Fatalf("write item: %v", err)
+	}
+	err = s.refreshFeed(ctx, back)
+	if err != nil {
+		t.Fatalf("refresh feed: %v", err)
+	}
+	published, err := bucket.ReadAll(ctx, "test/feed.xml")
+	if err != nil {
+		t.Fatalf("read feed: %v", err)
+	}
+
+	// A second item with the same GUID makes the feed invalid
+	err = s.writeItem(ctx, "test", &generic.Message{UUID: "item", Subject: "Second", Date: item.Date.Add(24 * time.Hour), Body: "<p>Second</p>"})
+	if err != nil {
+		t.Fatalf("write item: %v", err)
+	}
+	err = s.refreshFeed(ctx, back)
+	var problems validate.Problems
+	if !errors.As(err, &problems) {
+		t.Fatalf("refresh gave %v, expected validation problems", err)
+	}
+	b, err := bucket.ReadAll(ctx, "test/feed.xml")
+	if err != nil {
+		t.Fatalf("read feed: %v", err)
+	}
+	if !bytes.Equal(b, published) {
+		t.Errorf("invalid feed replaced the published feed:\n%s", b)
+	}
+}
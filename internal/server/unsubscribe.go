@@ -0,0 +1,403 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cptaffe/email2rss/internal/sender"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// oneClickBody is the form RFC 8058 one-click unsubscription POSTs, as given in List-Unsubscribe-Post
+const oneClickBody = "List-Unsubscribe=One-Click"
+
+// ErrNoUnsubscribe is returned when a sender doesn't offer a way to unsubscribe which can be automated
+var ErrNoUnsubscribe = errors.New("no supported way to unsubscribe")
+
+// Subscription is how to unsubscribe from one of the senders of a feed's email, as given by the
+// List-Unsubscribe headers of the latest email it sent, stored under {feed}/subscriptions/
+type Subscription struct {
+	Feed string `json:"feed"`
+	// Sender is the address the email is from
+	Sender string `json:"sender"`
+	// Unsubscribe are the URIs of the List-Unsubscribe header, https: or mailto:
+	Unsubscribe []string `json:"unsubscribe"`
+	// OneClick is set if the sender supports RFC 8058 one-click unsubscription by POSTing to its https: URI
+	OneClick bool      `json:"oneClick,omitempty"`
+	Seen     time.Time `json:"seen"`
+	// Unsubscribed is when unsubscribing last succeeded, with Method being one-click or mailto
+	Unsubscribed *time.Time `json:"unsubscribed,omitempty"`
+	Method       string     `json:"method,omitempty"`
+	// LastError is why unsubscribing last failed
+	LastError string `json:"lastError,omitempty"`
+}
+
+func subscriptionKey(feed, sender string) string {
+	return fmt.Sprintf("%s/subscriptions/%s.json", feed, sender)
+}
+
+// recordSubscription keeps the List-Unsubscribe headers of an email, if it has them, for its sender.
+// Unless the sender was authenticated, only URIs within the domain the email claims to be from are
+// kept, so that forged email can't have unsubscribing POST or mail wherever it likes.
+func (s *Server) recordSubscription(ctx context.Context, feed string, msg *mail.Message, verdict *sender.Verdict) error {
+	header := msg.Header.Get("List-Unsubscribe")
+	if header == "" {
+		return nil
+	}
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return fmt.Errorf("parse From header: %w", err)
+	}
+	address := strings.ToLower(from[0].Address)
+	if strings.ContainsAny(address, "/?#") {
+		return fmt.Errorf("invalid sender %q", address)
+	}
+	_, domain, _ := strings.Cut(address, "@")
+
+	var uris []string
+	for _, uri := range listURIs(header) {
+		if !strings.HasPrefix(uri, "https:") && !strings.HasPrefix(uri, "http:") && !strings.HasPrefix(uri, "mailto:") {
+			continue
+		}
+		if verdict == nil && !uriWithin(uri, domain) {
+			log.Printf("ignore List-Unsubscribe URI %s of unauthenticated sender %s to feed %s", uri, address, feed)
+			continue
+		}
+		uris = append(uris, uri)
+	}
+	if len(uris) == 0 {
+		return nil
+	}
+
+	sub, err := s.readSubscription(ctx, feed, address)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		sub = &Subscription{Feed: feed, Sender: address}
+	} else if err != nil {
+		return err
+	}
+	sub.Unsubscribe = uris
+	sub.OneClick = strings.EqualFold(strings.TrimSpace(msg.Header.Get("List-Unsubscribe-Post")), oneClickBody)
+	sub.Seen = time.Now().UTC()
+	return s.writeSubscription(ctx, sub)
+}
+
+// listURIs splits a List-Unsubscribe header into its URIs, which are each enclosed in angle brackets
+// and may themselves contain commas, as a mailto: URI listing several recipients does
+func listURIs(header string) []string {
+	var uris []string
+	for {
+		_, rest, ok := strings.Cut(header, "<")
+		if !ok {
+			return uris
+		}
+		uri, after, ok := strings.Cut(rest, ">")
+		if !ok {
+			return uris
+		}
+		uris = append(uris, strings.TrimSpace(uri))
+		header = after
+	}
+}
+
+// uriWithin reports whether the host of an http: or https: URI, or every address of a mailto: URI,
+// is within a domain or one of its parents, allowing for senders on a subdomain of the list's domain
+func uriWithin(uri, domain string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || domain == "" {
+		return false
+	}
+	var hosts []string
+	if u.Scheme == "mailto" {
+		addrs, err := mailtoAddresses(u)
+		if err != nil {
+			return false
+		}
+		for _, addr := range addrs {
+			_, host, _ := strings.Cut(addr.Address, "@")
+			hosts = append(hosts, host)
+		}
+	} else {
+		hosts = append(hosts, u.Hostname())
+	}
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		if host == "" || !withinDomain(host, domain) && !withinDomain(domain, host) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) readSubscription(ctx context.Context, feed, sender string) (*Subscription, error) {
+	b, err := s.bucket.ReadAll(ctx, subscriptionKey(feed, sender))
+	if err != nil {
+		return nil, fmt.Errorf("read subscription file: %w", err)
+	}
+	var sub Subscription
+	err = json.Unmarshal(b, &sub)
+	if err != nil {
+		return nil, fmt.Errorf("parse subscription file of %s: %w", sender, err)
+	}
+	return &sub, nil
+}
+
+func (s *Server) writeSubscription(ctx context.Context, sub *Subscription) error {
+	b, err := json.Marshal(sub)
+	if err != nil {
+		return fmt.Errorf("encode subscription: %w", err)
+	}
+	err = s.bucket.WriteAll(ctx, subscriptionKey(sub.Feed, sub.Sender), b, &blob.WriterOptions{ContentType: "application/json;charset=UTF-8"})
+	if err != nil {
+		return fmt.Errorf("write subscription file: %w", err)
+	}
+	return nil
+}
+
+// Subscriptions lists the senders of a feed's email which can be unsubscribed from
+func (s *Server) Subscriptions(ctx context.Context, feed string) ([]*Subscription, error) {
+	var subs []*Subscription
+	iter := s.bucket.List(&blob.ListOptions{Prefix: fmt.Sprintf("%s/subscriptions/", feed)})
+	for {
+		obj, err := iter.Next(ctx)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("list subscriptions: %w", err)
+		}
+		sender := strings.TrimSuffix(strings.TrimPrefix(obj.Key, fmt.Sprintf("%s/subscriptions/", feed)), ".json")
+		sub, err := s.readSubscription(ctx, feed, sender)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// unsubscribe unsubscribes from a sender by one-click POST if it supports it, or otherwise by
+// mailing its mailto: URI through the configured relay, recording the outcome
+func (s *Server) unsubscribe(ctx context.Context, sub *Subscription) error {
+	var method string
+	err := ErrNoUnsubscribe
+	if i := slices.IndexFunc(sub.Unsubscribe, func(uri string) bool { return strings.HasPrefix(uri, "https:") }); sub.OneClick && i >= 0 {
+		method = "one-click"
+		err = s.oneClick(ctx, sub.Unsubscribe[i])
+	} else if i := slices.IndexFunc(sub.Unsubscribe, func(uri string) bool { return strings.HasPrefix(uri, "mailto:") }); i >= 0 && s.config.SMTP != nil {
+		method = "mailto"
+		err = s.mailto(ctx, sub.Unsubscribe[i])
+	}
+	if err != nil {
+		sub.LastError = err.Error()
+	} else {
+		now := time.Now().UTC()
+		sub.Unsubscribed = &now
+		sub.Method = method
+		sub.LastError = ""
+	}
+	if werr := s.writeSubscription(ctx, sub); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// oneClick POSTs to a one-click unsubscribe URI as RFC 8058 describes
+func (s *Server) oneClick(ctx context.Context, uri string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, strings.NewReader(oneClickBody))
+	if err != nil {
+		return fmt.Errorf("construct request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post one-click unsubscribe: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("one-click unsubscribe answered %s", resp.Status)
+	}
+	return nil
+}
+
+// mailto sends the email a mailto: URI describes, with its subject and body if it gives them, through the relay
+func (s *Server) mailto(ctx context.Context, uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("parse mailto URI: %w", err)
+	}
+	addrs, err := mailtoAddresses(u)
+	if err != nil {
+		return fmt.Errorf("parse mailto addresses: %w", err)
+	}
+	query := u.Query()
+	subject := query.Get("subject")
+	if subject == "" {
+		subject = "unsubscribe"
+	}
+	relay := s.config.SMTP
+	_, domain, _ := strings.Cut(relay.From, "@")
+	// Each recipient is sent their own request, as they were each checked to be within the sender's domain
+	for _, addr := range addrs {
+		var nonce [8]byte
+		rand.Read(nonce[:])
+		var msg strings.Builder
+		fmt.Fprintf(&msg, "From: %s\r\n", relay.From)
+		fmt.Fprintf(&msg, "To: %s\r\n", addr.Address)
+		fmt.Fprintf(&msg, "Subject: %s\r\n", strings.NewReplacer("\r", "", "\n", "").Replace(subject))
+		fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+		fmt.Fprintf(&msg, "Message-ID: <%x@%s>\r\n", nonce, domain)
+		fmt.Fprintf(&msg, "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n")
+		msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(query.Get("body"), "\r\n", "\n"), "\n", "\r\n"))
+		msg.WriteString("\r\n")
+		err = sendMail(ctx, relay.Addr, relay.Username, relay.Password, relay.From, addr.Address, msg.String())
+		if err != nil {
+			return fmt.Errorf("mail %s: %w", addr.Address, err)
+		}
+	}
+	return nil
+}
+
+// mailtoAddresses parses the recipients of a mailto: URI, which may list several separated by commas
+func mailtoAddresses(u *url.URL) ([]*mail.Address, error) {
+	to, err := url.PathUnescape(u.Opaque)
+	if err != nil {
+		return nil, err
+	}
+	return mail.ParseAddressList(to)
+}
+
+// sendMail sends a message through an SMTP relay, bounded by the context's deadline
+func sendMail(ctx context.Context, relay, username, password, from, to, msg string) error {
+	host, _, err := net.SplitHostPort(relay)
+	if err != nil {
+		return fmt.Errorf("parse relay address: %w", err)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", relay)
+	if err != nil {
+		return fmt.Errorf("dial relay: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("greet relay: %w", err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return fmt.Errorf("start TLS with relay: %w", err)
+		}
+	}
+	if username != "" {
+		err = c.Auth(smtp.PlainAuth("", username, password, host))
+		if err != nil {
+			return fmt.Errorf("authenticate with relay: %w", err)
+		}
+	}
+	err = c.Mail(from)
+	if err != nil {
+		return fmt.Errorf("send MAIL: %w", err)
+	}
+	err = c.Rcpt(to)
+	if err != nil {
+		return fmt.Errorf("send RCPT: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("send DATA: %w", err)
+	}
+	_, err = io.WriteString(w, msg)
+	if err != nil {
+		return fmt.Errorf("write message: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("send message: %w", err)
+	}
+	return c.Quit()
+}
+
+func (s *Server) GetSubscriptions(w http.ResponseWriter, req *http.Request) {
+	subs, err := s.Subscriptions(req.Context(), req.PathValue("feed"))
+	if err != nil {
+		http.Error(w, "Could not list subscriptions", http.StatusInternalServerError)
+		log.Printf("list subscriptions: %v", err)
+		return
+	}
+	if subs == nil {
+		subs = []*Subscription{}
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	err = json.NewEncoder(w).Encode(subs)
+	if err != nil {
+		log.Printf("write subscriptions: %v", err)
+	}
+}
+
+// Unsubscribe unsubscribes from one sender of a feed's email, or every sender which hasn't been
+// unsubscribed from if none is given, answering with the outcome for each
+func (s *Server) Unsubscribe(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	feed := req.PathValue("feed")
+	var subs []*Subscription
+	if sender := req.PathValue("sender"); sender != "" {
+		sub, err := s.readSubscription(ctx, feed, strings.ToLower(sender))
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			http.Error(w, "No such sender", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not read subscription", http.StatusInternalServerError)
+			log.Printf("read subscription: %v", err)
+			return
+		}
+		subs = []*Subscription{sub}
+	} else {
+		var err error
+		subs, err = s.Subscriptions(ctx, feed)
+		if err != nil {
+			http.Error(w, "Could not list subscriptions", http.StatusInternalServerError)
+			log.Printf("list subscriptions: %v", err)
+			return
+		}
+		subs = slices.DeleteFunc(subs, func(sub *Subscription) bool { return sub.Unsubscribed != nil })
+	}
+
+	for _, sub := range subs {
+		err := s.unsubscribe(ctx, sub)
+		if err != nil {
+			log.Printf("unsubscribe feed %s from %s: %v", feed, sub.Sender, err)
+			continue
+		}
+		log.Printf("unsubscribed feed %s from %s by %s", feed, sub.Sender, sub.Method)
+	}
+	if subs == nil {
+		subs = []*Subscription{}
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	err := json.NewEncoder(w).Encode(subs)
+	if err != nil {
+		log.Printf("write subscriptions: %v", err)
+	}
+}
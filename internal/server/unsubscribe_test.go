@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cptaffe/email2rss/internal/config"
+	"gocloud.dev/blob"
+)
+
+// smtpMessage is what the fake relay was asked to deliver
+type smtpMessage struct {
+	from, to, data string
+}
+
+// serveSMTP runs a fake SMTP relay which accepts any message, sending each to the channel
+func serveSMTP(t *testing.T) (string, <-chan smtpMessage) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	messages := make(chan smtpMessage, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tp := textproto.NewConn(conn)
+				tp.PrintfLine("220 relay.example.com ESMTP")
+				var msg smtpMessage
+				for {
+					line, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+					verb, arg, _ := strings.Cut(line, " ")
+					switch strings.ToUpper(verb) {
+					case "EHLO", "HELO":
+						tp.PrintfLine("250 relay.example.com")
+					case "MAIL":
+						msg.from = arg
+						tp.PrintfLine("250 OK")
+					case "RCPT":
+						msg.to = arg
+						tp.PrintfLine("250 OK")
+					case "DATA":
+						tp.PrintfLine("354 Go ahead")
+						b, err := io.ReadAll(tp.DotReader())
+						if err != nil {
+							return
+						}
+						msg.data = string(b)
+						messages <- msg
+						tp.PrintfLine("250 OK")
+					case "QUIT":
+						tp.PrintfLine("221 Bye")
+						return
+					default:
+						tp.PrintfLine("502 Not implemented")
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), messages
+}
+
+func TestUnsubscribe(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	oneClicks := make(chan string, 10)
+	newsletter := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		oneClicks <- fmt.Sprintf("%s %s %s %s", req.Method, req.URL.RequestURI(), req.Header.Get("Content-Type"), b)
+	}))
+	defer newsletter.Close()
+	relay, mailed := serveSMTP(t)
+
+	cfg := config.Default()
+	cfg.Admin = testAdmin
+	cfg.SMTP = &config.SMTP{Addr: relay, From: "feeds@connor.zip"}
+	cfg.RelayAccess = map[string]*config.Access{"mx.example.org": {Tokens: []string{"relay-token"}}}
+	cfg.Feeds = map[string]config.Feed{"digest": {Senders: &config.Senders{Domains: []string{"example.com", "example.net", "example.org"}}}}
+	s, err := NewServer(ctx, "../../templates", bucket, WithHTTPClient(newsletter.Client()), WithConfig(cfg))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := asAdmin(httptest.NewRequest(method, path, strings.NewReader(body)))
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+	decode := func(rec *httptest.ResponseRecorder) map[string]*Subscription {
+		var subs []*Subscription
+		err := json.NewDecoder(rec.Body).Decode(&subs)
+		if err != nil {
+			t.Fatalf("decode subscriptions: %v", err)
+		}
+		bySender := map[string]*Subscription{}
+		for _, sub := range subs {
+			bySender[sub.Sender] = sub
+		}
+		return bySender
+	}
+
+	// The senders are authenticated, so their URIs are believed wherever they point
+	for i, headers := range []string{
+		"Authentication-Results: mx.example.org; dmarc=pass header.from=news.example.com\r\n" +
+			"From: Weekly Digest <Digest@news.example.com>\r\n" +
+			"List-Unsubscribe: <mailto:unsub@news.example.com>, <" + newsletter.URL + "/unsubscribe?id=42>\r\n" +
+			"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n",
+		"Authentication-Results: mx.example.org; dmarc=pass header.from=example.com\r\n" +
+			"From: Reports <reports@example.com>\r\n" +
+			"List-Unsubscribe: <mailto:leave%2B42@lists.example.com,owner@lists.example.com?subject=unsubscribe%20me&body=please>\r\n",
+		"Authentication-Results: mx.example.org; dmarc=pass header.from=example.net\r\n" +
+			"From: Other <other@example.net>\r\n" +
+			"List-Unsubscribe: <https://example.net/preferences>\r\n",
+		"Authentication-Results: mx.example.org; dmarc=pass header.from=example.org\r\n" +
+			"From: Friend <friend@example.org>\r\n",
+	} {
+		email := headers +
+			fmt.Sprintf("Date: Sun, 03 Nov 2024 13:5%d:00 +0000\r\n", i) +
+			"Subject: News\r\nContent-Type: text/html\r\n\r\n<p>News</p>"
+		if rec := do(http.MethodPost, "/email2rss/digest/email?token=relay-token", email); rec.Code != http.StatusCreated {
+			t.Fatalf("email %d gave %d: %s", i, rec.Code, rec.Body)
+		}
+	}
+	subs := decode(do(http.MethodGet, "/email2rss/digest/subscriptions", ""))
+	if len(subs) != 3 || !subs["digest@news.example.com"].OneClick || subs["reports@example.com"].OneClick {
+		t.Fatalf("subscriptions are %+v", subs)
+	}
+
+	// Only admins see or unsubscribe from subscriptions, and no one does without admin configured
+	for admin, code := range map[*config.Access]int{testAdmin: http.StatusUnauthorized, nil: http.StatusForbidden} {
+		s.config.Admin = admin
+		for _, req := range []*http.Request{
+			httptest.NewRequest(http.MethodGet, "/email2rss/digest/subscriptions", nil),
+			httptest.NewRequest(http.MethodPost, "/email2rss/digest/subscriptions/digest@news.example.com/unsubscribe", nil),
+			httptest.NewRequest(http.MethodPost, "/email2rss/digest/unsubscribe", nil),
+		} {
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != code {
+				t.Errorf("%s %s without credentials gave %d, expected %d", req.Method, req.URL, rec.Code, code)
+			}
+		}
+	}
+	s.config.Admin = testAdmin
+
+	// Senders supporting one-click unsubscription are POSTed to
+	rec := do(http.MethodPost, "/email2rss/digest/subscriptions/digest@news.example.com/unsubscribe", "")
+	subs = decode(rec)
+	if sub := subs["digest@news.example.com"]; sub == nil || sub.Method != "one-click" || sub.Unsubscribed == nil {
+		t.Errorf("unsubscribing gave %+v", sub)
+	}
+	if post := <-oneClicks; post != "POST /unsubscribe?id=42 application/x-www-form-urlencoded List-Unsubscribe=One-Click" {
+		t.Errorf("one-click unsubscribe was %q", post)
+	}
+
+	// Unsubscribing the feed covers the rest, mailing those which only have a mailto: URI
+	subs = decode(do(http.MethodPost, "/email2rss/digest/unsubscribe", ""))
+	if len(subs) != 2 {
+		t.Fatalf("unsubscribed from %+v, expected the remaining two", subs)
+	}
+	if sub := subs["reports@example.com"]; sub.Method != "mailto" || sub.Unsubscribed == nil {
+		t.Errorf("unsubscribing gave %+v", sub)
+	}
+	// Each of the URI's recipients is mailed
+	for _, to := range []string{"TO:<leave+42@lists.example.com>", "TO:<owner@lists.example.com>"} {
+		msg := <-mailed
+		if msg.from != "FROM:<feeds@connor.zip>" || msg.to != to ||
+			!strings.Contains(msg.data, "Subject: unsubscribe me\n") || !strings.HasSuffix(msg.data, "\nplease\n") {
+			t.Errorf("unsubscribe email was %+v, expected it %s", msg, to)
+		}
+	}
+	if sub := subs["other@example.net"]; sub.Unsubscribed != nil || !strings.Contains(sub.LastError, ErrNoUnsubscribe.Error()) {
+		t.Errorf("unsubscribing without a supported method gave %+v", sub)
+	}
+
+	if rec = do(http.MethodPost, "/email2rss/digest/subscriptions/friend@example.org/unsubscribe", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unsubscribing from unknown sender gave %d, expected 404", rec.Code)
+	}
+	select {
+	case post := <-oneClicks:
+		t.Errorf("unexpected one-click unsubscribe %q", post)
+	case msg := <-mailed:
+		t.Errorf("unexpected unsubscribe email %+v", msg)
+	default:
+	}
+
+	// Otherwise only URIs within the domain the email claims to be from are kept
+	for i, headers := range []string{
+		"From: Weekly Digest <digest@news.example.com>\r\n" +
+			"List-Unsubscribe: <https://tracker.example.net/unsubscribe>, <mailto:leave@example.com>\r\n",
+		"From: Bank <alerts@bank.example>\r\n" +
+			"List-Unsubscribe: <https://attacker.example/collect>, <mailto:unsub@attacker.example,alerts@bank.example>\r\n",
+	} {
+		email := headers +
+			fmt.Sprintf("Date: Sun, 03 Nov 2024 14:0%d:00 +0000\r\n", i) +
+			"Subject: News\r\nContent-Type: text/html\r\n\r\n<p>News</p>"
+		if rec := do(http.MethodPost, "/email2rss/unverified/email", email); rec.Code != http.StatusCreated {
+			t.Fatalf("email %d gave %d: %s", i, rec.Code, rec.Body)
+		}
+	}
+	subs = decode(do(http.MethodGet, "/email2rss/unverified/subscriptions", ""))
+	if sub := subs["digest@news.example.com"]; len(subs) != 1 || sub == nil || !slices.Equal(sub.Unsubscribe, []string{"mailto:leave@example.com"}) {
+		t.Errorf("unverified subscriptions are %+v", subs)
+	}
+}
@@ -0,0 +1,345 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/cptaffe/email2rss/internal/config"
+	"gocloud.dev/blob"
+)
+
+const (
+	// deliveryInterval is how often the delivery log is checked for deliveries due to be retried
+	deliveryInterval = time.Minute
+	// maxDeliveryBackoff caps the delay between attempts to deliver to a webhook
+	maxDeliveryBackoff = 6 * time.Hour
+	// maxDeliveryAttempts is how many times a delivery is attempted before giving up, about two days
+	maxDeliveryAttempts = 15
+	// deliveryRetention is how long finished deliveries are kept in the log
+	deliveryRetention = 30 * 24 * time.Hour
+	// redeliveryClaim holds redeliveries back from the deliverer while they're attempted on request,
+	// outlasting the client's timeout so that they aren't sent twice
+	redeliveryClaim = 5 * time.Minute
+)
+
+// Events sent to webhooks in the X-Email2rss-Event header
+const (
+	// EventCreated is sent when an email adds an item
+	EventCreated = "item.created"
+	// EventUpdated is sent when an item is enriched with data from the network
+	EventUpdated = "item.updated"
+	// EventRedelivered is sent when an item is redelivered on request
+	EventRedelivered = "item.redelivered"
+)
+
+// Delivery is an item sent to a webhook, stored under {feed}/deliveries/ as a log
+// and retried with backoff until the webhook accepts it
+type Delivery struct {
+	ID        string    `json:"id"`
+	Feed      string    `json:"feed"`
+	Key       string    `json:"key"`
+	Event     string    `json:"event"`
+	URL       string    `json:"url"`
+	Created   time.Time `json:"created"`
+	Attempts  int       `json:"attempts"`
+	NotBefore time.Time `json:"notBefore"`
+	// Status is the webhook's last response, if it answered
+	Status    int        `json:"status,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+	Delivered *time.Time `json:"delivered,omitempty"`
+	// Failed is set once the delivery has been abandoned
+	Failed bool `json:"failed,omitempty"`
+}
+
+// Done reports whether the delivery won't be attempted again
+func (d *Delivery) Done() bool {
+	return d.Delivered != nil || d.Failed
+}
+
+func deliveryKey(feed, id string) string {
+	return fmt.Sprintf("%s/deliveries/%s.json", feed, id)
+}
+
+// sign computes the X-Email2rss-Signature of a payload
+func sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhook finds the configured webhook a delivery is addressed to
+func (s *Server) webhook(feed, url string) (config.Webhook, bool) {
+	webhooks := s.config.Feed(feed).Webhooks
+	i := slices.IndexFunc(webhooks, func(w config.Webhook) bool { return w.URL == url })
+	if i < 0 {
+		return config.Webhook{}, false
+	}
+	return webhooks[i], true
+}
+
+// newDeliveries logs a delivery of an item to each of the feed's webhooks, which the deliverer
+// won't attempt before notBefore
+func (s *Server) newDeliveries(ctx context.Context, feed, key, event string, notBefore time.Time) ([]*Delivery, error) {
+	var deliveries []*Delivery
+	now := time.Now().UTC()
+	for _, webhook := range s.config.Feed(feed).Webhooks {
+		var nonce [4]byte
+		rand.Read(nonce[:])
+		d := &Delivery{
+			ID:        fmt.Sprintf("%s-%x", now.Format(versionLayout), nonce),
+			Feed:      feed,
+			Key:       key,
+			Event:     event,
+			URL:       webhook.URL,
+			Created:   now,
+			NotBefore: notBefore,
+		}
+		err := s.writeDelivery(ctx, d)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+// fireWebhooks schedules delivery of an item which has been written to the feed's webhooks
+func (s *Server) fireWebhooks(ctx context.Context, feed, key, event string) {
+	deliveries, err := s.newDeliveries(ctx, feed, key, event, time.Time{})
+	if err != nil {
+		log.Printf("schedule webhook deliveries of item %s of feed %s: %v", key, feed, err)
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+	// Wake the deliverer without blocking if it's already been woken
+	select {
+	case s.deliveries <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Server) writeDelivery(ctx context.Context, d *Delivery) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("encode delivery: %w", err)
+	}
+	err = s.bucket.WriteAll(ctx, deliveryKey(d.Feed, d.ID), b, &blob.WriterOptions{ContentType: "application/json;charset=UTF-8"})
+	if err != nil {
+		return fmt.Errorf("write delivery file: %w", err)
+	}
+	return nil
+}
+
+// Deliveries lists the delivery log of a feed, newest first
+func (s *Server) Deliveries(ctx context.Context, feed string) ([]*Delivery, error) {
+	var deliveries []*Delivery
+	iter := s.bucket.List(&blob.ListOptions{Prefix: fmt.Sprintf("%s/deliveries/", feed)})
+	for {
+		obj, err := iter.Next(ctx)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("list deliveries: %w", err)
+		}
+		b, err := s.bucket.ReadAll(ctx, obj.Key)
+		if err != nil {
+			return nil, fmt.Errorf("read delivery file: %w", err)
+		}
+		var d Delivery
+		err = json.Unmarshal(b, &d)
+		if err != nil {
+			return nil, fmt.Errorf("parse delivery file %s: %w", obj.Key, err)
+		}
+		deliveries = append(deliveries, &d)
+	}
+	slices.Reverse(deliveries)
+	return deliveries, nil
+}
+
+// Deliverer sends items to webhooks whenever they're written and periodically to retry failures
+func (s *Server) Deliverer(ctx context.Context) {
+	ticker := time.NewTicker(deliveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.deliveries:
+		case <-ticker.C:
+		}
+		err := s.processDeliveries(ctx, time.Now())
+		if err != nil {
+			log.Printf("process webhook deliveries: %v", err)
+		}
+	}
+}
+
+// processDeliveries attempts every delivery which is due at now, and prunes old ones from the log
+func (s *Server) processDeliveries(ctx context.Context, now time.Time) error {
+	feeds, err := s.feeds(ctx)
+	if err != nil {
+		return err
+	}
+	for _, feed := range feeds {
+		deliveries, err := s.Deliveries(ctx, feed)
+		if err != nil {
+			return err
+		}
+		for _, d := range deliveries {
+			if d.Done() {
+				if now.Sub(d.Created) > deliveryRetention {
+					err = s.bucket.Delete(ctx, deliveryKey(d.Feed, d.ID))
+					if err != nil {
+						return fmt.Errorf("delete old delivery file: %w", err)
+					}
+				}
+				continue
+			}
+			if d.NotBefore.After(now) {
+				continue
+			}
+			err = s.attemptDelivery(ctx, d, now)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// attemptDelivery sends an item to a webhook and records the outcome in the delivery log,
+// scheduling a retry if it fails
+func (s *Server) attemptDelivery(ctx context.Context, d *Delivery, now time.Time) error {
+	d.Attempts++
+	status, err := s.deliver(ctx, d)
+	d.Status = status
+	switch {
+	case err == nil:
+		delivered := now.UTC()
+		d.Delivered = &delivered
+		d.LastError = ""
+	case d.Attempts >= maxDeliveryAttempts:
+		log.Printf("abandon delivery of item %s of feed %s to %s: %v", d.Key, d.Feed, d.URL, err)
+		d.LastError = err.Error()
+		d.Failed = true
+	default:
+		log.Printf("deliver item %s of feed %s to %s: %v", d.Key, d.Feed, d.URL, err)
+		d.LastError = err.Error()
+		d.NotBefore = now.Add(min(deliveryInterval<<min(d.Attempts, 16), maxDeliveryBackoff))
+	}
+	err = s.writeDelivery(ctx, d)
+	if err != nil {
+		return fmt.Errorf("record delivery: %w", err)
+	}
+	return nil
+}
+
+// deliver POSTs an item's JSON to a webhook, signed with the webhook's secret,
+// returning the status the webhook answered with
+func (s *Server) deliver(ctx context.Context, d *Delivery) (int, error) {
+	webhook, ok := s.webhook(d.Feed, d.URL)
+	if !ok {
+		return 0, fmt.Errorf("webhook is no longer configured")
+	}
+	payload, err := s.bucket.ReadAll(ctx, fmt.Sprintf("%s/items/%s.json", d.Feed, d.Key))
+	if err != nil {
+		return 0, fmt.Errorf("read item: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, fmt.Errorf("construct request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json;charset=UTF-8")
+	req.Header.Set("X-Email2rss-Event", d.Event)
+	req.Header.Set("X-Email2rss-Feed", d.Feed)
+	req.Header.Set("X-Email2rss-Item", d.Key)
+	req.Header.Set("X-Email2rss-Delivery", d.ID)
+	if webhook.Secret != "" {
+		req.Header.Set("X-Email2rss-Signature", sign(webhook.Secret, payload))
+	}
+	resp, err := s.webhookClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("POST webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// GetDeliveries serves a feed's webhook delivery log
+func (s *Server) GetDeliveries(w http.ResponseWriter, req *http.Request) {
+	deliveries, err := s.Deliveries(req.Context(), req.PathValue("feed"))
+	if err != nil {
+		http.Error(w, "Could not list deliveries", http.StatusInternalServerError)
+		log.Printf("list deliveries: %v", err)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []*Delivery{}
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	err = json.NewEncoder(w).Encode(deliveries)
+	if err != nil {
+		log.Printf("write deliveries: %v", err)
+	}
+}
+
+// Redeliver sends an item to each of the feed's webhooks straight away, answering with
+// the outcome of each delivery. Failures are retried like any other delivery.
+func (s *Server) Redeliver(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	feed := req.PathValue("feed")
+	key := req.PathValue("key")
+	exists, err := s.bucket.Exists(ctx, fmt.Sprintf("%s/items/%s.json", feed, key))
+	if err != nil {
+		http.Error(w, "Could not check if item exists", http.StatusInternalServerError)
+		log.Printf("check if item exists: %v", err)
+		return
+	}
+	if !exists {
+		http.Error(w, "No such item", http.StatusNotFound)
+		return
+	}
+	if len(s.config.Feed(feed).Webhooks) == 0 {
+		http.Error(w, "Feed has no webhooks", http.StatusNotFound)
+		return
+	}
+
+	// The deliveries are claimed until they've been attempted here, so that the deliverer doesn't send them too
+	deliveries, err := s.newDeliveries(ctx, feed, key, EventRedelivered, time.Now().Add(redeliveryClaim))
+	if err != nil {
+		http.Error(w, "Could not schedule deliveries", http.StatusInternalServerError)
+		log.Printf("schedule webhook deliveries: %v", err)
+		return
+	}
+	for _, d := range deliveries {
+		err = s.attemptDelivery(ctx, d, time.Now())
+		if err != nil {
+			http.Error(w, "Could not deliver item", http.StatusInternalServerError)
+			log.Printf("deliver item: %v", err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	err = json.NewEncoder(w).Encode(deliveries)
+	if err != nil {
+		log.Printf("write deliveries: %v", err)
+	}
+}
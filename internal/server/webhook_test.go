@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cptaffe/email2rss/internal/config"
+	"github.com/cptaffe/email2rss/internal/fetch"
+	"github.com/cptaffe/email2rss/internal/generic"
+	"gocloud.dev/blob"
+)
+
+func TestWebhooks(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	var s *Server
+	var raced atomic.Bool
+	received := make(chan *http.Request, 4)
+	bodies := make(chan []byte, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		received <- req
+		bodies <- b
+		// The deliverer runs while a redelivery is in progress, and mustn't send it again
+		if req.Header.Get("X-Email2rss-Event") == EventRedelivered && !raced.Swap(true) {
+			err := s.processDeliveries(context.Background(), time.Now())
+			if err != nil {
+				t.Errorf("process deliveries during redelivery: %v", err)
+			}
+		}
+	}))
+	defer hook.Close()
+	var recovered atomic.Bool
+	var attempts, redeliveries atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Header.Get("X-Email2rss-Event") {
+		case EventCreated:
+			attempts.Add(1)
+		case EventRedelivered:
+			redeliveries.Add(1)
+		}
+		if !recovered.Load() {
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer failing.Close()
+
+	cfg := config.Default()
+	cfg.Admin = testAdmin
+	cfg.Feeds = map[string]config.Feed{"digest": {Webhooks: []config.Webhook{{URL: hook.URL, Secret: "s3cret"}, {URL: failing.URL}}}}
+	// The clients are built as main.go builds them, and webhooks on the local network are still delivered to
+	s, err = NewServer(ctx, "../../templates", bucket, WithHTTPClient(fetch.NewClient(publicOptions)), WithWebhookClient(fetch.NewClient(WebhookOptions)), WithConfig(cfg))
+	if err != nil {
+		t.Fatalf("construct server: %v", err)
+	}
+	item := &generic.Message{UUID: "a", Subject: "Issue", Date: time.Date(2024, 11, 1, 8, 0, 0, 0, time.UTC), Body: "<p>Body</p>"}
+	err = s.writeItem(ctx, "digest", item)
+	if err != nil {
+		t.Fatalf("write item: %v", err)
+	}
+	s.fireWebhooks(ctx, "digest", item.Key(), EventCreated)
+
+	var req *http.Request
+	var body []byte
+	select {
+	case req = <-received:
+		body = <-bodies
+	case <-time.After(5 * time.Second):
+		t.Fatalf("webhook wasn't called")
+	}
+	stored, err := bucket.ReadAll(ctx, "digest/items/"+item.Key()+".json")
+	if err != nil {
+		t.Fatalf("read item: %v", err)
+	}
+	if string(body) != string(stored) {
+		t.Errorf("webhook received %s, expected the item %s", body, stored)
+	}
+	if signature := req.Header.Get("X-Email2rss-Signature"); signature != sign("s3cret", stored) {
+		t.Errorf("signature is %s", signature)
+	}
+	if req.Header.Get("X-Email2rss-Event") != EventCreated || req.Header.Get("X-Email2rss-Feed") != "digest" || req.Header.Get("X-Email2rss-Item") != item.Key() {
+		t.Errorf("webhook received headers %v", req.Header)
+	}
+
+	// Both deliveries are logged, and the failure is retried later
+	var deliveries []*Delivery
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries, err = s.Deliveries(ctx, "digest")
+		if err != nil {
+			t.Fatalf("list deliveries: %v", err)
+		}
+		if len(deliveries) == 2 && deliveries[0].Attempts > 0 && deliveries[1].Attempts > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deliveries weren't attempted: %+v", deliveries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, d := range deliveries {
+		switch d.URL {
+		case hook.URL:
+			if d.Delivered == nil || d.Status != http.StatusOK {
+				t.Errorf("delivery to webhook is %+v", d)
+			}
+		case failing.URL:
+			if d.Done() || d.Status != http.StatusServiceUnavailable || d.LastError == "" || !d.NotBefore.After(time.Now()) {
+				t.Errorf("delivery to failing webhook is %+v", d)
+			}
+		}
+	}
+	// Failures are retried by the deliverer alone, not by the client straight away
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("failing webhook was sent the item %d times, expected once", n)
+	}
+	recovered.Store(true)
+	err = s.processDeliveries(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("process deliveries: %v", err)
+	}
+	deliveries, err = s.Deliveries(ctx, "digest")
+	if err != nil {
+		t.Fatalf("list deliveries: %v", err)
+	}
+	for _, d := range deliveries {
+		if d.Delivered == nil {
+			t.Errorf("delivery wasn't retried: %+v", d)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, asAdmin(httptest.NewRequest(http.MethodPost, "/email2rss/digest/items/"+item.Key()+"/redeliver", nil)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("redeliver gave %d: %s", rec.Code, rec.Body)
+	}
+	var redelivered []*Delivery
+	err = json.NewDecoder(rec.Body).Decode(&redelivered)
+	if err != nil {
+		t.Fatalf("parse deliveries: %v", err)
+	}
+	if len(redelivered) != 2 || redelivered[0].Delivered == nil || redelivered[1].Delivered == nil {
+		t.Errorf("redelivered %+v", redelivered)
+	}
+	if n := redeliveries.Load(); n != 1 {
+		t.Errorf("item was redelivered to the second webhook %d times, expected once", n)
+	}
+	select {
+	case req = <-received:
+		<-bodies
+		if req.Header.Get("X-Email2rss-Event") != EventRedelivered {
+			t.Errorf("redelivery had event %s", req.Header.Get("X-Email2rss-Event"))
+		}
+	default:
+		t.Errorf("item wasn't redelivered")
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, asAdmin(httptest.NewRequest(http.MethodPost, "/email2rss/digest/items/2024-01-01T00:00:00Z/redeliver", nil)))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("redelivering a missing item gave %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, asAdmin(httptest.NewRequest(http.MethodGet, "/email2rss/digest/deliveries", nil)))
+	var log []*Delivery
+	err = json.NewDecoder(rec.Body).Decode(&log)
+	if err != nil {
+		t.Fatalf("parse delivery log: %v", err)
+	}
+	if len(log) != 4 || log[0].Event != EventRedelivered {
+		t.Errorf("delivery log is %+v", log)
+	}
+}
@@ -0,0 +1,67 @@
+package validate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Atom validates an Atom 1.0 document
+func Atom(b []byte) error {
+	root, err := parse(b)
+	if err != nil {
+		return err
+	}
+	if root.Name.Space != atomNamespace || root.Name.Local != "feed" {
+		return fmt.Errorf("root element is <%s>, expected an Atom <feed>", root.Name.Local)
+	}
+	return atom(root)
+}
+
+func atom(feed *element) error {
+	var p Problems
+	p.atomCommon(feed)
+
+	// Every entry needs an author, which it may inherit from the feed
+	authored := feed.child(atomNamespace, "author") != nil
+	ids := map[string]int{}
+	for _, entry := range feed.children(atomNamespace, "entry") {
+		p.atomCommon(entry)
+		if !authored && entry.child(atomNamespace, "author") == nil {
+			p.add("line %d: <entry> has no <author> and neither does the <feed>", entry.Line)
+		}
+		id := entry.text(atomNamespace, "id")
+		if line, ok := ids[id]; ok && id != "" {
+			p.add("line %d: <id> %q is also used by the entry on line %d", entry.child(atomNamespace, "id").Line, id, line)
+		} else if id != "" {
+			ids[id] = entry.child(atomNamespace, "id").Line
+		}
+		p.rfc3339(entry, "published")
+	}
+	return p.err()
+}
+
+// atomCommon checks the elements feeds and entries share
+func (p *Problems) atomCommon(e *element) {
+	for _, name := range []string{"id", "title", "updated"} {
+		if e.child(atomNamespace, name) == nil {
+			p.add("line %d: <%s> has no <%s>", e.Line, e.Name.Local, name)
+		}
+	}
+	if id := e.child(atomNamespace, "id"); id != nil && strings.TrimSpace(id.Text) == "" {
+		p.add("line %d: <id> is empty", id.Line)
+	}
+	p.rfc3339(e, "updated")
+	for _, link := range e.children(atomNamespace, "link") {
+		p.checkURL(link, "href")
+	}
+}
+
+func (p *Problems) rfc3339(e *element, name string) {
+	for _, date := range e.children(atomNamespace, name) {
+		_, err := time.Parse(time.RFC3339, strings.TrimSpace(date.Text))
+		if err != nil {
+			p.add("line %d: <%s> is not an RFC 3339 date: %q", date.Line, name, strings.TrimSpace(date.Text))
+		}
+	}
+}
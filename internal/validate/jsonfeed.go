@@ -0,0 +1,106 @@
+package validate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type jsonFeed struct {
+	Version     string      `json:"version"`
+	Title       string      `json:"title"`
+	HomePageURL string      `json:"home_page_url"`
+	FeedURL     string      `json:"feed_url"`
+	Icon        string      `json:"icon"`
+	Favicon     string      `json:"favicon"`
+	Items       []*jsonItem `json:"items"`
+}
+
+type jsonItem struct {
+	ID            json.RawMessage   `json:"id"`
+	URL           string            `json:"url"`
+	ExternalURL   string            `json:"external_url"`
+	Image         string            `json:"image"`
+	ContentHTML   *string           `json:"content_html"`
+	ContentText   *string           `json:"content_text"`
+	DatePublished string            `json:"date_published"`
+	DateModified  string            `json:"date_modified"`
+	Attachments   []*jsonAttachment `json:"attachments"`
+}
+
+type jsonAttachment struct {
+	URL         string   `json:"url"`
+	MIMEType    string   `json:"mime_type"`
+	SizeInBytes *float64 `json:"size_in_bytes"`
+}
+
+// JSONFeed validates a JSON Feed 1 or 1.1 document
+func JSONFeed(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	var feed jsonFeed
+	err := dec.Decode(&feed)
+	if err != nil {
+		return fmt.Errorf("document is not valid JSON Feed: %w", err)
+	}
+	if dec.More() {
+		return fmt.Errorf("document has content after the feed")
+	}
+
+	var p Problems
+	if feed.Version != "https://jsonfeed.org/version/1" && feed.Version != "https://jsonfeed.org/version/1.1" {
+		p.add("version is %q, expected https://jsonfeed.org/version/1.1", feed.Version)
+	}
+	if strings.TrimSpace(feed.Title) == "" {
+		p.add("feed has no title")
+	}
+	p.jsonURLs("feed", map[string]string{"home_page_url": feed.HomePageURL, "feed_url": feed.FeedURL, "icon": feed.Icon, "favicon": feed.Favicon})
+	if feed.Items == nil {
+		p.add("feed has no items array")
+	}
+
+	ids := map[string]int{}
+	for i, item := range feed.Items {
+		where := fmt.Sprintf("item %d", i)
+		var id string
+		if json.Unmarshal(item.ID, &id) != nil || strings.TrimSpace(id) == "" {
+			p.add("%s has no string id", where)
+		} else if j, ok := ids[id]; ok {
+			p.add("%s has id %q, which item %d also uses", where, id, j)
+		} else {
+			ids[id] = i
+		}
+		if item.ContentHTML == nil && item.ContentText == nil {
+			p.add("%s has neither content_html nor content_text", where)
+		}
+		p.jsonURLs(where, map[string]string{"url": item.URL, "external_url": item.ExternalURL, "image": item.Image})
+		for _, date := range []struct{ name, value string }{{"date_published", item.DatePublished}, {"date_modified", item.DateModified}} {
+			if _, err := time.Parse(time.RFC3339, date.value); date.value != "" && err != nil {
+				p.add("%s has %s which is not an RFC 3339 date: %q", where, date.name, date.value)
+			}
+		}
+		for j, attachment := range item.Attachments {
+			where := fmt.Sprintf("attachment %d of item %d", j, i)
+			if !absoluteURL(attachment.URL) {
+				p.add("%s has url which is not an absolute URL: %q", where, attachment.URL)
+			}
+			if !mediaType(attachment.MIMEType) {
+				p.add("%s has mime_type which is not a media type: %q", where, attachment.MIMEType)
+			}
+			if attachment.SizeInBytes != nil && *attachment.SizeInBytes < 0 {
+				p.add("%s has a negative size_in_bytes", where)
+			}
+		}
+	}
+	return p.err()
+}
+
+// jsonURLs checks that the optional URLs of a feed or item are absolute
+func (p *Problems) jsonURLs(where string, urls map[string]string) {
+	for _, name := range []string{"home_page_url", "feed_url", "icon", "favicon", "url", "external_url", "image"} {
+		if u, ok := urls[name]; ok && u != "" && !absoluteURL(u) {
+			p.add("%s has %s which is not an absolute URL: %q", where, name, u)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package validate
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rfc822Layouts are the date formats RSS allows, with and without the day of the week and seconds.
+// Zone names are checked against rfc822Zones instead.
+var rfc822Layouts = func() []string {
+	var layouts []string
+	for _, weekday := range []string{"Mon, ", ""} {
+		for _, day := range []string{"02", "2"} {
+			for _, clock := range []string{"15:04:05", "15:04"} {
+				layouts = append(layouts, weekday+day+" Jan 2006 "+clock+" -0700")
+			}
+		}
+	}
+	return layouts
+}()
+
+// rfc822Zones are the zone names RFC 822 defines, besides military zones which nobody uses
+var rfc822Zones = map[string]bool{
+	"UT": true, "GMT": true,
+	"EST": true, "EDT": true,
+	"CST": true, "CDT": true,
+	"MST": true, "MDT": true,
+	"PST": true, "PDT": true,
+}
+
+// durationRegexp matches the forms of itunes:duration, a number of seconds or [HH:]MM:SS
+var durationRegexp = regexp.MustCompile(`^(\d+|(\d+:)?[0-5]?\d:[0-5]\d)$`)
+
+// rfc822 reports whether a date is in RFC 822 format. Go parses any zone abbreviation,
+// such as "CEST", which RFC 822 doesn't define and readers can't interpret.
+func rfc822(date string) bool {
+	fields := strings.Fields(date)
+	if len(fields) == 0 {
+		return false
+	}
+	if zone := fields[len(fields)-1]; rfc822Zones[zone] {
+		// Go doesn't parse every zone RFC 822 names, such as "UT", so the offset is substituted
+		date = strings.TrimSuffix(date, zone) + "+0000"
+	}
+	for _, layout := range rfc822Layouts {
+		_, err := time.Parse(layout, date)
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// RSS validates an RSS 2.0 document, including the iTunes and Podcasting 2.0 extensions the templates use
+func RSS(b []byte) error {
+	root, err := parse(b)
+	if err != nil {
+		return err
+	}
+	if root.Name.Space != "" || root.Name.Local != "rss" {
+		return fmt.Errorf("root element is <%s>, expected <rss>", root.Name.Local)
+	}
+	return rss(root)
+}
+
+func rss(root *element) error {
+	var p Problems
+	if version, _ := root.attr("version"); version != "2.0" {
+		p.add("line %d: <rss> has version %q, expected \"2.0\"", root.Line, version)
+	}
+	channels := root.children("", "channel")
+	if len(channels) != 1 {
+		p.add("line %d: <rss> has %d channels, expected one", root.Line, len(channels))
+	}
+	for _, channel := range channels {
+		p.channel(channel)
+	}
+	return p.err()
+}
+
+func (p *Problems) channel(channel *element) {
+	for _, name := range []string{"title", "link", "description"} {
+		if channel.child("", name) == nil {
+			p.add("line %d: <channel> has no <%s>", channel.Line, name)
+		}
+	}
+	if channel.text("", "title") == "" && channel.child("", "title") != nil {
+		p.add("line %d: <channel> has an empty <title>", channel.child("", "title").Line)
+	}
+	p.checkURL(channel.child("", "link"), "")
+	p.dates(channel, "pubDate", "lastBuildDate")
+	for _, link := range channel.children(atomNamespace, "link") {
+		p.checkURL(link, "href")
+	}
+	p.checkURL(channel.child(itunesNamespace, "image"), "href")
+	if image := channel.child("", "image"); image != nil {
+		p.checkURL(image.child("", "url"), "")
+	}
+
+	guids := map[string]int{}
+	for _, item := range channel.children("", "item") {
+		p.item(item, guids)
+	}
+}
+
+func (p *Problems) item(item *element, guids map[string]int) {
+	if item.child("", "title") == nil && item.child("", "description") == nil {
+		p.add("line %d: <item> has neither a <title> nor a <description>", item.Line)
+	}
+	p.checkURL(item.child("", "link"), "")
+	p.dates(item, "pubDate")
+
+	if guid := item.child("", "guid"); guid != nil {
+		id := strings.TrimSpace(guid.Text)
+		switch line, ok := guids[id]; {
+		case id == "":
+			p.add("line %d: <guid> is empty", guid.Line)
+		case ok:
+			p.add("line %d: <guid> %q is also used by the item on line %d", guid.Line, id, line)
+		default:
+			guids[id] = guid.Line
+		}
+		// Permalinks are the default, so a guid which isn't a URL has to say so
+		if permalink, _ := guid.attr("isPermaLink"); permalink != "false" && id != "" {
+			p.checkURL(guid, "")
+		}
+	}
+
+	// Podcast apps only play one enclosure, and which one they pick varies
+	enclosures := item.children("", "enclosure")
+	if len(enclosures) > 1 {
+		p.add("line %d: <item> has more than one <enclosure>", enclosures[1].Line)
+	}
+	for _, enclosure := range enclosures {
+		p.checkURL(enclosure, "url")
+		length, ok := enclosure.attr("length")
+		if n, err := strconv.ParseInt(length, 10, 64); !ok || err != nil || n < 0 {
+			p.add("line %d: length of <enclosure> is not a number of bytes: %q", enclosure.Line, length)
+		}
+		p.checkMediaType(enclosure)
+	}
+
+	p.checkURL(item.child(itunesNamespace, "image"), "href")
+	if duration := item.child(itunesNamespace, "duration"); duration != nil && !durationRegexp.MatchString(strings.TrimSpace(duration.Text)) {
+		p.add("line %d: <itunes:duration> is not a number of seconds or [HH:]MM:SS: %q", duration.Line, strings.TrimSpace(duration.Text))
+	}
+	for _, transcript := range item.children(podcastNamespace, "transcript") {
+		p.checkURL(transcript, "url")
+		p.checkMediaType(transcript)
+	}
+	for _, chapters := range item.children(podcastNamespace, "chapters") {
+		p.checkURL(chapters, "url")
+		p.checkMediaType(chapters)
+	}
+	for _, person := range item.children(podcastNamespace, "person") {
+		if href, ok := person.attr("href"); ok && href != "" {
+			p.checkURL(person, "href")
+		}
+	}
+}
+
+// dates checks that an element's date children are RFC 822 dates
+func (p *Problems) dates(e *element, names ...string) {
+	for _, name := range names {
+		for _, date := range e.children("", name) {
+			if !rfc822(strings.TrimSpace(date.Text)) {
+				p.add("line %d: <%s> is not an RFC 822 date: %q", date.Line, name, strings.TrimSpace(date.Text))
+			}
+		}
+	}
+}
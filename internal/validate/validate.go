@@ -0,0 +1,207 @@
+// Package validate checks generated RSS, Atom and JSON Feed documents for the mistakes
+// which make podcast apps and feed readers reject them, so that a broken template is
+// caught before the feed is published rather than by its subscribers
+package validate
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"strings"
+)
+
+const (
+	atomNamespace    = "http://www.w3.org/2005/Atom"
+	itunesNamespace  = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+	podcastNamespace = "https://podcastindex.org/namespace/1.0"
+)
+
+// Problems lists everything wrong with a feed, rather than stopping at the first mistake
+type Problems []string
+
+func (p *Problems) add(format string, args ...any) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+func (p Problems) Error() string {
+	return strings.Join(p, "\n")
+}
+
+func (p Problems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return p
+}
+
+// Feed validates a document, detecting whether it's RSS, Atom or JSON Feed.
+// The error lists Problems if the document could be parsed but has mistakes.
+func Feed(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		return JSONFeed(b)
+	}
+	root, err := parse(b)
+	if err != nil {
+		return err
+	}
+	switch {
+	case root.Name.Space == "" && root.Name.Local == "rss":
+		return rss(root)
+	case root.Name.Space == atomNamespace && root.Name.Local == "feed":
+		return atom(root)
+	}
+	return fmt.Errorf("unknown feed format with root element <%s>", root.Name.Local)
+}
+
+// element is a node of a parsed XML document
+type element struct {
+	Name     xml.Name
+	Attr     []xml.Attr
+	Text     string
+	Children []*element
+	Line     int
+}
+
+// children lists the element's children with the given name, where space is a namespace URI
+func (e *element) children(space, local string) []*element {
+	var children []*element
+	for _, c := range e.Children {
+		if c.Name.Space == space && c.Name.Local == local {
+			children = append(children, c)
+		}
+	}
+	return children
+}
+
+func (e *element) child(space, local string) *element {
+	children := e.children(space, local)
+	if len(children) == 0 {
+		return nil
+	}
+	return children[0]
+}
+
+func (e *element) attr(local string) (string, bool) {
+	for _, a := range e.Attr {
+		if a.Name.Space == "" && a.Name.Local == local {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// text is the trimmed text of a child, or "" if there's no such child
+func (e *element) text(space, local string) string {
+	c := e.child(space, local)
+	if c == nil {
+		return ""
+	}
+	return strings.TrimSpace(c.Text)
+}
+
+// parse reads a whole XML document, checking that it's well-formed along the way
+func parse(b []byte) (*element, error) {
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	var root *element
+	var stack []*element
+	for {
+		offset := dec.InputOffset()
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("document is not well-formed XML: %w", err)
+		}
+		line := bytes.Count(b[:offset], []byte("\n")) + 1
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			// The decoder leaves prefixes it can't resolve in place of the namespace URI
+			if tok.Name.Space != "" && !strings.Contains(tok.Name.Space, ":") {
+				return nil, fmt.Errorf("line %d: element <%s:%s> uses an undeclared namespace prefix", line, tok.Name.Space, tok.Name.Local)
+			}
+			for _, a := range tok.Attr {
+				if a.Name.Space != "" && a.Name.Space != "xmlns" && !strings.Contains(a.Name.Space, ":") {
+					return nil, fmt.Errorf("line %d: attribute %s:%s uses an undeclared namespace prefix", line, a.Name.Space, a.Name.Local)
+				}
+			}
+			e := &element{Name: tok.Name, Attr: tok.Attr, Line: line}
+			if len(stack) == 0 {
+				if root != nil {
+					return nil, fmt.Errorf("line %d: document has more than one root element", line)
+				}
+				root = e
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, e)
+			}
+			stack = append(stack, e)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) == 0 {
+				if len(bytes.TrimSpace(tok)) > 0 {
+					return nil, fmt.Errorf("line %d: text outside the root element", line)
+				}
+				continue
+			}
+			stack[len(stack)-1].Text += string(tok)
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("document has no root element")
+	}
+	return root, nil
+}
+
+// absoluteURL reports whether a link can be followed from outside the feed
+func absoluteURL(u string) bool {
+	parsed, err := url.Parse(strings.TrimSpace(u))
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// checkURL adds a problem if an element's attribute or text isn't an absolute URL
+func (p *Problems) checkURL(e *element, attr string) {
+	if e == nil {
+		return
+	}
+	var u string
+	if attr == "" {
+		u = strings.TrimSpace(e.Text)
+	} else {
+		var ok bool
+		u, ok = e.attr(attr)
+		if !ok {
+			p.add("line %d: <%s> has no %s attribute", e.Line, e.Name.Local, attr)
+			return
+		}
+	}
+	if !absoluteURL(u) {
+		if attr == "" {
+			p.add("line %d: <%s> is not an absolute URL: %q", e.Line, e.Name.Local, u)
+		} else {
+			p.add("line %d: %s of <%s> is not an absolute URL: %q", e.Line, attr, e.Name.Local, u)
+		}
+	}
+}
+
+// mediaType reports whether s is a type/subtype, which mime.ParseMediaType doesn't insist on
+func mediaType(s string) bool {
+	mediatype, _, err := mime.ParseMediaType(s)
+	return err == nil && strings.Contains(mediatype, "/")
+}
+
+// checkMediaType adds a problem if a type attribute is missing or isn't a media type
+func (p *Problems) checkMediaType(e *element) {
+	typ, ok := e.attr("type")
+	if !ok || typ == "" {
+		p.add("line %d: <%s> has no type attribute", e.Line, e.Name.Local)
+		return
+	}
+	if !mediaType(typ) {
+		p.add("line %d: type of <%s> is not a media type: %q", e.Line, e.Name.Local, typ)
+	}
+}
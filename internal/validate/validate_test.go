@@ -0,0 +1,138 @@
+package validate
+
+import (
+	_ "embed"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var (
+	//go:embed test/valid.rss
+	validRSS []byte
+	//go:embed test/invalid.rss
+	invalidRSS []byte
+	//go:embed test/valid.atom
+	validAtom []byte
+	//go:embed test/invalid.atom
+	invalidAtom []byte
+	//go:embed test/valid.json
+	validJSON []byte
+	//go:embed test/invalid.json
+	invalidJSON []byte
+)
+
+func TestFeed(t *testing.T) {
+	tests := []struct {
+		name     string
+		feed     []byte
+		problems []string
+	}{
+		{"valid RSS", validRSS, nil},
+		{"valid Atom", validAtom, nil},
+		{"valid JSON Feed", validJSON, nil},
+		{"invalid RSS", invalidRSS, []string{
+			`line 2: <rss> has version "0.91"`,
+			"line 5: <channel> has no <description>",
+			"line 6: <channel> has an empty <title>",
+			`line 7: <link> is not an absolute URL: "/email2rss/test"`,
+			`line 11: <pubDate> is not an RFC 822 date: "Sat, 02 Nov 2024 08:00:00 CEST"`,
+			`line 12: url of <enclosure> is not an absolute URL: "episode.mp3"`,
+			`line 12: length of <enclosure> is not a number of bytes: ""`,
+			`line 12: type of <enclosure> is not a media type: "audio"`,
+			`line 13: <itunes:duration> is not a number of seconds`,
+			`line 17: <guid> "one" is also used by the item on line 10`,
+			`line 18: <pubDate> is not an RFC 822 date`,
+			"line 19: <transcript> has no type attribute",
+			"line 21: <item> has neither a <title> nor a <description>",
+			`line 22: <guid> is not an absolute URL: "not-a-url"`,
+			"line 24: <item> has more than one <enclosure>",
+		}},
+		{"invalid Atom", invalidAtom, []string{
+			"line 2: <feed> has no <title>",
+			`line 4: <updated> is not an RFC 3339 date`,
+			"line 5: <entry> has no <author> and neither does the <feed>",
+			`line 8: href of <link> is not an absolute URL: "/posts/1"`,
+			`line 12: <id> "urn:example:1" is also used by the entry on line 6`,
+		}},
+		{"invalid JSON Feed", invalidJSON, []string{
+			`version is "https://jsonfeed.org/version/2"`,
+			"feed has no title",
+			`feed has home_page_url which is not an absolute URL: "example.org"`,
+			"item 0 has date_published which is not an RFC 3339 date",
+			`item 1 has id "1", which item 0 also uses`,
+			"item 1 has neither content_html nor content_text",
+			`attachment 0 of item 1 has url which is not an absolute URL: "/episode.mp3"`,
+			`attachment 0 of item 1 has mime_type which is not a media type: ""`,
+			"item 2 has no string id",
+		}},
+	}
+	for _, test := range tests {
+		err := Feed(test.feed)
+		if test.problems == nil {
+			if err != nil {
+				t.Errorf("%s has problems:\n%v", test.name, err)
+			}
+			continue
+		}
+		var problems Problems
+		if !errors.As(err, &problems) {
+			t.Errorf("%s gave %v, expected problems", test.name, err)
+			continue
+		}
+		for _, expected := range test.problems {
+			found := false
+			for _, problem := range problems {
+				found = found || strings.HasPrefix(problem, expected)
+			}
+			if !found {
+				t.Errorf("%s is missing the problem %q, it has:\n%v", test.name, expected, err)
+			}
+		}
+		if len(problems) != len(test.problems) {
+			t.Errorf("%s has %d problems, expected %d:\n%v", test.name, len(problems), len(test.problems), err)
+		}
+	}
+}
+
+func TestWellFormed(t *testing.T) {
+	tests := []struct {
+		name, doc string
+	}{
+		{"unclosed element", `<rss version="2.0"><channel></rss>`},
+		{"undefined entity", `<rss version="2.0"><channel><title>&nbsp;</title></channel></rss>`},
+		{"unescaped ampersand", `<rss version="2.0"><channel><link>https://example.com/?a=1&b=2</link></channel></rss>`},
+		{"CDATA ended early", `<rss version="2.0"><channel><description><![CDATA[a]]>b]]></description></channel></rss>`},
+		{"undeclared prefix", `<rss version="2.0"><channel><itunes:image href="https://example.com/a.png"/></channel></rss>`},
+		{"control character", "<rss version=\"2.0\"><channel><title>a\fb</title></channel></rss>"},
+		{"two roots", `<rss version="2.0"></rss><rss version="2.0"></rss>`},
+		{"no root", `<?xml version="1.0"?>`},
+	}
+	for _, test := range tests {
+		err := Feed([]byte(test.doc))
+		var problems Problems
+		if err == nil || errors.As(err, &problems) {
+			t.Errorf("%s gave %v, expected a well-formedness error", test.name, err)
+		}
+	}
+}
+
+func TestRFC822(t *testing.T) {
+	tests := []struct {
+		date  string
+		valid bool
+	}{
+		{"Sat, 02 Nov 2024 08:00:00 -0500", true},
+		{"Sat, 2 Nov 2024 08:00:00 GMT", true},
+		{"02 Nov 2024 08:00 PST", true},
+		{"02 Nov 2024 08:00:00 UT", true},
+		{"Sat, 02 Nov 2024 08:00:00 CEST", false},
+		{"Sat, 02 Nov 2024 08:00:00 UTC", false},
+		{"2024-11-02T08:00:00Z", false},
+	}
+	for _, test := range tests {
+		if valid := rfc822(test.date); valid != test.valid {
+			t.Errorf("rfc822(%q) is %v, expected %v", test.date, valid, test.valid)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Package websub implements a WebSub hub, which pushes a feed to subscribers as soon as
+// it's published rather than leaving them to poll it, and pings external hubs
+package websub
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+const (
+	// DefaultLease is granted to subscribers which don't ask for a lease
+	DefaultLease = 10 * 24 * time.Hour
+	// MaxLease caps the leases subscribers ask for
+	MaxLease = 30 * 24 * time.Hour
+	// maxSecret is the longest hub.secret the specification allows
+	maxSecret = 200
+)
+
+// Subscription is a callback verified to want a topic, stored under {feed}/subscribers/
+type Subscription struct {
+	Feed     string    `json:"feed"`
+	Topic    string    `json:"topic"`
+	Callback string    `json:"callback"`
+	Secret   string    `json:"secret,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+func subscriptionKey(feed, callback string) string {
+	h := sha256.Sum256([]byte(callback))
+	return fmt.Sprintf("%s/subscribers/%x.json", feed, h[:16])
+}
+
+// Hub verifies subscriptions to feeds and distributes them to their subscribers
+type Hub struct {
+	// URL is where the hub is reachable, sent to subscribers in Link headers
+	URL     string
+	bucket  *blob.Bucket
+	client  *http.Client
+	resolve func(topic string) (feed string, ok bool)
+	// async runs work after a request has been answered, such as verifying a subscription
+	async func(func())
+}
+
+type Option func(*Hub)
+
+// WithHTTPClient sets the client used to verify and notify subscribers
+func WithHTTPClient(client *http.Client) Option {
+	return func(h *Hub) {
+		h.client = client
+	}
+}
+
+// NewHub constructs a hub reachable at hubURL, storing subscriptions in bucket.
+// resolve maps a topic URL to the feed it names, reporting false for unknown topics.
+func NewHub(hubURL string, bucket *blob.Bucket, resolve func(topic string) (string, bool), opts ...Option) *Hub {
+	h := &Hub{
+		URL:     hubURL,
+		bucket:  bucket,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		resolve: resolve,
+		async:   func(f func()) { go f() },
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// ServeHTTP accepts subscription and unsubscription requests, which are verified
+// with the subscriber's callback after the request is accepted
+func (h *Hub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		http.Error(w, "Could not parse form", http.StatusBadRequest)
+		return
+	}
+	mode := req.PostForm.Get("hub.mode")
+	if mode != "subscribe" && mode != "unsubscribe" {
+		http.Error(w, "hub.mode must be subscribe or unsubscribe", http.StatusBadRequest)
+		return
+	}
+	topic := req.PostForm.Get("hub.topic")
+	feed, ok := h.resolve(topic)
+	if !ok {
+		http.Error(w, "Unknown hub.topic", http.StatusNotFound)
+		return
+	}
+	callback := req.PostForm.Get("hub.callback")
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "hub.callback must be an absolute http(s) URL", http.StatusBadRequest)
+		return
+	}
+	secret := req.PostForm.Get("hub.secret")
+	if len(secret) >= maxSecret {
+		http.Error(w, "hub.secret is too long", http.StatusBadRequest)
+		return
+	}
+	lease := DefaultLease
+	if s := req.PostForm.Get("hub.lease_seconds"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds <= 0 {
+			http.Error(w, "hub.lease_seconds must be a positive number", http.StatusBadRequest)
+			return
+		}
+		lease = min(time.Duration(seconds)*time.Second, MaxLease)
+	}
+
+	sub := &Subscription{Feed: feed, Topic: topic, Callback: callback, Secret: secret, Expires: time.Now().Add(lease)}
+	ctx := context.WithoutCancel(req.Context())
+	h.async(func() {
+		err := h.verify(ctx, mode, sub, lease)
+		if err != nil {
+			log.Printf("verify %s of %s to %s: %v", mode, sub.Callback, sub.Topic, err)
+		}
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// verify checks that the callback asked for the (un)subscription by having it echo a challenge,
+// then stores or deletes the subscription
+func (h *Hub) verify(ctx context.Context, mode string, sub *Subscription, lease time.Duration) error {
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	challenge := hex.EncodeToString(nonce[:])
+
+	u, err := url.Parse(sub.Callback)
+	if err != nil {
+		return fmt.Errorf("parse callback: %w", err)
+	}
+	query := u.Query()
+	query.Set("hub.mode", mode)
+	query.Set("hub.topic", sub.Topic)
+	query.Set("hub.challenge", challenge)
+	if mode == "subscribe" {
+		query.Set("hub.lease_seconds", strconv.Itoa(int(lease.Seconds())))
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("construct request: %w", err)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("GET callback: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(len(challenge))+1))
+	if err != nil {
+		return fmt.Errorf("read callback response: %w", err)
+	}
+	if resp.StatusCode/100 != 2 || string(body) != challenge {
+		return fmt.Errorf("callback didn't confirm, answering %s", resp.Status)
+	}
+
+	key := subscriptionKey(sub.Feed, sub.Callback)
+	if mode == "unsubscribe" {
+		err = h.bucket.Delete(ctx, key)
+		if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return fmt.Errorf("delete subscription: %w", err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(sub)
+	if err != nil {
+		return fmt.Errorf("encode subscription: %w", err)
+	}
+	err = h.bucket.WriteAll(ctx, key, b, &blob.WriterOptions{ContentType: "application/json;charset=UTF-8"})
+	if err != nil {
+		return fmt.Errorf("write subscription: %w", err)
+	}
+	return nil
+}
+
+// Subscriptions lists a feed's subscriptions, including expired ones
+func (h *Hub) Subscriptions(ctx context.Context, feed string) ([]*Subscription, error) {
+	var subs []*Subscription
+	iter := h.bucket.List(&blob.ListOptions{Prefix: fmt.Sprintf("%s/subscribers/", feed)})
+	for {
+		obj, err := iter.Next(ctx)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("list subscriptions: %w", err)
+		}
+		b, err := h.bucket.ReadAll(ctx, obj.Key)
+		if err != nil {
+			return nil, fmt.Errorf("read subscription: %w", err)
+		}
+		var sub Subscription
+		err = json.Unmarshal(b, &sub)
+		if err != nil {
+			return nil, fmt.Errorf("parse subscription %s: %w", obj.Key, err)
+		}
+		subs = append(subs, &sub)
+	}
+	return subs, nil
+}
+
+// Publish sends a feed's new content to each of its subscribers, dropping those
+// whose lease has expired or which answer 410 Gone
+func (h *Hub) Publish(ctx context.Context, feed, contentType string, content []byte) error {
+	subs, err := h.Subscriptions(ctx, feed)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, sub := range subs {
+		if time.Now().After(sub.Expires) {
+			err = h.bucket.Delete(ctx, subscriptionKey(sub.Feed, sub.Callback))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("delete expired subscription: %w", err))
+			}
+			continue
+		}
+		err = h.deliver(ctx, sub, contentType, content)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("deliver to %s: %w", sub.Callback, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Notify publishes in the background, as subscribers may be slow to respond
+func (h *Hub) Notify(ctx context.Context, feed, contentType string, content []byte) {
+	ctx = context.WithoutCancel(ctx)
+	h.async(func() {
+		err := h.Publish(ctx, feed, contentType, content)
+		if err != nil {
+			log.Printf("publish feed %s to subscribers: %v", feed, err)
+		}
+	})
+}
+
+func (h *Hub) deliver(ctx context.Context, sub *Subscription, contentType string, content []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Callback, bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("construct request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Link", fmt.Sprintf(`<%s>; rel="hub", <%s>; rel="self"`, h.URL, sub.Topic))
+	if sub.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(sub.Secret))
+		mac.Write(content)
+		req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("POST callback: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		err = h.bucket.Delete(ctx, subscriptionKey(sub.Feed, sub.Callback))
+		if err != nil {
+			return fmt.Errorf("delete subscription: %w", err)
+		}
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("callback answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Ping tells an external hub that a topic has been updated, so that it fetches
+// and distributes it, in the manner most hubs accept
+func Ping(ctx context.Context, client *http.Client, hubURL, topic string) error {
+	form := url.Values{"hub.mode": {"publish"}, "hub.url": {topic}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hubURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("construct request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("POST hub: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("hub answered %s", resp.Status)
+	}
+	return nil
+}
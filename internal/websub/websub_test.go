@@ -0,0 +1,218 @@
+package websub
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/memblob"
+)
+
+const testTopic = "https://connor.zip/email2rss/digest"
+
+// subscriber is a WebSub subscriber which confirms the requests it expects and records deliveries
+type subscriber struct {
+	*httptest.Server
+	// confirm is whether verification requests are confirmed
+	confirm bool
+	// status answers deliveries
+	status     int
+	verified   []url.Values
+	deliveries []*http.Request
+	bodies     []string
+}
+
+func newSubscriber(t *testing.T) *subscriber {
+	sub := &subscriber{confirm: true, status: http.StatusOK}
+	sub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			query := req.URL.Query()
+			sub.verified = append(sub.verified, query)
+			if !sub.confirm {
+				http.NotFound(w, req)
+				return
+			}
+			io.WriteString(w, query.Get("hub.challenge"))
+		case http.MethodPost:
+			b, _ := io.ReadAll(req.Body)
+			sub.deliveries = append(sub.deliveries, req)
+			sub.bodies = append(sub.bodies, string(b))
+			w.WriteHeader(sub.status)
+		}
+	}))
+	t.Cleanup(sub.Close)
+	return sub
+}
+
+func newTestHub(t *testing.T) (*Hub, *blob.Bucket) {
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, "mem://")
+	if err != nil {
+		t.Fatalf("open bucket: %v", err)
+	}
+	t.Cleanup(func() { bucket.Close() })
+	resolve := func(topic string) (string, bool) {
+		return "digest", topic == testTopic
+	}
+	h := NewHub("https://connor.zip/email2rss/hub", bucket, resolve)
+	// Verify and distribute before answering, so tests needn't wait
+	h.async = func(f func()) { f() }
+	return h, bucket
+}
+
+func request(h *Hub, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/email2rss/hub", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestSubscribe(t *testing.T) {
+	ctx := context.Background()
+	h, _ := newTestHub(t)
+	sub := newSubscriber(t)
+
+	rec := request(h, url.Values{"hub.mode": {"subscribe"}, "hub.topic": {testTopic}, "hub.callback": {sub.URL + "/callback?id=1"}, "hub.secret": {"s3cret"}, "hub.lease_seconds": {"3600"}})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("subscribe gave %d: %s", rec.Code, rec.Body)
+	}
+	if len(sub.verified) != 1 {
+		t.Fatalf("subscriber was asked to verify %d times", len(sub.verified))
+	}
+	query := sub.verified[0]
+	if query.Get("hub.mode") != "subscribe" || query.Get("hub.topic") != testTopic || query.Get("hub.lease_seconds") != "3600" || query.Get("id") != "1" {
+		t.Errorf("verification request had query %v", query)
+	}
+	subs, err := h.Subscriptions(ctx, "digest")
+	if err != nil {
+		t.Fatalf("list subscriptions: %v", err)
+	}
+	if len(subs) != 1 || subs[0].Callback != sub.URL+"/callback?id=1" {
+		t.Fatalf("subscriptions are %+v", subs)
+	}
+
+	content := `<?xml version="1.0"?><rss version="2.0"></rss>`
+	err = h.Publish(ctx, "digest", "application/rss+xml", []byte(content))
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if len(sub.deliveries) != 1 || sub.bodies[0] != content {
+		t.Fatalf("subscriber received %q", sub.bodies)
+	}
+	delivery := sub.deliveries[0]
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(content))
+	if signature := delivery.Header.Get("X-Hub-Signature"); signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("signature is %s", signature)
+	}
+	if link := delivery.Header.Get("Link"); link != `<https://connor.zip/email2rss/hub>; rel="hub", <`+testTopic+`>; rel="self"` {
+		t.Errorf("Link is %s", link)
+	}
+	if ct := delivery.Header.Get("Content-Type"); ct != "application/rss+xml" {
+		t.Errorf("Content-Type is %s", ct)
+	}
+
+	rec = request(h, url.Values{"hub.mode": {"unsubscribe"}, "hub.topic": {testTopic}, "hub.callback": {sub.URL + "/callback?id=1"}})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("unsubscribe gave %d: %s", rec.Code, rec.Body)
+	}
+	subs, err = h.Subscriptions(ctx, "digest")
+	if err != nil || len(subs) != 0 {
+		t.Errorf("subscriptions after unsubscribing are %+v, %v", subs, err)
+	}
+}
+
+func TestSubscribeUnconfirmed(t *testing.T) {
+	ctx := context.Background()
+	h, _ := newTestHub(t)
+	sub := newSubscriber(t)
+	sub.confirm = false
+
+	// Anyone can ask the hub to subscribe a callback, which must confirm it
+	request(h, url.Values{"hub.mode": {"subscribe"}, "hub.topic": {testTopic}, "hub.callback": {sub.URL}})
+	subs, err := h.Subscriptions(ctx, "digest")
+	if err != nil || len(subs) != 0 {
+		t.Errorf("unconfirmed subscriptions are %+v, %v", subs, err)
+	}
+
+	tests := []struct {
+		form url.Values
+		code int
+	}{
+		{url.Values{"hub.mode": {"publish"}, "hub.topic": {testTopic}, "hub.callback": {sub.URL}}, http.StatusBadRequest},
+		{url.Values{"hub.mode": {"subscribe"}, "hub.topic": {"https://example.com/feed"}, "hub.callback": {sub.URL}}, http.StatusNotFound},
+		{url.Values{"hub.mode": {"subscribe"}, "hub.topic": {testTopic}, "hub.callback": {"/relative"}}, http.StatusBadRequest},
+		{url.Values{"hub.mode": {"subscribe"}, "hub.topic": {testTopic}, "hub.callback": {sub.URL}, "hub.lease_seconds": {"-1"}}, http.StatusBadRequest},
+		{url.Values{"hub.mode": {"subscribe"}, "hub.topic": {testTopic}, "hub.callback": {sub.URL}, "hub.secret": {strings.Repeat("s", 200)}}, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if rec := request(h, test.form); rec.Code != test.code {
+			t.Errorf("request %v gave %d, expected %d", test.form, rec.Code, test.code)
+		}
+	}
+}
+
+func TestPublishDropsSubscribers(t *testing.T) {
+	ctx := context.Background()
+	h, bucket := newTestHub(t)
+	gone := newSubscriber(t)
+	gone.status = http.StatusGone
+	expired := newSubscriber(t)
+	failing := newSubscriber(t)
+	failing.status = http.StatusBadRequest
+
+	for _, sub := range []*subscriber{gone, expired, failing} {
+		request(h, url.Values{"hub.mode": {"subscribe"}, "hub.topic": {testTopic}, "hub.callback": {sub.URL}})
+	}
+	// Expire one of the leases
+	key := subscriptionKey("digest", expired.URL)
+	err := bucket.WriteAll(ctx, key, []byte(`{"feed":"digest","topic":"`+testTopic+`","callback":"`+expired.URL+`","expires":"`+time.Now().Add(-time.Hour).Format(time.RFC3339)+`"}`), nil)
+	if err != nil {
+		t.Fatalf("write subscription: %v", err)
+	}
+
+	err = h.Publish(ctx, "digest", "application/rss+xml", []byte("<rss/>"))
+	if err == nil || !strings.Contains(err.Error(), "400 Bad Request") {
+		t.Errorf("publish gave %v, expected the failing subscriber's error", err)
+	}
+	if len(expired.deliveries) != 0 {
+		t.Errorf("expired subscriber received the feed")
+	}
+	subs, err := h.Subscriptions(ctx, "digest")
+	if err != nil {
+		t.Fatalf("list subscriptions: %v", err)
+	}
+	// Subscribers which fail are retried on the next publication
+	if len(subs) != 1 || subs[0].Callback != failing.URL {
+		t.Errorf("subscriptions are %+v, expected only the failing subscriber", subs)
+	}
+}
+
+func TestPing(t *testing.T) {
+	var form url.Values
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		form = req.PostForm
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer hub.Close()
+
+	err := Ping(context.Background(), hub.Client(), hub.URL, testTopic)
+	if err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if form.Get("hub.mode") != "publish" || form.Get("hub.url") != testTopic {
+		t.Errorf("hub received %v", form)
+	}
+}
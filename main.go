@@ -9,6 +9,8 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/cptaffe/email2rss/internal/config"
+	"github.com/cptaffe/email2rss/internal/fetch"
 	"github.com/cptaffe/email2rss/internal/server"
 	"gocloud.dev/blob"
 	_ "gocloud.dev/blob/gcsblob"
@@ -16,6 +18,9 @@ import (
 
 var (
 	templatePath = flag.String("templates", "", "Path to the templates folder")
+	offline      = flag.Bool("offline", false, "Store items without fetching data such as audio sizes from the network")
+	configPath   = flag.String("config", "", "Path to a JSON file configuring each feed")
+	fetchTimeout = flag.Duration("fetch-timeout", fetch.DefaultOptions.Timeout, "Timeout for each request backends make to the network")
 )
 
 func main() {
@@ -23,6 +28,13 @@ func main() {
 	ctx := context.Background()
 	signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 
+	opts := fetch.DefaultOptions
+	opts.Offline = *offline
+	opts.Timeout = *fetchTimeout
+	if flag.Arg(0) == "validate" {
+		os.Exit(validateFeeds(ctx, fetch.NewClient(opts), flag.Args()[1:]))
+	}
+
 	bucket, err := blob.OpenBucket(ctx, "gs://connor.zip")
 	if err != nil {
 		log.Fatalf("open bucket: %v", err)
@@ -30,7 +42,32 @@ func main() {
 	}
 	defer bucket.Close()
 
-	s, err := server.NewServer(ctx, *templatePath, bucket)
+	cfg := config.Default()
+	if *configPath != "" {
+		cfg, err = config.Load(*configPath)
+		if err != nil {
+			log.Fatalf("load config: %v", err)
+		}
+	}
+
+	switch flag.Arg(0) {
+	case "history":
+		status := history(ctx, bucket, flag.Args()[1:])
+		bucket.Close()
+		os.Exit(status)
+	case "rollback":
+		status := rollback(ctx, bucket, cfg, flag.Args()[1:])
+		bucket.Close()
+		os.Exit(status)
+	}
+
+	// The server fetches URLs found in emails, so it mustn't reach addresses on the local network
+	opts.PublicOnly = true
+	// Webhooks are configured rather than found in emails, so they may be
+	webhookOpts := server.WebhookOptions
+	webhookOpts.Offline = *offline
+	webhookOpts.Timeout = *fetchTimeout
+	s, err := server.NewServer(ctx, *templatePath, bucket, server.WithHTTPClient(fetch.NewClient(opts)), server.WithWebhookClient(fetch.NewClient(webhookOpts)), server.WithConfig(cfg))
 	if err != nil {
 		log.Fatalf("init server: %v", err)
 	}
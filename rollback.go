@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/cptaffe/email2rss/internal/config"
+	"github.com/cptaffe/email2rss/internal/server"
+	"gocloud.dev/blob"
+)
+
+// history prints the versions of a feed which can be restored, newest first
+func history(ctx context.Context, bucket *blob.Bucket, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: email2rss history FEED")
+		return 2
+	}
+	versions, err := server.History(ctx, bucket, args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "list history: %v\n", err)
+		return 1
+	}
+	for _, version := range versions {
+		fmt.Printf("%s\t%d bytes\n", version.Version, version.Size)
+	}
+	return 0
+}
+
+// rollback restores a version of a feed, the most recent one if none is given
+func rollback(ctx context.Context, bucket *blob.Bucket, cfg *config.Config, args []string) int {
+	if len(args) != 1 && len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: email2rss rollback FEED [VERSION]")
+		return 2
+	}
+	var version string
+	if len(args) == 2 {
+		version = args[1]
+	}
+	version, err := server.Rollback(ctx, bucket, args[0], version, cfg.Feed(args[0]).HistoryLength())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "roll back feed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("restored %s\n", version)
+	return 0
+}
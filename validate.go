@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/cptaffe/email2rss/internal/validate"
+)
+
+// validateFeeds checks each feed, given as a path, an http(s) URL or "-" for stdin,
+// printing its problems and returning the exit status
+func validateFeeds(ctx context.Context, client *http.Client, feeds []string) int {
+	if len(feeds) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: email2rss validate FEED...")
+		return 2
+	}
+	status := 0
+	for _, feed := range feeds {
+		b, err := readFeed(ctx, client, feed)
+		if err == nil {
+			err = validate.Feed(b)
+		}
+		if err != nil {
+			fmt.Printf("%s:\n%s\n", feed, indent(err.Error()))
+			status = 1
+			continue
+		}
+		fmt.Printf("%s: ok\n", feed)
+	}
+	return status
+}
+
+func readFeed(ctx context.Context, client *http.Client, feed string) ([]byte, error) {
+	switch {
+	case feed == "-":
+		return io.ReadAll(os.Stdin)
+	case strings.HasPrefix(feed, "http://") || strings.HasPrefix(feed, "https://"):
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, feed, nil)
+		if err != nil {
+			return nil, fmt.Errorf("construct request: %w", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("fetch feed: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetch feed: %s", resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	}
+	return os.ReadFile(feed)
+}
+
+func indent(s string) string {
+	return "  " + strings.ReplaceAll(s, "\n", "\n  ")
+}